@@ -1,14 +1,29 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/bentito/clusterextensionhelper/pkg/webhook"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "revert" {
+		if err := runRevert(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("revert: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rules" {
+		if err := runRules(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("rules: %v", err)
+		}
+		return
+	}
+
 	// Load TLS certificates (you need to generate these and mount them into the container)
 	cert, err := tls.LoadX509KeyPair("/certs/tls.crt", "/certs/tls.key")
 	if err != nil {
@@ -22,7 +37,38 @@ func main() {
 		},
 	}
 
+	// Apply corrections proposed in approve mode once they are approved
+	if os.Getenv("PROPOSAL_CONTROLLER_ENABLED") == "true" {
+		go func() {
+			if err := webhook.RunProposalController(context.Background()); err != nil {
+				log.Printf("Proposal controller stopped: %v", err)
+			}
+		}()
+	}
+
+	// Delete the ConfigMaps holding originals once they expire
+	go func() {
+		if err := webhook.RunOriginalPruner(context.Background()); err != nil {
+			log.Printf("Original pruner stopped: %v", err)
+		}
+	}()
+
+	// The shadow report is not authenticated, so it is only served on the loopback address, outside the
+	// webhook's port
+	reportAddr := os.Getenv("SHADOW_REPORT_ADDR")
+	if reportAddr == "" {
+		reportAddr = "127.0.0.1:8081"
+	}
+	reportMux := http.NewServeMux()
+	reportMux.HandleFunc("/shadow/report", webhook.ShadowReport)
+	go func() {
+		if err := http.ListenAndServe(reportAddr, reportMux); err != nil {
+			log.Printf("Shadow report server stopped: %v", err)
+		}
+	}()
+
 	http.HandleFunc("/mutate", webhook.Mutate)
+	http.HandleFunc("/validate", webhook.Validate)
 
 	log.Println("Starting webhook server...")
 	if err := server.ListenAndServeTLS("", ""); err != nil {
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bentito/clusterextensionhelper/pkg/webhook"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+// runRevert implements the revert subcommand: it shows the original spec, or corrected fields, saved by the
+// webhook next to the current ones of a corrected object and prints, or applies, the JSON patch that
+// restores them.
+func runRevert(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("revert", flag.ContinueOnError)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig file (defaults to KUBECONFIG or ~/.kube/config)")
+	group := flags.String("group", "olm.operatorframework.io", "API group of the corrected object")
+	version := flags.String("version", "v1alpha1", "API version of the corrected object")
+	resource := flags.String("resource", "clusterextensions", "resource name of the corrected object")
+	namespace := flags.String("namespace", "", "namespace of the corrected object, for namespaced resources")
+	apply := flags.Bool("apply", false, "apply the reverse patch instead of only printing it")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s revert [flags] NAME\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected the name of one object")
+	}
+	name := flags.Arg(0)
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = *kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	gvr := schema.GroupVersionResource{Group: *group, Version: *version, Resource: *resource}
+	objects := dynamicClient.Resource(gvr).Namespace(*namespace)
+	current, err := objects.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	original, err := webhook.OriginalFields(ctx, clientset, current)
+	if err != nil {
+		return err
+	}
+
+	currentFields := map[string]interface{}{}
+	for field := range original {
+		currentFields[field] = current.Object[field]
+	}
+	originalYAML, err := yaml.Marshal(original)
+	if err != nil {
+		return err
+	}
+	currentYAML, err := yaml.Marshal(currentFields)
+	if err != nil {
+		return err
+	}
+	patch, err := webhook.RevertPatch(current, original)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Original of %s:\n\n%s\n", name, originalYAML)
+	fmt.Fprintf(out, "Changes made by the correction (- original, + current):\n\n%s\n", webhook.LineDiff(string(originalYAML), string(currentYAML)))
+	fmt.Fprintf(out, "Reverse patch:\n\n%s\n", patch)
+
+	fmt.Fprintf(out, "\nThe patch turns the mode of %s off, so the webhook doesn't correct the original again. Remove the mode annotation once the source manifest is fixed.\n", name)
+	if !*apply {
+		namespaceFlag := ""
+		if *namespace != "" {
+			namespaceFlag = " -n " + *namespace
+		}
+		fmt.Fprintf(out, "\nApply it with --apply, or with:\n\n  kubectl patch %s.%s %s%s --type=json -p '%s'\n", *resource, *group, name, namespaceFlag, patch)
+		return nil
+	}
+	if _, err := objects.Patch(ctx, name, types.JSONPatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to apply reverse patch: %v", err)
+	}
+	fmt.Fprintf(out, "\nReverted %s.\n", name)
+	return nil
+}
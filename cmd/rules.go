@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bentito/clusterextensionhelper/pkg/webhook"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// targetRoleName names the ClusterRole and ClusterRoleBinding printed by rules --rbac.
+const targetRoleName = "webhook-correction-targets"
+
+// runRules implements the rules subcommand: it prints the webhook rules that send the kinds in a
+// correction targets file to the webhook, as YAML or as a JSON patch for a webhook configuration, or the
+// RBAC that lets the webhook apply approved corrections to them.
+func runRules(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("rules", flag.ContinueOnError)
+	targets := flags.String("targets", os.Getenv("CORRECTION_TARGETS_FILE"), "path to the correction targets file (defaults to CORRECTION_TARGETS_FILE, or ClusterExtensions only)")
+	patch := flags.Bool("patch", false, "print a JSON patch that replaces the rules of the first webhook, for kubectl patch --type=json")
+	rbac := flags.Bool("rbac", false, "print a ClusterRole and ClusterRoleBinding that let the webhook apply approved corrections to the targets, for kubectl apply")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s rules [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var data []byte
+	if *targets != "" {
+		var err error
+		if data, err = os.ReadFile(*targets); err != nil {
+			return err
+		}
+	}
+	if *rbac {
+		return printTargetRBAC(data, out)
+	}
+	rules, err := webhook.WebhookRules(data)
+	if err != nil {
+		return err
+	}
+
+	if *patch {
+		operations := []map[string]interface{}{{"op": "replace", "path": "/webhooks/0/rules", "value": rules}}
+		encoded, err := json.Marshal(operations)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(encoded))
+		return nil
+	}
+	encoded, err := yaml.Marshal(map[string]interface{}{"rules": rules})
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(out, string(encoded))
+	return nil
+}
+
+// printTargetRBAC prints the ClusterRole the webhook needs to write the targets, bound to its service account.
+func printTargetRBAC(data []byte, out io.Writer) error {
+	rules, err := webhook.TargetRBACRules(data)
+	if err != nil {
+		return err
+	}
+	role := map[string]interface{}{
+		"apiVersion": "rbac.authorization.k8s.io/v1",
+		"kind":       "ClusterRole",
+		"metadata":   map[string]interface{}{"name": targetRoleName},
+		"rules":      rules,
+	}
+	binding := map[string]interface{}{
+		"apiVersion": "rbac.authorization.k8s.io/v1",
+		"kind":       "ClusterRoleBinding",
+		"metadata":   map[string]interface{}{"name": targetRoleName},
+		"subjects":   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "webhook-service-account", Namespace: "default"}},
+		"roleRef":    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: targetRoleName},
+	}
+	for i, object := range []map[string]interface{}{role, binding} {
+		encoded, err := yaml.Marshal(object)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(out, "---")
+		}
+		fmt.Fprint(out, string(encoded))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+func init() {
+	utilruntime.Must(admissionv1.AddToScheme(scheme))
+	utilruntime.Must(admissionv1beta1.AddToScheme(scheme))
+}
+
+// serveAdmission decodes an admission review, passes it to review and writes the response. Reviews are
+// accepted in admission.k8s.io/v1 and v1beta1, and answered in the version they came in; review always
+// sees a v1 review. An error from review is returned as an internal server error.
+func serveAdmission(w http.ResponseWriter, r *http.Request, review func(*admissionv1.AdmissionReview) (*admissionv1.AdmissionResponse, error)) {
+	var body []byte
+	if r.Body != nil {
+		if data, err := io.ReadAll(r.Body); err == nil {
+			body = data
+		}
+	}
+
+	if len(body) == 0 {
+		http.Error(w, "Empty request body", http.StatusBadRequest)
+		return
+	}
+
+	// Verify the content type is accurate
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "Invalid Content-Type, expected application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	admissionReview, reply, err := decodeAdmissionReview(body)
+	if err != nil {
+		log.Printf("Could not decode body: %v", err)
+		http.Error(w, fmt.Sprintf("Could not decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Process the AdmissionRequest
+	admissionResponse, err := review(admissionReview)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send response
+	admissionResponse.UID = admissionReview.Request.UID
+	respBytes, err := json.Marshal(reply(admissionResponse))
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+		http.Error(w, fmt.Sprintf("Could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, writeErr := w.Write(respBytes)
+	if writeErr != nil {
+		log.Printf("Error while sending response: %v", writeErr)
+		return
+	}
+}
+
+// decodeAdmissionReview decodes an admission review of any supported version into a v1 review. It also
+// returns the function that wraps a response in a review of the version the request came in.
+func decodeAdmissionReview(body []byte) (*admissionv1.AdmissionReview, func(*admissionv1.AdmissionResponse) interface{}, error) {
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		review *admissionv1.AdmissionReview
+		reply  func(*admissionv1.AdmissionResponse) interface{}
+	)
+	switch in := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		review = in
+		reply = func(response *admissionv1.AdmissionResponse) interface{} {
+			out := &admissionv1.AdmissionReview{Response: response}
+			out.SetGroupVersionKind(admissionv1.SchemeGroupVersion.WithKind("AdmissionReview"))
+			return out
+		}
+	case *admissionv1beta1.AdmissionReview:
+		review = &admissionv1.AdmissionReview{}
+		if in.Request != nil {
+			review.Request = convertAdmissionRequest(in.Request)
+		}
+		reply = func(response *admissionv1.AdmissionResponse) interface{} {
+			out := &admissionv1beta1.AdmissionReview{Response: convertAdmissionResponse(response)}
+			out.SetGroupVersionKind(admissionv1beta1.SchemeGroupVersion.WithKind("AdmissionReview"))
+			return out
+		}
+	default:
+		return nil, nil, fmt.Errorf("expected an AdmissionReview, got %s", gvk)
+	}
+
+	if review.Request == nil {
+		return nil, nil, fmt.Errorf("%s has no request", gvk)
+	}
+	if review.Request.UID == "" {
+		return nil, nil, fmt.Errorf("%s request has no uid", gvk)
+	}
+	return review, reply, nil
+}
+
+// convertAdmissionRequest converts a v1beta1 admission request to v1. The two versions have the same fields.
+func convertAdmissionRequest(in *admissionv1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	return &admissionv1.AdmissionRequest{
+		UID:                in.UID,
+		Kind:               in.Kind,
+		Resource:           in.Resource,
+		SubResource:        in.SubResource,
+		RequestKind:        in.RequestKind,
+		RequestResource:    in.RequestResource,
+		RequestSubResource: in.RequestSubResource,
+		Name:               in.Name,
+		Namespace:          in.Namespace,
+		Operation:          admissionv1.Operation(in.Operation),
+		UserInfo:           in.UserInfo,
+		Object:             in.Object,
+		OldObject:          in.OldObject,
+		DryRun:             in.DryRun,
+		Options:            in.Options,
+	}
+}
+
+// convertAdmissionResponse converts a v1 admission response to v1beta1.
+func convertAdmissionResponse(in *admissionv1.AdmissionResponse) *admissionv1beta1.AdmissionResponse {
+	out := &admissionv1beta1.AdmissionResponse{
+		UID:              in.UID,
+		Allowed:          in.Allowed,
+		Result:           in.Result,
+		Patch:            in.Patch,
+		AuditAnnotations: in.AuditAnnotations,
+		Warnings:         in.Warnings,
+	}
+	if in.PatchType != nil {
+		patchType := admissionv1beta1.PatchType(*in.PatchType)
+		out.PatchType = &patchType
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+)
+
+// reviewJSON is an admission review with a ClusterExtension, in the version given.
+func reviewJSON(t *testing.T, apiVersion string) string {
+	t.Helper()
+	return `{"apiVersion": "` + apiVersion + `", "kind": "AdmissionReview", "request": {
+		"uid": "test-uid", "operation": "CREATE", "dryRun": true,
+		"kind": {"group": "olm.operatorframework.io", "version": "v1alpha1", "kind": "ClusterExtension"},
+		"resource": {"group": "olm.operatorframework.io", "version": "v1alpha1", "resource": "clusterextensions"},
+		"object": ` + string(mustJSON(t, validCRYAML)) + `}}`
+}
+
+// serve sends body to serveAdmission and returns the recorded response. The review answers with a patch.
+func serve(t *testing.T, body, contentType string) (*httptest.ResponseRecorder, *admissionv1.AdmissionReview) {
+	t.Helper()
+	var seen *admissionv1.AdmissionReview
+	request := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(body))
+	request.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	serveAdmission(recorder, request, func(ar *admissionv1.AdmissionReview) (*admissionv1.AdmissionResponse, error) {
+		seen = ar
+		patchType := admissionv1.PatchTypeJSONPatch
+		return &admissionv1.AdmissionResponse{Allowed: true, Patch: []byte("[]"), PatchType: &patchType, Warnings: []string{"checked"}}, nil
+	})
+	return recorder, seen
+}
+
+func TestServeAdmission_Versions(t *testing.T) {
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		recorder, seen := serve(t, reviewJSON(t, apiVersion), "application/json; charset=utf-8")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", apiVersion, recorder.Code, recorder.Body)
+		}
+		if seen.Request.Operation != admissionv1.Create || seen.Request.Resource.Resource != "clusterextensions" || seen.Request.DryRun == nil || !*seen.Request.DryRun {
+			t.Errorf("%s: the request was not decoded: %+v", apiVersion, seen.Request)
+		}
+		if cr := parseCR(t, string(seen.Request.Object.Raw)); cr.GetName() != "argocd" {
+			t.Errorf("%s: unexpected object %s", apiVersion, seen.Request.Object.Raw)
+		}
+
+		// The reply is in the version of the request
+		var reply struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Request    *json.RawMessage
+			Response   *admissionv1beta1.AdmissionResponse
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("%s: invalid reply: %v", apiVersion, err)
+		}
+		if reply.APIVersion != apiVersion || reply.Kind != "AdmissionReview" || reply.Request != nil {
+			t.Errorf("%s: unexpected reply %s", apiVersion, recorder.Body)
+		}
+		if response := reply.Response; response == nil || response.UID != "test-uid" || !response.Allowed ||
+			response.PatchType == nil || *response.PatchType != admissionv1beta1.PatchTypeJSONPatch || len(response.Warnings) != 1 {
+			t.Errorf("%s: unexpected response %s", apiVersion, recorder.Body)
+		}
+	}
+}
+
+func TestServeAdmission_BadRequests(t *testing.T) {
+	valid := reviewJSON(t, "admission.k8s.io/v1")
+	for name, test := range map[string]struct {
+		body, contentType string
+		code              int
+	}{
+		"empty body":         {"", "application/json", http.StatusBadRequest},
+		"wrong content":      {valid, "application/yaml", http.StatusUnsupportedMediaType},
+		"not JSON":           {"{", "application/json", http.StatusBadRequest},
+		"missing apiVersion": {strings.Replace(valid, `"apiVersion": "admission.k8s.io/v1", `, "", 1), "application/json", http.StatusBadRequest},
+		"missing kind":       {strings.Replace(valid, `"kind": "AdmissionReview", `, "", 1), "application/json", http.StatusBadRequest},
+		"unknown version":    {reviewJSON(t, "admission.k8s.io/v2"), "application/json", http.StatusBadRequest},
+		"mismatched kind":    {strings.Replace(valid, `"kind": "AdmissionReview"`, `"kind": "AdmissionRequest"`, 1), "application/json", http.StatusBadRequest},
+		"other kind":         {`{"apiVersion": "v1", "kind": "Status"}`, "application/json", http.StatusBadRequest},
+		"missing request":    {`{"apiVersion": "admission.k8s.io/v1beta1", "kind": "AdmissionReview"}`, "application/json", http.StatusBadRequest},
+		"missing uid":        {strings.Replace(valid, `"uid": "test-uid", `, "", 1), "application/json", http.StatusBadRequest},
+	} {
+		recorder, seen := serve(t, test.body, test.contentType)
+		if recorder.Code != test.code {
+			t.Errorf("%s: expected %d, got %d: %s", name, test.code, recorder.Code, recorder.Body)
+		}
+		if seen != nil {
+			t.Errorf("%s: the review should not have been processed", name)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// proposalResync is how often every proposal is looked at again, which is how expired proposals are
+// noticed.
+const proposalResync = time.Minute
+
+// proposalTimeout bounds the API calls made for one proposal.
+const proposalTimeout = 30 * time.Second
+
+// proposalController applies approved proposals to their targets and deletes expired ones.
+type proposalController struct {
+	client dynamic.Interface
+}
+
+// RunProposalController watches ClusterExtensionCorrections until ctx is done. When a proposal is
+// approved, it applies the proposed patch to the submitted object and writes the result: it creates the
+// object for a CREATE, and updates it for an UPDATE if it hasn't changed since. Only proposals signed by
+// the webhook, for one of its correction targets, and approved after they were created are applied.
+// Proposals are deleted once they expire, whatever their phase.
+func RunProposalController(ctx context.Context) error {
+	client, err := kubeDynamicClient()
+	if err != nil {
+		return err
+	}
+	controller := &proposalController{client: client}
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, proposalResync)
+	informer := factory.ForResource(proposalGVR).Informer()
+	handle := func(obj interface{}) {
+		if proposal, ok := obj.(*unstructured.Unstructured); ok {
+			controller.reconcile(ctx, proposal)
+		}
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    handle,
+		UpdateFunc: func(_, obj interface{}) { handle(obj) },
+	}); err != nil {
+		return err
+	}
+
+	log.Printf("Watching %s for approved corrections", proposalGVR.Resource)
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync %s", proposalGVR.Resource)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// reconcile deletes an expired proposal, or applies an approved one that is still pending.
+func (c *proposalController) reconcile(ctx context.Context, proposal *unstructured.Unstructured) {
+	ctx, cancel := context.WithTimeout(ctx, proposalTimeout)
+	defer cancel()
+	name := proposal.GetName()
+
+	expiresAt, _, _ := unstructured.NestedString(proposal.Object, "spec", "expiresAt")
+	if expiry, err := time.Parse(time.RFC3339, expiresAt); err == nil && !now().Before(expiry) {
+		log.Printf("Deleting expired proposal %s", name)
+		err := c.client.Resource(proposalGVR).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("Failed to delete expired proposal %s: %v", name, err)
+		}
+		return
+	}
+
+	phase, _, _ := unstructured.NestedString(proposal.Object, "status", "phase")
+	approved, _, _ := unstructured.NestedBool(proposal.Object, "spec", "approved")
+	if !approved || (phase != "" && phase != proposalPending) {
+		return
+	}
+
+	log.Printf("Applying approved proposal %s", name)
+	status := map[string]interface{}{"phase": proposalApplied, "appliedAt": now().UTC().Format(time.RFC3339)}
+	if err := c.apply(ctx, proposal); err != nil {
+		log.Printf("Failed to apply proposal %s: %v", name, err)
+		status = map[string]interface{}{"phase": proposalFailed, "message": err.Error()}
+	}
+
+	updated := proposal.DeepCopy()
+	updated.Object["status"] = status
+	if _, err := c.client.Resource(proposalGVR).UpdateStatus(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		log.Printf("Failed to update the status of proposal %s: %v", name, err)
+	}
+}
+
+// apply writes the corrected object of a proposal to its target.
+func (c *proposalController) apply(ctx context.Context, proposal *unstructured.Unstructured) error {
+	// The controller writes with the webhook's permissions: only apply what the webhook proposed, for the
+	// kinds it corrects, once a person has approved it
+	if err := verifyProposal(proposal); err != nil {
+		return err
+	}
+	if proposal.GetGeneration() < 2 {
+		return fmt.Errorf("proposal was approved when it was created")
+	}
+
+	spec, _, _ := unstructured.NestedMap(proposal.Object, "spec")
+	target, _, _ := unstructured.NestedStringMap(spec, "target")
+	original, _, _ := unstructured.NestedString(spec, "original")
+	patch, _, _ := unstructured.NestedString(spec, "patch")
+	operation, _, _ := unstructured.NestedString(spec, "operation")
+	if target["resource"] == "" || (target["name"] == "" && target["generateName"] == "") || original == "" {
+		return fmt.Errorf("proposal has no target or original object")
+	}
+	if target["name"] == "" && operation != string(admissionv1.Create) {
+		return fmt.Errorf("proposal of an update has no target name")
+	}
+	gvr := schema.GroupVersionResource{Group: target["group"], Version: target["version"], Resource: target["resource"]}
+	targets, err := loadCorrectionTargets()
+	if err != nil {
+		return fmt.Errorf("failed to load correction targets: %v", err)
+	}
+	if targets.lookupResource(gvr) == nil {
+		return fmt.Errorf("%s is not a correction target", gvr)
+	}
+
+	corrected, err := applyProposalPatch(original, patch)
+	if err != nil {
+		return err
+	}
+	if corrected.GetName() != target["name"] || corrected.GetGenerateName() != target["generateName"] {
+		return fmt.Errorf("corrected object is named %q, not %q", corrected.GetName(), target["name"])
+	}
+	objects := c.client.Resource(gvr).Namespace(target["namespace"])
+
+	// Save the original now that the correction is applied, as auto-fix does when it patches an object
+	if corrected.GetLabels()[correctedLabel] == "true" {
+		submitted := &unstructured.Unstructured{}
+		if err := submitted.UnmarshalJSON([]byte(original)); err != nil {
+			return err
+		}
+		if err := saveOriginal(ctx, &admissionv1.AdmissionRequest{UID: proposal.GetUID()}, submitted, corrected); err != nil {
+			log.Printf("Failed to save the original of proposal %s: %v", proposal.GetName(), err)
+		}
+	}
+
+	for _, field := range serverManagedMetadata {
+		unstructured.RemoveNestedField(corrected.Object, "metadata", field)
+	}
+	if operation == string(admissionv1.Create) {
+		if _, err := objects.Create(ctx, corrected, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create %s %s: %v", gvr.Resource, target["name"], err)
+		}
+		return nil
+	}
+
+	// The update only goes through if the object is still the one the correction was made against
+	baseResourceVersion, _, _ := unstructured.NestedString(spec, "baseResourceVersion")
+	if baseResourceVersion == "" {
+		return fmt.Errorf("proposal of an update has no baseResourceVersion")
+	}
+	current, err := objects.Get(ctx, target["name"], metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if current.GetResourceVersion() != baseResourceVersion {
+		return fmt.Errorf("%s %s changed since the correction was proposed", gvr.Resource, target["name"])
+	}
+	corrected.SetResourceVersion(current.GetResourceVersion())
+	if _, err := objects.Update(ctx, corrected, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update %s %s: %v", gvr.Resource, target["name"], err)
+	}
+	return nil
+}
+
+// applyProposalPatch applies the JSON patch of a proposal to the submitted object.
+func applyProposalPatch(original, patch string) (*unstructured.Unstructured, error) {
+	correctedJSON := []byte(original)
+	if patch != "" {
+		decoded, err := jsonpatch.DecodePatch([]byte(patch))
+		if err != nil {
+			return nil, fmt.Errorf("invalid patch: %v", err)
+		}
+		if correctedJSON, err = decoded.Apply(correctedJSON); err != nil {
+			return nil, fmt.Errorf("failed to apply patch: %v", err)
+		}
+	}
+	corrected := &unstructured.Unstructured{}
+	if err := corrected.UnmarshalJSON(correctedJSON); err != nil {
+		return nil, err
+	}
+	return corrected, nil
+}
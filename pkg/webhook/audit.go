@@ -0,0 +1,135 @@
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// auditRecord is written for every request that reached the model. Reasoning is kept here rather than in
+// the regular log, since it can be long and is only needed when investigating a correction.
+type auditRecord struct {
+	Time      time.Time  `json:"time"`
+	UID       string     `json:"uid,omitempty"`
+	Kind      string     `json:"kind"`
+	Namespace string     `json:"namespace,omitempty"`
+	Name      string     `json:"name"`
+	Provider  string     `json:"provider"`
+	Model     string     `json:"model"`
+	Reasoning string     `json:"reasoning,omitempty"`
+	Usage     tokenUsage `json:"usage"`
+	Error     string     `json:"error,omitempty"`
+}
+
+var recordMu sync.Mutex
+
+// writeAuditRecord appends the record as one JSON line to the file named by AUDIT_LOG_PATH, or to the
+// regular log if it is not set.
+func writeAuditRecord(record auditRecord) {
+	writeRecord("AUDIT_LOG_PATH", "Audit", record)
+}
+
+// writeRecord appends a record as one JSON line to the file named by the environment variable, or to the
+// regular log, after label, if it is not set.
+func writeRecord(pathVariable, label string, record interface{}) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to marshal %s record: %v", strings.ToLower(label), err)
+		return
+	}
+
+	path := os.Getenv(pathVariable)
+	if path == "" {
+		log.Printf("%s: %s", label, data)
+		return
+	}
+
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Failed to open %s log %s: %v", strings.ToLower(label), path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write %s log %s: %v", strings.ToLower(label), path, err)
+	}
+}
+
+// usageTotals accumulates token usage for one model.
+type usageTotals struct {
+	requests         int
+	promptTokens     int
+	completionTokens int
+	reasoningTokens  int
+}
+
+var (
+	usageMu     sync.Mutex
+	usageLedger = map[string]*usageTotals{}
+)
+
+// measureUsage returns a completion's token usage, with reasoning tokens counted separately. Counts the
+// server didn't report are estimated.
+func measureUsage(provider, model, prompt string, completion *chatCompletion) tokenUsage {
+	usage := completion.usage
+	estimator := estimatorForModel(provider, model)
+	if usage.PromptTokens == 0 {
+		usage.PromptTokens = estimator.countTokens(prompt)
+	}
+	if usage.ReasoningTokens == 0 && completion.reasoning != "" {
+		usage.ReasoningTokens = estimator.countTokens(completion.reasoning)
+	}
+	if usage.CompletionTokens == 0 {
+		usage.CompletionTokens = estimator.countTokens(completion.content) + usage.ReasoningTokens
+	}
+	return usage
+}
+
+// addUsage adds token usage to the running totals for the model and logs them, with reasoning tokens
+// separate from answer tokens.
+func addUsage(provider, model string, usage tokenUsage) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	key := provider + "/" + model
+	totals, ok := usageLedger[key]
+	if !ok {
+		totals = &usageTotals{}
+		usageLedger[key] = totals
+	}
+	totals.requests++
+	totals.promptTokens += usage.PromptTokens
+	totals.completionTokens += usage.CompletionTokens
+	totals.reasoningTokens += usage.ReasoningTokens
+
+	log.Printf("Token usage for %s: prompt %d, answer %d, reasoning %d (totals over %d requests: prompt %d, answer %d, reasoning %d)",
+		key, usage.PromptTokens, usage.CompletionTokens-usage.ReasoningTokens, usage.ReasoningTokens,
+		totals.requests, totals.promptTokens, totals.completionTokens-totals.reasoningTokens, totals.reasoningTokens)
+}
+
+// auditCorrection writes the audit record for a correction the model answered, accepted or not.
+func auditCorrection(req *admissionv1.AdmissionRequest, cr *unstructured.Unstructured, client openaiClientInterface, correction *llmCorrection, err error) {
+	provider, model := describeClient(client)
+	record := auditRecord{
+		Time:      time.Now().UTC(),
+		UID:       string(req.UID),
+		Kind:      cr.GetKind(),
+		Namespace: cr.GetNamespace(),
+		Name:      cr.GetName(),
+		Provider:  provider,
+		Model:     model,
+		Reasoning: correction.reasoning,
+		Usage:     correction.usage,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	writeAuditRecord(record)
+}
@@ -0,0 +1,235 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// minResponseTokens is the smallest number of tokens kept free for the model's answer.
+const minResponseTokens = 512
+
+// messageOverheadTokens covers the system message and chat formatting around the prompt.
+const messageOverheadTokens = 32
+
+// promptLevel is one step of shrinking the prompt to fit the model's context window.
+type promptLevel string
+
+const (
+	promptLevelFullCRD      promptLevel = "full-crd"
+	promptLevelCondensedCRD promptLevel = "condensed-crd"
+	promptLevelFailingPaths promptLevel = "failing-paths"
+	promptLevelNoExamples   promptLevel = "failing-paths-no-examples"
+)
+
+// fitPrompt builds the largest prompt that fits the context window of the client's model.
+// It tries the full CRD, then the condensed CRD, then only the schema subtrees of the failing
+// paths, and finally drops the few-shot examples.
+func fitPrompt(client openaiClientInterface, cr *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition, in promptInput, validationErrors []string) (string, error) {
+	provider, model := describeClient(client)
+	estimator := estimatorForModel(provider, model)
+	window := contextWindowForModel(provider, model)
+	budget := window - max(minResponseTokens, 2*estimator.countTokens(in.crYAML)) - messageOverheadTokens
+
+	condensed, err := condenseCRD(crd, cr.GroupVersionKind().Version)
+	if err != nil {
+		return "", err
+	}
+	condensedYAML, err := yaml.Marshal(condensed)
+	if err != nil {
+		return "", err
+	}
+
+	failingYAML := condensedYAML
+	if paths := failingPaths(validationErrors); len(paths) > 0 {
+		failingYAML, err = yaml.Marshal(restrictToPaths(condensed, paths))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	levels := []struct {
+		level    promptLevel
+		crdYAML  string
+		examples []*correctionExample
+	}{
+		{promptLevelFullCRD, in.crdYAML, in.examples},
+		{promptLevelCondensedCRD, string(condensedYAML), in.examples},
+		{promptLevelFailingPaths, string(failingYAML), in.examples},
+		{promptLevelNoExamples, string(failingYAML), nil},
+	}
+
+	var tokens int
+	for _, l := range levels {
+		candidate := in
+		candidate.crdYAML = l.crdYAML
+		candidate.examples = l.examples
+		prompt := buildPrompt(candidate)
+		tokens = estimator.countTokens(prompt)
+		if tokens <= budget {
+			log.Printf("Prompt for %s model %s uses %d of %d tokens at level %s", provider, model, tokens, budget, l.level)
+			return prompt, nil
+		}
+		log.Printf("Prompt at level %s needs %d tokens, over the budget of %d for model %s", l.level, tokens, budget, model)
+	}
+
+	return "", classify(failureBudgetExhausted, fmt.Errorf("prompt needs %d tokens but model %s only has %d of its %d token context available", tokens, model, budget, window))
+}
+
+// failingPaths returns the field paths named by the given ValidateCR messages.
+func failingPaths(validationErrors []string) []string {
+	var paths []string
+	for _, message := range validationErrors {
+		if failure, ok := validationFailures[message]; ok {
+			paths = append(paths, failure.path)
+		}
+	}
+	return paths
+}
+
+// condenseCRD returns a reduced CRD with only the names, scope and the schema of the given version,
+// stripped of descriptions and the status subtree. All versions are kept if none matches.
+func condenseCRD(crd *apiextensionsv1.CustomResourceDefinition, version string) (map[string]interface{}, error) {
+	var versions []interface{}
+	for _, v := range crd.Spec.Versions {
+		if v.Name != version && hasVersion(crd, version) {
+			continue
+		}
+		entry := map[string]interface{}{"name": v.Name}
+		if v.Schema != nil && v.Schema.OpenAPIV3Schema != nil {
+			schema, err := runtime.DefaultUnstructuredConverter.ToUnstructured(v.Schema.OpenAPIV3Schema)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert schema of version %s: %v", v.Name, err)
+			}
+			schema = stripSchema(schema)
+			if properties, ok := schema["properties"].(map[string]interface{}); ok {
+				delete(properties, "status")
+			}
+			entry["schema"] = map[string]interface{}{"openAPIV3Schema": schema}
+		}
+		versions = append(versions, entry)
+	}
+
+	return map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"metadata":   map[string]interface{}{"name": crd.Name},
+		"spec": map[string]interface{}{
+			"group": crd.Spec.Group,
+			"names": map[string]interface{}{
+				"kind":     crd.Spec.Names.Kind,
+				"plural":   crd.Spec.Names.Plural,
+				"singular": crd.Spec.Names.Singular,
+			},
+			"scope":    string(crd.Spec.Scope),
+			"versions": versions,
+		},
+	}, nil
+}
+
+func hasVersion(crd *apiextensionsv1.CustomResourceDefinition, version string) bool {
+	for _, v := range crd.Spec.Versions {
+		if v.Name == version {
+			return true
+		}
+	}
+	return false
+}
+
+// stripSchema returns a copy of an OpenAPI schema without descriptions or examples.
+// Property names are left alone, so a property called "description" survives.
+func stripSchema(schema map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for key, value := range schema {
+		switch key {
+		case "description", "example", "externalDocs":
+			continue
+		case "properties", "patternProperties", "definitions":
+			if properties, ok := value.(map[string]interface{}); ok {
+				stripped := map[string]interface{}{}
+				for name, property := range properties {
+					if child, ok := property.(map[string]interface{}); ok {
+						stripped[name] = stripSchema(child)
+					}
+				}
+				value = stripped
+			}
+		case "items", "additionalProperties", "not":
+			if child, ok := value.(map[string]interface{}); ok {
+				value = stripSchema(child)
+			}
+		case "allOf", "anyOf", "oneOf":
+			if list, ok := value.([]interface{}); ok {
+				stripped := make([]interface{}, 0, len(list))
+				for _, item := range list {
+					if child, ok := item.(map[string]interface{}); ok {
+						stripped = append(stripped, stripSchema(child))
+					}
+				}
+				value = stripped
+			}
+		}
+		out[key] = value
+	}
+	return out
+}
+
+// restrictToPaths returns a copy of a condensed CRD whose schemas only describe the given field paths.
+// The parent of every failing field is kept whole; its ancestors keep only the properties along the path.
+func restrictToPaths(condensed map[string]interface{}, paths []string) map[string]interface{} {
+	out := runtime.DeepCopyJSON(condensed)
+	versions, _, _ := unstructured.NestedSlice(out, "spec", "versions")
+	for i, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		schema, found, _ := unstructured.NestedMap(version, "schema", "openAPIV3Schema")
+		if !found {
+			continue
+		}
+		restricted := map[string]interface{}{}
+		for _, path := range paths {
+			mergeSchemaPath(restricted, schema, strings.Split(path, "."))
+		}
+		version["schema"] = map[string]interface{}{"openAPIV3Schema": restricted}
+		versions[i] = version
+	}
+	_ = unstructured.SetNestedSlice(out, versions, "spec", "versions")
+	return out
+}
+
+// mergeSchemaPath copies the schema nodes along segments from src into dst.
+func mergeSchemaPath(dst, src map[string]interface{}, segments []string) {
+	if len(segments) <= 1 {
+		for key, value := range src {
+			dst[key] = value
+		}
+		return
+	}
+	for _, key := range []string{"type", "required"} {
+		if value, ok := src[key]; ok {
+			dst[key] = value
+		}
+	}
+	child, ok, _ := unstructured.NestedMap(src, "properties", segments[0])
+	if !ok {
+		return
+	}
+	properties, _ := dst["properties"].(map[string]interface{})
+	if properties == nil {
+		properties = map[string]interface{}{}
+		dst["properties"] = properties
+	}
+	next, _ := properties[segments[0]].(map[string]interface{})
+	if next == nil {
+		next = map[string]interface{}{}
+		properties[segments[0]] = next
+	}
+	mergeSchemaPath(next, child, segments[1:])
+}
@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+func loadClusterExtensionCRD(t *testing.T) *apiextensionsv1.CustomResourceDefinition {
+	t.Helper()
+	data, err := os.ReadFile("../../llm-config/clusterExt_crd.yaml")
+	if err != nil {
+		t.Fatalf("Failed to read CRD: %v", err)
+	}
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := yaml.Unmarshal(data, crd); err != nil {
+		t.Fatalf("Failed to unmarshal CRD: %v", err)
+	}
+	return crd
+}
+
+func TestEstimatorForModel(t *testing.T) {
+	text := "apiVersion: olm.operatorframework.io/v1alpha1\nkind: ClusterExtension\n"
+
+	if _, ok := estimatorForModel(providerOpenAI, "gpt-4o").(*tiktokenEstimator); !ok {
+		t.Errorf("Expected a tiktoken estimator for gpt-4o")
+	}
+	if _, ok := estimatorForModel(providerLocal, "mistral-nemo").(*charRatioEstimator); !ok {
+		t.Errorf("Expected a character ratio estimator for mistral-nemo")
+	}
+	for _, model := range []string{"gpt-4o", "mistral-nemo"} {
+		if n := estimatorForModel(providerOpenAI, model).countTokens(text); n <= 0 || n > len(text) {
+			t.Errorf("Unexpected token count %d for model %s", n, model)
+		}
+	}
+}
+
+func TestContextWindowForModel(t *testing.T) {
+	if got := contextWindowForModel(providerOpenAI, "gpt-4o-mini"); got != 128000 {
+		t.Errorf("Expected 128000 tokens for gpt-4o-mini, got %d", got)
+	}
+	if got := contextWindowForModel(providerLocal, "granite-code:3b-instruct-128k-fp16"); got != 16384 {
+		t.Errorf("Expected 16384 tokens for granite-code, got %d", got)
+	}
+	if got := contextWindowForModel(providerLocal, "some-new-model"); got != defaultLocalContextTokens {
+		t.Errorf("Expected the default window for an unknown local model, got %d", got)
+	}
+
+	t.Setenv("LLM_CONTEXT_TOKENS", "4096")
+	if got := contextWindowForModel(providerOpenAI, "gpt-4o"); got != 4096 {
+		t.Errorf("Expected LLM_CONTEXT_TOKENS to override the table, got %d", got)
+	}
+}
+
+func TestCondenseCRD(t *testing.T) {
+	crd := loadClusterExtensionCRD(t)
+	condensed, err := condenseCRD(crd, "v1alpha1")
+	if err != nil {
+		t.Fatalf("condenseCRD failed: %v", err)
+	}
+	out, err := yaml.Marshal(condensed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "description:") {
+		t.Errorf("Expected descriptions to be stripped")
+	}
+	versions, _, _ := unstructured.NestedSlice(condensed, "spec", "versions")
+	schema, found, _ := unstructured.NestedMap(versions[0].(map[string]interface{}), "schema", "openAPIV3Schema", "properties")
+	if !found {
+		t.Fatalf("Expected the condensed CRD to keep the schema")
+	}
+	if _, ok := schema["status"]; ok {
+		t.Errorf("Expected the status subtree to be removed")
+	}
+	if _, ok := schema["spec"]; !ok {
+		t.Errorf("Expected the spec subtree to be kept")
+	}
+}
+
+func TestRestrictToPaths(t *testing.T) {
+	crd := loadClusterExtensionCRD(t)
+	condensed, err := condenseCRD(crd, "v1alpha1")
+	if err != nil {
+		t.Fatalf("condenseCRD failed: %v", err)
+	}
+	restricted := restrictToPaths(condensed, []string{"spec.source.catalog.packageName"})
+	versions, _, _ := unstructured.NestedSlice(restricted, "spec", "versions")
+	spec, _, _ := unstructured.NestedMap(versions[0].(map[string]interface{}), "schema", "openAPIV3Schema", "properties", "spec", "properties")
+	if _, ok := spec["install"]; ok {
+		t.Errorf("Expected unrelated subtrees to be dropped")
+	}
+	if _, found, _ := unstructured.NestedMap(spec, "source", "properties", "catalog", "properties", "packageName"); !found {
+		t.Errorf("Expected the failing path to be kept")
+	}
+}
+
+func TestFitPrompt_ShrinksToFit(t *testing.T) {
+	crd := loadClusterExtensionCRD(t)
+	crdYAML, err := yaml.Marshal(crd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := &unstructured.Unstructured{}
+	cr.SetAPIVersion("olm.operatorframework.io/v1alpha1")
+	cr.SetKind("ClusterExtension")
+	client := &localLLMClient{model: "mistral-nemo"}
+	in := promptInput{crdYAML: string(crdYAML), crYAML: "spec: {}"}
+	validationErrors := []string{"packageName is missing in catalog"}
+
+	t.Setenv("LLM_CONTEXT_TOKENS", "100000")
+	prompt, err := fitPrompt(client, cr, crd, in, validationErrors)
+	if err != nil {
+		t.Fatalf("fitPrompt failed: %v", err)
+	}
+	if !strings.Contains(prompt, "description:") {
+		t.Errorf("Expected the full CRD when it fits")
+	}
+
+	t.Setenv("LLM_CONTEXT_TOKENS", "2048")
+	prompt, err = fitPrompt(client, cr, crd, in, validationErrors)
+	if err != nil {
+		t.Fatalf("fitPrompt failed: %v", err)
+	}
+	if strings.Contains(prompt, "description:") {
+		t.Errorf("Expected a condensed CRD in a small context window")
+	}
+
+	t.Setenv("LLM_CONTEXT_TOKENS", "600")
+	if _, err := fitPrompt(client, cr, crd, in, validationErrors); err == nil {
+		t.Errorf("Expected an error when nothing fits")
+	}
+}
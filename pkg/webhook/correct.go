@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// correctionResult is what the correction pipeline made of an invalid object.
+type correctionResult struct {
+	// correction is the model's answer, with its reasoning and token usage, once there is one.
+	correction *llmCorrection
+	adjusted   *unstructured.Unstructured
+	operations []patchOperation
+	patch      []byte
+	// warnings explain a v1alpha1 layout in a v1 object, and describe the changes that were dropped and the
+	// ones that remain.
+	warnings []string
+}
+
+// correctObject runs the correction pipeline on an invalid object: the model, or the cache for dry runs,
+// then the update scope and the correction policy, and the validation of the result. It returns nil when
+// a dry run is not corrected. On failure, the result holds what was gathered before it.
+func correctObject(req *admissionv1.AdmissionRequest, cr *unstructured.Unstructured, client openaiClientInterface, dryRun bool) (*correctionResult, error) {
+	result := &correctionResult{warnings: legacyLayoutWarnings(cr)}
+
+	crd, err := getCRD(cr)
+	if err != nil {
+		log.Printf("Failed to retrieve CRD: %v", err)
+		return result, err
+	}
+
+	// For an update, find the fields the user changed, so the correction can be limited to them
+	var update *updateScope
+	if req.Operation == admissionv1.Update && len(req.OldObject.Raw) > 0 {
+		oldCR := &unstructured.Unstructured{}
+		if _, _, err := deserializer.Decode(req.OldObject.Raw, nil, oldCR); err != nil {
+			log.Printf("Could not decode raw old object: %v", err)
+			return result, err
+		}
+		update = newUpdateScope(oldCR, cr, crd)
+		log.Printf("Update changed %d fields and is missing %d required fields", len(update.changed), len(update.required))
+	}
+
+	// Adjust the CR using an LLM. Dry runs leave no trace and only call the model if the policy allows it
+	if dryRun {
+		result.correction, err = correctForDryRun(defaultDryRunPolicy(), cr, crd, client, update)
+		if err == nil && result.correction == nil {
+			return nil, nil
+		}
+	} else {
+		result.correction, err = adjustCRWithLLM(cr, crd, client, update)
+		if result.correction != nil {
+			provider, model := describeClient(client)
+			addUsage(provider, model, result.correction.usage)
+			auditCorrection(req, cr, client, result.correction, err)
+		}
+		if err == nil {
+			corrections.store(cr, crd, result.correction.adjusted)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to adjust CR with LLM: %v", err)
+		return result, err
+	}
+	adjustedCR := result.correction.adjusted
+
+	// Undo the changes to fields the update didn't touch or that are immutable
+	if update != nil {
+		var dropped []string
+		if adjustedCR, dropped, err = update.restrict(cr, adjustedCR); err != nil {
+			log.Printf("Failed to limit correction to the update: %v", err)
+			return result, err
+		}
+		for _, warning := range dropped {
+			log.Printf("Dropping change: %s", warning)
+		}
+		result.warnings = append(result.warnings, dropped...)
+	}
+
+	// Undo the changes the correction policy forbids
+	target, err := targetFor(cr)
+	if err != nil {
+		return result, err
+	}
+	policy, err := target.correctionPolicy()
+	if err != nil {
+		log.Printf("Failed to load correction policy: %v", err)
+		return result, fmt.Errorf("failed to load correction policy: %v", err)
+	}
+	adjustedCR, dropped, err := policy.enforce(cr, adjustedCR)
+	if err != nil {
+		log.Printf("Failed to apply correction policy: %v", err)
+		return result, err
+	}
+	policyWarnings := describeDroppedChanges(dropped)
+	for _, warning := range policyWarnings {
+		log.Printf("Dropping change: %s", warning)
+	}
+
+	// Validate the adjusted CR
+	if isValid, validationErrors := validateObject(adjustedCR, crd); !isValid {
+		log.Printf("Adjusted CR is still invalid: %s", validationErrors)
+		if len(dropped) > 0 {
+			return result, classify(failurePolicyViolation, fmt.Errorf("adjusted CR is invalid without the changes the correction policy forbids (%s): %s",
+				strings.Join(policyWarnings, "; "), validationErrors))
+		}
+		result.warnings = append(result.warnings, policyWarnings...)
+		return result, classify(failureCorrectionInvalid, fmt.Errorf("adjusted CR is still invalid: %s", validationErrors))
+	}
+	result.warnings = append(result.warnings, policyWarnings...)
+
+	// Create a patch
+	if result.patch, err = patchFor(cr, adjustedCR); err != nil {
+		return result, err
+	}
+	if result.operations, err = parsePatch(result.patch); err != nil {
+		return result, err
+	}
+	result.adjusted = adjustedCR
+
+	// Tell the user what was changed, after what the policy dropped
+	for _, operation := range result.operations {
+		change := describeOperation(cr.Object, operation)
+		log.Printf("Correction: %s", change)
+		result.warnings = append(result.warnings, change)
+	}
+	return result, nil
+}
@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	apiextensionslisters "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/cache"
+)
+
+// crdCache keeps the cluster's CRDs and REST mappings in memory. CRDs are watched with an informer, and the
+// REST mapper and the OpenAPI documents of built-in kinds read discovery on first use and again after any
+// CRD is added, deleted or has its spec changed.
+type crdCache struct {
+	client apiextensionsclientset.Interface
+	crds   apiextensionslisters.CustomResourceDefinitionLister
+	synced cache.InformerSynced
+	mapper *restmapper.DeferredDiscoveryRESTMapper
+}
+
+// sharedCRDCache returns the webhook's CRD cache. It is started on first use and runs for the life of the process.
+var sharedCRDCache = sync.OnceValues(func() (*crdCache, error) {
+	client, err := kubeAPIExtensionsClient()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubeClientset()
+	if err != nil {
+		return nil, err
+	}
+	return newCRDCache(context.Background(), client, clientset.Discovery())
+})
+
+// newCRDCache starts watching CRDs until ctx is done. Lookups don't wait for the first list: until it
+// completes, CRDs are read from the API server.
+func newCRDCache(ctx context.Context, client apiextensionsclientset.Interface, discoveryClient discovery.DiscoveryInterface) (*crdCache, error) {
+	factory := apiextensionsinformers.NewSharedInformerFactory(client, 0)
+	informer := factory.Apiextensions().V1().CustomResourceDefinitions()
+	c := &crdCache{
+		client: client,
+		crds:   informer.Lister(),
+		synced: informer.Informer().HasSynced,
+		mapper: restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+	}
+
+	// A CRD change can add, remove or rename resources, so the mappings are read again on next use. Status
+	// updates don't change the spec's generation, and leave the mappings alone
+	if _, err := informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { c.reset() },
+		UpdateFunc: func(oldObj, obj interface{}) {
+			old, okOld := oldObj.(*apiextensionsv1.CustomResourceDefinition)
+			crd, ok := obj.(*apiextensionsv1.CustomResourceDefinition)
+			if !okOld || !ok || old.Generation != crd.Generation {
+				c.reset()
+			}
+		},
+		DeleteFunc: func(interface{}) { c.reset() },
+	}); err != nil {
+		return nil, err
+	}
+
+	factory.Start(ctx.Done())
+	return c, nil
+}
+
+// reset makes the next lookup read discovery again, for the REST mappings and the OpenAPI documents alike.
+func (c *crdCache) reset() {
+	c.mapper.Reset()
+	resetOpenAPIDiscovery()
+}
+
+// restMapping maps a kind to its resource. A kind that isn't found, but that a CRD in the cache defines, was
+// not yet served when discovery was read, for example because its CRD was just created: discovery is read
+// again for it.
+func (c *crdCache) restMapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if !meta.IsNoMatchError(err) || !c.synced() || !c.defines(gvk) {
+		return mapping, err
+	}
+	c.reset()
+	return c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+}
+
+// defines reports whether a cached CRD defines the kind.
+func (c *crdCache) defines(gvk schema.GroupVersionKind) bool {
+	crds, err := c.crds.List(labels.Everything())
+	if err != nil {
+		return false
+	}
+	for _, crd := range crds {
+		if crd.Spec.Group == gvk.Group && crd.Spec.Names.Kind == gvk.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the CRD of an object's kind or, for built-in kinds, one made from their OpenAPI v3 schema.
+func (c *crdCache) get(ctx context.Context, cr *unstructured.Unstructured) (*apiextensionsv1.CustomResourceDefinition, error) {
+	gvk := cr.GroupVersionKind()
+	mapping, err := c.restMapping(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map GVK: %v", err)
+	}
+
+	// Built-in resources, like Deployments, have no CRD: describe them with their OpenAPI v3 schema
+	if gvk.Group == "" {
+		return builtinCRD(ctx, mapping)
+	}
+
+	// The name of the CRD is the plural form of the resource plus the group name
+	crdName := fmt.Sprintf("%s.%s", mapping.Resource.Resource, gvk.Group)
+
+	var crd *apiextensionsv1.CustomResourceDefinition
+	if c.synced() {
+		crd, err = c.crds.Get(crdName)
+		if err == nil {
+			// The cached CRD is shared with the informer
+			crd = crd.DeepCopy()
+		}
+	} else {
+		crd, err = c.client.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, crdName, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return builtinCRD(ctx, mapping)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve CRD: %v", err)
+	}
+	return crd, nil
+}
@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// discoveryReads counts how many times the API groups were discovered.
+func discoveryReads(discoveryClient *fakediscovery.FakeDiscovery) int {
+	reads := 0
+	for _, action := range discoveryClient.Actions() {
+		if action.GetResource().Resource == "group" {
+			reads++
+		}
+	}
+	return reads
+}
+
+// waitFor waits up to 5 seconds for the informer to make condition true.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the CRD cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCRDCache(t *testing.T) {
+	crd, err := clusterExtensionV1CRD(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := apiextensionsfake.NewSimpleClientset(crd)
+	discoveryClient := fake.NewSimpleClientset().Discovery().(*fakediscovery.FakeDiscovery)
+	discoveryClient.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "olm.operatorframework.io/v1",
+		APIResources: []metav1.APIResource{{Name: "clusterextensions", Kind: "ClusterExtension"}},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	crds, err := newCRDCache(ctx, client, discoveryClient)
+	if err != nil {
+		t.Fatalf("newCRDCache failed: %v", err)
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), crds.synced) {
+		t.Fatal("The CRD informer did not sync")
+	}
+
+	// Lookups are served from memory: discovery is read once, and the API server not at all
+	client.ClearActions()
+	for i := 0; i < 3; i++ {
+		found, err := crds.get(ctx, parseCR(t, validV1CRYAML))
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		if found.Name != crd.Name {
+			t.Errorf("Unexpected CRD %s", found.Name)
+		}
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("Expected no requests to the API server, got %v", client.Actions())
+	}
+	if discoveryReads(discoveryClient) != 1 {
+		t.Errorf("Expected discovery to be read once, got %v", discoveryClient.Actions())
+	}
+
+	// Status updates leave the mappings alone; spec changes, which bump the generation, don't
+	crd.Status.Conditions = []apiextensionsv1.CustomResourceDefinitionCondition{{Type: apiextensionsv1.Established, Status: apiextensionsv1.ConditionTrue}}
+	if _, err := client.ApiextensionsV1().CustomResourceDefinitions().UpdateStatus(ctx, crd, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		cached, err := crds.crds.Get(crd.Name)
+		return err == nil && len(cached.Status.Conditions) == 1
+	})
+	time.Sleep(50 * time.Millisecond)
+	if _, err := crds.get(ctx, parseCR(t, validV1CRYAML)); err != nil {
+		t.Fatal(err)
+	}
+	if reads := discoveryReads(discoveryClient); reads != 1 {
+		t.Errorf("Expected a status update not to reset discovery, got %d reads", reads)
+	}
+	crd.Generation = 2
+	if _, err := client.ApiextensionsV1().CustomResourceDefinitions().Update(ctx, crd, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, err := crds.get(ctx, parseCR(t, validV1CRYAML))
+		return err == nil && discoveryReads(discoveryClient) == 2
+	})
+
+	// A new CRD invalidates the mappings, so its kind is found
+	discoveryClient.Resources = append(discoveryClient.Resources, &metav1.APIResourceList{
+		GroupVersion: "example.com/v1",
+		APIResources: []metav1.APIResource{{Name: "widgets", Kind: "Widget"}},
+	})
+	widgets := &apiextensionsv1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: "widgets.example.com"}}
+	if _, err := client.ApiextensionsV1().CustomResourceDefinitions().Create(ctx, widgets, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	widget := parseCR(t, "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: example\n")
+	waitFor(t, func() bool {
+		found, err := crds.get(ctx, widget)
+		return err == nil && found.Name == widgets.Name
+	})
+}
@@ -0,0 +1,139 @@
+package webhook
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// dryRunPolicy is how much of the correction pipeline runs for dry-run requests, like
+// kubectl apply --dry-run=server.
+type dryRunPolicy string
+
+const (
+	// dryRunSkip doesn't correct the object and reports its validation errors as warnings.
+	dryRunSkip dryRunPolicy = "skip"
+	// dryRunCached replays the correction made earlier for an identical object, without calling the model.
+	// Objects that were never corrected are handled like dryRunSkip.
+	dryRunCached dryRunPolicy = "cached"
+	// dryRunFull runs the whole pipeline, model call included.
+	dryRunFull dryRunPolicy = "full"
+)
+
+// maxCachedCorrections bounds the number of corrections kept for dry runs.
+const maxCachedCorrections = 256
+
+// defaultDryRunPolicy returns the policy set by DRY_RUN_POLICY. It defaults to cached.
+func defaultDryRunPolicy() dryRunPolicy {
+	switch policy := dryRunPolicy(strings.ToLower(os.Getenv("DRY_RUN_POLICY"))); policy {
+	case dryRunSkip, dryRunFull:
+		return policy
+	case "", dryRunCached:
+		return dryRunCached
+	default:
+		log.Printf("Unknown DRY_RUN_POLICY %q, using %s", policy, dryRunCached)
+		return dryRunCached
+	}
+}
+
+// isDryRun reports whether the API server will not persist the request's object.
+func isDryRun(req *admissionv1.AdmissionRequest) bool {
+	return req.DryRun != nil && *req.DryRun
+}
+
+// dryRunResponse allows a dry-run request without correcting it, with its validation errors as warnings.
+func dryRunResponse(validationErrors string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: true,
+		Warnings: limitWarnings([]string{
+			"dry run: the object was not corrected: " + validationErrors,
+		}),
+	}
+}
+
+// correctionCache keeps the corrected fields the model returned, usually the spec, keyed by the submitted
+// ones, so dry runs can show a correction without paying for it. Entries are evicted oldest first.
+type correctionCache struct {
+	mu      sync.Mutex
+	entries map[string]map[string]interface{}
+	order   []string
+}
+
+var corrections = &correctionCache{entries: map[string]map[string]interface{}{}}
+
+// correctionKey identifies a correction by the CRD generation, the object's kind and its corrected fields.
+func correctionKey(cr *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition) (string, error) {
+	return hashJSON(map[string]interface{}{
+		"crd":        crd.Name,
+		"generation": crd.Generation,
+		"kind":       cr.GroupVersionKind().String(),
+		"fields":     correctedValues(cr, correctedFieldsFor(cr)),
+	})
+}
+
+// store records the corrected fields of an accepted correction.
+func (c *correctionCache) store(cr *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition, adjusted *unstructured.Unstructured) {
+	key, err := correctionKey(cr, crd)
+	if err != nil {
+		log.Printf("Failed to cache correction: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = correctedValues(adjusted, correctedFieldsFor(adjusted))
+	for len(c.order) > maxCachedCorrections {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// lookup returns the cached correction of cr, merged into it, or nil if there is none.
+func (c *correctionCache) lookup(cr *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition) *llmCorrection {
+	key, err := correctionKey(cr, crd)
+	if err != nil {
+		log.Printf("Failed to look up cached correction: %v", err)
+		return nil
+	}
+
+	c.mu.Lock()
+	values, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	adjusted := cr.DeepCopy()
+	setCorrectedValues(adjusted, values)
+	return &llmCorrection{adjusted: adjusted}
+}
+
+// correctForDryRun returns the correction for a dry-run request under the policy, or nil if the object
+// should not be corrected. It only calls the model if the policy is full, and the usage of that call is
+// not added to the totals.
+func correctForDryRun(policy dryRunPolicy, cr *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition, client openaiClientInterface, update *updateScope) (*llmCorrection, error) {
+	switch policy {
+	case dryRunFull:
+		correction, err := adjustCRWithLLM(cr, crd, client, update)
+		if err == nil {
+			corrections.store(cr, crd, correction.adjusted)
+		}
+		return correction, err
+	case dryRunCached:
+		if correction := corrections.lookup(cr, crd); correction != nil {
+			log.Printf("Using cached correction for dry run")
+			return correction, nil
+		}
+		log.Printf("No cached correction for dry run")
+		return nil, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,136 @@
+package webhook
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// dryRunReviewFor returns a dry-run admission review for the CR.
+func dryRunReviewFor(t *testing.T, crYAML string) *admissionv1.AdmissionReview {
+	t.Helper()
+	review := admissionReviewFor(t, crYAML)
+	dryRun := true
+	review.Request.DryRun = &dryRun
+	return review
+}
+
+// withEmptyCorrectionCache gives the test its own correction cache.
+func withEmptyCorrectionCache(t *testing.T) {
+	t.Helper()
+	previous := corrections
+	corrections = &correctionCache{entries: map[string]map[string]interface{}{}}
+	t.Cleanup(func() { corrections = previous })
+}
+
+// usageRequests returns the number of completions counted in the usage totals.
+func usageRequests() int {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	requests := 0
+	for _, totals := range usageLedger {
+		requests += totals.requests
+	}
+	return requests
+}
+
+// auditLines returns the number of records in the audit log.
+func auditLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+var correctedAnnotatedCRYAML = strings.Replace(annotatedCRYAML, "packageName:", "packageName: example-package", 1)
+
+func TestMutate_DryRunSkip(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withEmptyCorrectionCache(t)
+	t.Setenv("DRY_RUN_POLICY", "skip")
+
+	client := &promptCapturingClient{response: correctedAnnotatedCRYAML}
+	response := mutate(dryRunReviewFor(t, annotatedCRYAML), client)
+	if !response.Allowed || response.Patch != nil {
+		t.Fatalf("Expected the dry run to be allowed without a patch, got %+v", response)
+	}
+	if client.prompt != "" {
+		t.Errorf("Did not expect the model to be called")
+	}
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "dry run: the object was not corrected: packageName is missing") {
+		t.Errorf("Unexpected warnings %q", response.Warnings)
+	}
+}
+
+func TestMutate_DryRunCached(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withEmptyCorrectionCache(t)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	t.Setenv("AUDIT_LOG_PATH", auditPath)
+
+	// Nothing is cached yet, so the dry run is not corrected
+	client := &promptCapturingClient{response: correctedAnnotatedCRYAML}
+	response := mutate(dryRunReviewFor(t, annotatedCRYAML), client)
+	if !response.Allowed || response.Patch != nil {
+		t.Fatalf("Expected the dry run to be allowed without a patch, got %+v", response)
+	}
+
+	// A real request corrects the object and caches the correction
+	if response := mutate(admissionReviewFor(t, annotatedCRYAML), client); response.Patch == nil {
+		t.Fatalf("Expected a patch, got %+v", response)
+	}
+	if lines := auditLines(t, auditPath); lines != 1 {
+		t.Fatalf("Expected one audit record, got %d", lines)
+	}
+
+	client.prompt = ""
+	requests := usageRequests()
+	response = mutate(dryRunReviewFor(t, annotatedCRYAML), client)
+	if !response.Allowed || response.Patch == nil {
+		t.Fatalf("Expected the cached correction as a patch, got %+v", response)
+	}
+	if client.prompt != "" {
+		t.Errorf("Did not expect the model to be called")
+	}
+	if !strings.Contains(strings.Join(response.Warnings, "\n"), `spec.source.catalog.packageName: set to "example-package"`) {
+		t.Errorf("Expected the correction in the warnings, got %q", response.Warnings)
+	}
+	if lines := auditLines(t, auditPath); lines != 1 {
+		t.Errorf("Did not expect an audit record for the dry run, got %d records", lines)
+	}
+	if usageRequests() != requests {
+		t.Errorf("Did not expect the dry run in the usage totals")
+	}
+}
+
+func TestMutate_DryRunFull(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withEmptyCorrectionCache(t)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	t.Setenv("AUDIT_LOG_PATH", auditPath)
+	t.Setenv("DRY_RUN_POLICY", "full")
+
+	client := &promptCapturingClient{response: correctedAnnotatedCRYAML}
+	requests := usageRequests()
+	response := mutate(dryRunReviewFor(t, annotatedCRYAML), client)
+	if !response.Allowed || response.Patch == nil {
+		t.Fatalf("Expected a patch, got %+v", response)
+	}
+	if client.prompt == "" {
+		t.Errorf("Expected the model to be called")
+	}
+	if lines := auditLines(t, auditPath); lines != 0 {
+		t.Errorf("Did not expect an audit record for the dry run, got %d records", lines)
+	}
+	if usageRequests() != requests {
+		t.Errorf("Did not expect the dry run in the usage totals")
+	}
+}
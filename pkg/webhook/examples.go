@@ -0,0 +1,278 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultMaxExamples is the number of few-shot examples inserted into a prompt unless FEW_SHOT_MAX_EXAMPLES says otherwise.
+const defaultMaxExamples = 3
+
+// maxExamplesLimit caps FEW_SHOT_MAX_EXAMPLES, since every example adds two manifests to the prompt.
+const maxExamplesLimit = 3
+
+// minExampleSimilarity is the similarity an example without a matching error type needs to be selected.
+const minExampleSimilarity = 0.5
+
+// correctionExample is a curated pair of a broken CR and its corrected form.
+type correctionExample struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	ErrorTypes  []string `json:"errorTypes"`
+	Broken      string   `json:"broken"`
+	Corrected   string   `json:"corrected"`
+
+	// tokens is the vocabulary used for similarity scoring, computed when the example is loaded.
+	tokens map[string]struct{}
+	// apiVersion is the API version of the broken CR, if it has one.
+	apiVersion string
+}
+
+// exampleLibrary holds the curated examples grouped by validation error type.
+type exampleLibrary struct {
+	examples []*correctionExample
+	byType   map[string][]*correctionExample
+}
+
+// fewShotLibrary returns the example library configured through the environment. It is loaded once on first use.
+var fewShotLibrary = sync.OnceValue(func() *exampleLibrary {
+	return loadExampleLibrary(os.Getenv("FEW_SHOT_EXAMPLES_DIR"), os.Getenv("FEW_SHOT_EXAMPLES_CONFIGMAP"))
+})
+
+// loadExampleLibrary reads the examples in a directory and a ConfigMap referenced as "namespace/name".
+// Either may be empty. Examples that can't be read are logged and skipped.
+func loadExampleLibrary(dir, configMapRef string) *exampleLibrary {
+	lib := newExampleLibrary(nil)
+
+	if dir != "" {
+		examples, err := loadExamplesFromDir(dir)
+		if err != nil {
+			log.Printf("Failed to load few-shot examples from %s: %v", dir, err)
+		}
+		lib.add(examples...)
+	}
+
+	if configMapRef != "" {
+		examples, err := loadExamplesFromConfigMap(context.Background(), configMapRef)
+		if err != nil {
+			log.Printf("Failed to load few-shot examples from ConfigMap %s: %v", configMapRef, err)
+		}
+		lib.add(examples...)
+	}
+
+	log.Printf("Loaded %d few-shot examples", len(lib.examples))
+	return lib
+}
+
+// maxFewShotExamples returns the number of examples to insert into a prompt, from 0 to maxExamplesLimit.
+func maxFewShotExamples() int {
+	value := os.Getenv("FEW_SHOT_MAX_EXAMPLES")
+	if value == "" {
+		return defaultMaxExamples
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Ignoring invalid FEW_SHOT_MAX_EXAMPLES %q", value)
+		return defaultMaxExamples
+	}
+	if n > maxExamplesLimit {
+		log.Printf("FEW_SHOT_MAX_EXAMPLES %d is above the limit, using %d", n, maxExamplesLimit)
+		return maxExamplesLimit
+	}
+	return n
+}
+
+func newExampleLibrary(examples []*correctionExample) *exampleLibrary {
+	lib := &exampleLibrary{byType: map[string][]*correctionExample{}}
+	lib.add(examples...)
+	return lib
+}
+
+func (l *exampleLibrary) add(examples ...*correctionExample) {
+	for _, example := range examples {
+		l.examples = append(l.examples, example)
+		for _, errorType := range example.ErrorTypes {
+			l.byType[errorType] = append(l.byType[errorType], example)
+		}
+	}
+}
+
+// selectExamples returns up to limit examples most relevant to the given validation errors and CR.
+// Examples sharing an error type with the current errors rank first, ties are broken by token similarity.
+// Examples of another API version are left out, since their layout may differ.
+func (l *exampleLibrary) selectExamples(validationErrors []string, crYAML, apiVersion string, limit int) []*correctionExample {
+	if l == nil || limit <= 0 || len(l.examples) == 0 {
+		return nil
+	}
+
+	typeMatches := map[*correctionExample]int{}
+	for _, message := range validationErrors {
+		for _, example := range l.byType[classifyValidationError(message)] {
+			typeMatches[example]++
+		}
+	}
+
+	query := tokenize(strings.Join(validationErrors, " ") + " " + crYAML)
+
+	type candidate struct {
+		example    *correctionExample
+		matches    int
+		similarity float64
+	}
+	var candidates []candidate
+	for _, example := range l.examples {
+		if example.apiVersion != "" && apiVersion != "" && example.apiVersion != apiVersion {
+			continue
+		}
+		c := candidate{example: example, matches: typeMatches[example], similarity: jaccard(query, example.tokens)}
+		if c.matches == 0 && c.similarity < minExampleSimilarity {
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].matches != candidates[j].matches {
+			return candidates[i].matches > candidates[j].matches
+		}
+		return candidates[i].similarity > candidates[j].similarity
+	})
+
+	var selected []*correctionExample
+	for _, c := range candidates {
+		if len(selected) == limit {
+			break
+		}
+		selected = append(selected, c.example)
+	}
+	return selected
+}
+
+// parseExample decodes a single example document in YAML or JSON.
+func parseExample(source string, data []byte) (*correctionExample, error) {
+	example := &correctionExample{}
+	if err := yaml.Unmarshal(data, example); err != nil {
+		return nil, fmt.Errorf("failed to parse example %s: %v", source, err)
+	}
+	if example.Broken == "" || example.Corrected == "" {
+		return nil, fmt.Errorf("example %s must set both broken and corrected", source)
+	}
+	if example.Name == "" {
+		example.Name = strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	}
+	var broken struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	if err := yaml.Unmarshal([]byte(example.Broken), &broken); err == nil {
+		example.apiVersion = broken.APIVersion
+	}
+	example.tokens = tokenize(strings.Join(example.ErrorTypes, " ") + " " + example.Description + " " + example.Broken)
+	return example, nil
+}
+
+// loadExamplesFromDir reads every .yaml, .yml and .json file in dir as an example.
+func loadExamplesFromDir(dir string) ([]*correctionExample, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var examples []*correctionExample
+	for _, entry := range entries {
+		if entry.IsDir() || !isExampleFile(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return examples, err
+		}
+		example, err := parseExample(path, data)
+		if err != nil {
+			log.Printf("Skipping few-shot example: %v", err)
+			continue
+		}
+		examples = append(examples, example)
+	}
+	return examples, nil
+}
+
+// loadExamplesFromConfigMap reads every data key of the ConfigMap referenced as "namespace/name" as an example.
+func loadExamplesFromConfigMap(ctx context.Context, ref string) ([]*correctionExample, error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("expected namespace/name, got %q", ref)
+	}
+
+	clientset, err := kubeClientset()
+	if err != nil {
+		return nil, err
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(configMap.Data))
+	for key := range configMap.Data {
+		if isExampleFile(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var examples []*correctionExample
+	for _, key := range keys {
+		example, err := parseExample(key, []byte(configMap.Data[key]))
+		if err != nil {
+			log.Printf("Skipping few-shot example: %v", err)
+			continue
+		}
+		examples = append(examples, example)
+	}
+	return examples, nil
+}
+
+func isExampleFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// tokenize splits text into a set of lower-cased alphanumeric words.
+func tokenize(text string) map[string]struct{} {
+	tokens := map[string]struct{}{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		tokens[word] = struct{}{}
+	}
+	return tokens
+}
+
+// jaccard returns the Jaccard similarity of two token sets.
+func jaccard(a, b map[string]struct{}) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	intersection := 0
+	for token := range a {
+		if _, ok := b[token]; ok {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
@@ -0,0 +1,141 @@
+package webhook
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// promptCapturingClient records the prompt it receives and answers with a fixed response.
+type promptCapturingClient struct {
+	prompt   string
+	response string
+}
+
+func (c *promptCapturingClient) CreateChatCompletion(ctx context.Context, prompt string) (string, error) {
+	c.prompt = prompt
+	return c.response, nil
+}
+
+func TestLoadExamplesFromDir(t *testing.T) {
+	examples, err := loadExamplesFromDir("../../examples/few-shot")
+	if err != nil {
+		t.Fatalf("Failed to load examples: %v", err)
+	}
+	if len(examples) == 0 {
+		t.Fatalf("Expected the shipped few-shot examples to load")
+	}
+	for _, example := range examples {
+		if len(example.ErrorTypes) == 0 {
+			t.Errorf("Example %q has no error types", example.Name)
+		}
+	}
+}
+
+func TestLoadExamplesFromDir_SkipsIncompleteExamples(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "incomplete.yaml"), []byte("name: incomplete\nbroken: foo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("not an example"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	examples, err := loadExamplesFromDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to load examples: %v", err)
+	}
+	if len(examples) != 0 {
+		t.Errorf("Expected no examples, got %d", len(examples))
+	}
+}
+
+func TestSelectExamples(t *testing.T) {
+	lib := newExampleLibrary(nil)
+	for _, e := range []struct {
+		name       string
+		errorTypes []string
+		broken     string
+	}{
+		{"package", []string{"missing-package-name"}, "spec: {source: {catalog: {}}}"},
+		{"namespace", []string{"missing-namespace"}, "spec: {install: {}}"},
+		{"unrelated", []string{"missing-spec"}, "kind: Deployment"},
+	} {
+		example, err := parseExample(e.name, []byte("broken: '"+e.broken+"'\ncorrected: x\nerrorTypes: ["+strings.Join(e.errorTypes, ",")+"]\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lib.add(example)
+	}
+
+	selected := lib.selectExamples([]string{"packageName is missing in catalog"}, "spec:\n  source:\n    catalog: {}\n", "", 3)
+	if len(selected) == 0 || selected[0].Name != "package" {
+		t.Fatalf("Expected the package example to be selected first, got %v", selected)
+	}
+	for _, example := range selected {
+		if example.Name == "unrelated" {
+			t.Errorf("Did not expect the unrelated example to be selected")
+		}
+	}
+
+	if selected := lib.selectExamples([]string{"packageName is missing in catalog"}, "", "", 0); len(selected) != 0 {
+		t.Errorf("Expected no examples with a limit of 0, got %d", len(selected))
+	}
+}
+
+func TestMaxFewShotExamples(t *testing.T) {
+	for value, want := range map[string]int{"": 3, "0": 0, "2": 2, "3": 3, "50": 3, "-1": 3, "many": 3} {
+		t.Setenv("FEW_SHOT_MAX_EXAMPLES", value)
+		if got := maxFewShotExamples(); got != want {
+			t.Errorf("FEW_SHOT_MAX_EXAMPLES=%q: expected %d, got %d", value, want, got)
+		}
+	}
+}
+
+func TestAdjustCRWithLLM_IncludesFewShotExamples(t *testing.T) {
+	examples, err := loadExamplesFromDir("../../examples/few-shot")
+	if err != nil {
+		t.Fatalf("Failed to load examples: %v", err)
+	}
+	originalLibrary := fewShotLibrary
+	defer func() { fewShotLibrary = originalLibrary }()
+	fewShotLibrary = func() *exampleLibrary { return newExampleLibrary(examples) }
+
+	crYAML := `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: example
+spec:
+  install:
+    namespace: example-namespace
+    serviceAccount:
+      name: example-sa
+  source:
+    sourceType: Catalog
+    catalog:
+      packageName:
+`
+	cr := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal([]byte(crYAML), &cr.Object); err != nil {
+		t.Fatalf("Failed to unmarshal CR: %v", err)
+	}
+	crd, err := mockGetCRD(cr)
+	if err != nil {
+		t.Fatalf("Failed to get CRD: %v", err)
+	}
+
+	client := &promptCapturingClient{response: strings.Replace(crYAML, "packageName:", "packageName: example-package", 1)}
+	if _, err := AdjustCRWithLLM(cr, crd, client); err != nil {
+		t.Fatalf("AdjustCRWithLLM failed: %v", err)
+	}
+
+	if !strings.Contains(client.prompt, "Example 1 (missing-package-name)") {
+		t.Errorf("Expected the prompt to lead with the missing-package-name example, got:\n%s", client.prompt)
+	}
+}
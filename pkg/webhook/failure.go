@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// failureClass is the kind of failure that stopped a correction. The failure policy decides per class
+// whether the object is admitted unchanged or denied.
+type failureClass string
+
+const (
+	// failureInternal is a failure of the webhook itself, like a failed CRD lookup.
+	failureInternal failureClass = "internal"
+	// failureLLMUnavailable is a model that can't be reached, times out or returns an error.
+	failureLLMUnavailable failureClass = "llm-unavailable"
+	// failureCorrectionInvalid is a model answer that can't be used, or a correction that is still invalid.
+	failureCorrectionInvalid failureClass = "correction-invalid"
+	// failurePolicyViolation is a correction the correction policy or the prompt-injection defenses refused.
+	failurePolicyViolation failureClass = "policy-violation"
+	// failureBudgetExhausted is a prompt that doesn't fit in the model's context.
+	failureBudgetExhausted failureClass = "budget-exhausted"
+)
+
+// failureAction is what the webhook does when a correction fails.
+type failureAction string
+
+const (
+	failureAllow failureAction = "allow"
+	failureDeny  failureAction = "deny"
+)
+
+// failureStatuses are the reason and code of a denial for each class.
+var failureStatuses = map[failureClass]struct {
+	reason metav1.StatusReason
+	code   int32
+}{
+	failureInternal:          {metav1.StatusReasonInternalError, http.StatusInternalServerError},
+	failureLLMUnavailable:    {metav1.StatusReasonServiceUnavailable, http.StatusServiceUnavailable},
+	failureCorrectionInvalid: {metav1.StatusReasonInvalid, http.StatusUnprocessableEntity},
+	failurePolicyViolation:   {metav1.StatusReasonForbidden, http.StatusForbidden},
+	failureBudgetExhausted:   {metav1.StatusReasonRequestEntityTooLarge, http.StatusRequestEntityTooLarge},
+}
+
+// classifiedError is an error with its failure class.
+type classifiedError struct {
+	class failureClass
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+func (e *classifiedError) Unwrap() error { return e.err }
+
+// classify gives err a failure class, unless it already has one.
+func classify(class failureClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return err
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// classOf returns the failure class of err. Errors without one are internal.
+func classOf(err error) failureClass {
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+	return failureInternal
+}
+
+// loadFailurePolicy returns the action for each class set by FAILURE_POLICY, a comma-separated list
+// of class=action pairs like llm-unavailable=allow,budget-exhausted=allow. Classes not listed are denied.
+var loadFailurePolicy = sync.OnceValues(func() (map[failureClass]failureAction, error) {
+	policy, err := parseFailurePolicy(os.Getenv("FAILURE_POLICY"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid FAILURE_POLICY: %v", err)
+	}
+	return policy, nil
+})
+
+func parseFailurePolicy(value string) (map[failureClass]failureAction, error) {
+	policy := map[failureClass]failureAction{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, action, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not class=action", pair)
+		}
+		class := failureClass(strings.TrimSpace(name))
+		if _, ok := failureStatuses[class]; !ok {
+			return nil, fmt.Errorf("unknown failure class %q, expected one of %s", class, strings.Join(failureClassNames(), ", "))
+		}
+		switch act := failureAction(strings.ToLower(strings.TrimSpace(action))); act {
+		case failureAllow, failureDeny:
+			policy[class] = act
+		default:
+			return nil, fmt.Errorf("unknown action %q for %s, expected allow or deny", action, class)
+		}
+	}
+	return policy, nil
+}
+
+func failureClassNames() []string {
+	names := make([]string, 0, len(failureStatuses))
+	for class := range failureStatuses {
+		names = append(names, string(class))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// failureResponse answers a request whose correction failed with err. Depending on the failure policy for
+// its class, the object is admitted unchanged with a warning, or denied with the class's reason and code.
+func failureResponse(err error, warnings []string) *admissionv1.AdmissionResponse {
+	class := classOf(err)
+	policy, policyErr := loadFailurePolicy()
+	if policyErr != nil {
+		log.Printf("Failed to load failure policy: %v", policyErr)
+		class, err = failureInternal, fmt.Errorf("%v (and %v)", err, policyErr)
+	}
+
+	if policy[class] == failureAllow {
+		log.Printf("Admitting object unchanged after %s failure: %v", class, err)
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: limitWarnings(append(warnings, fmt.Sprintf("the object was not corrected (%s): %v", class, err))),
+		}
+	}
+
+	status := failureStatuses[class]
+	return &admissionv1.AdmissionResponse{
+		Allowed:  false,
+		Warnings: limitWarnings(warnings),
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  status.reason,
+			Code:    status.code,
+		},
+	}
+}
+
+// unavailableClient stands in for an LLM client that couldn't be created, so requests that need no
+// correction are still admitted and those that do fail as llm-unavailable.
+type unavailableClient struct {
+	err error
+}
+
+func (c *unavailableClient) CreateChatCompletion(ctx context.Context, prompt string) (string, error) {
+	return "", c.err
+}
@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func withFailurePolicy(t *testing.T, value string) {
+	t.Helper()
+	policy, err := parseFailurePolicy(value)
+	if err != nil {
+		t.Fatalf("parseFailurePolicy failed: %v", err)
+	}
+	original := loadFailurePolicy
+	t.Cleanup(func() { loadFailurePolicy = original })
+	loadFailurePolicy = func() (map[failureClass]failureAction, error) { return policy, nil }
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	policy, err := parseFailurePolicy(" llm-unavailable=allow, budget-exhausted=Allow,internal=deny ")
+	if err != nil {
+		t.Fatalf("parseFailurePolicy failed: %v", err)
+	}
+	want := map[failureClass]failureAction{
+		failureLLMUnavailable:  failureAllow,
+		failureBudgetExhausted: failureAllow,
+		failureInternal:        failureDeny,
+	}
+	if fmt.Sprint(policy) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, policy)
+	}
+
+	for _, value := range []string{"llm-unavailable", "timeout=allow", "internal=ignore"} {
+		if _, err := parseFailurePolicy(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestMutate_FailurePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		client openaiClientInterface
+		class  failureClass
+		reason metav1.StatusReason
+		code   int32
+	}{
+		{
+			name:   "model unreachable",
+			client: &mockOpenAIClient{err: fmt.Errorf("dial tcp: connection refused")},
+			class:  failureLLMUnavailable,
+			reason: metav1.StatusReasonServiceUnavailable,
+			code:   503,
+		},
+		{
+			name:   "client not configured",
+			client: &unavailableClient{err: fmt.Errorf("failed to initialize LLM client: OPENAI_API_KEY is not set")},
+			class:  failureLLMUnavailable,
+			reason: metav1.StatusReasonServiceUnavailable,
+			code:   503,
+		},
+		{
+			name:   "unusable answer",
+			client: &mockOpenAIClient{response: "I can't help with that."},
+			class:  failureCorrectionInvalid,
+			reason: metav1.StatusReasonInvalid,
+			code:   422,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withGetCRD(t, mockGetCRD)
+
+			withFailurePolicy(t, "")
+			response := mutate(admissionReviewFor(t, annotatedCRYAML), tt.client)
+			if response.Allowed {
+				t.Fatalf("Expected the request to be denied by default")
+			}
+			if response.Result.Reason != tt.reason || response.Result.Code != tt.code {
+				t.Errorf("Expected %s %d, got %s %d: %s", tt.reason, tt.code, response.Result.Reason, response.Result.Code, response.Result.Message)
+			}
+
+			withFailurePolicy(t, string(tt.class)+"=allow")
+			response = mutate(admissionReviewFor(t, annotatedCRYAML), tt.client)
+			if !response.Allowed || response.Patch != nil {
+				t.Fatalf("Expected the object to be admitted unchanged, got %+v", response)
+			}
+			if len(response.Warnings) == 0 || !strings.Contains(response.Warnings[len(response.Warnings)-1], "("+string(tt.class)+")") {
+				t.Errorf("Expected a warning naming %s, got %q", tt.class, response.Warnings)
+			}
+		})
+	}
+}
+
+func TestFailureResponse_Classes(t *testing.T) {
+	withFailurePolicy(t, "")
+	tests := map[failureClass]int32{
+		failureInternal:        500,
+		failurePolicyViolation: 403,
+		failureBudgetExhausted: 413,
+	}
+	for class, code := range tests {
+		response := failureResponse(classify(class, fmt.Errorf("failed")), nil)
+		if response.Allowed || response.Result.Code != code || response.Result.Status != metav1.StatusFailure {
+			t.Errorf("%s: expected a %d failure, got %+v", class, code, response.Result)
+		}
+	}
+
+	// The first class given to an error is kept
+	err := classify(failureCorrectionInvalid, classify(failureBudgetExhausted, fmt.Errorf("failed")))
+	if classOf(err) != failureBudgetExhausted {
+		t.Errorf("Expected the inner class to be kept, got %s", classOf(err))
+	}
+	if classOf(fmt.Errorf("failed")) != failureInternal {
+		t.Errorf("Expected unclassified errors to be internal")
+	}
+}
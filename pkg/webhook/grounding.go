@@ -0,0 +1,435 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// maxPromptCandidates is the number of names per list written into the prompt. The allowed-list check
+// still uses every name.
+const maxPromptCandidates = 100
+
+// catalogFetchTimeout bounds how long reading a catalog's content may take.
+const catalogFetchTimeout = 10 * time.Second
+
+// clusterContextTimeout bounds gathering the cluster context of a CR, all lists and catalog reads together.
+// With the model call's llmTimeout, it must leave the correction within the webhook's timeout.
+const clusterContextTimeout = 5 * time.Second
+
+// clusterCatalogResources are the ClusterCatalog versions tried, newest first.
+var clusterCatalogResources = []schema.GroupVersionResource{
+	{Group: "olm.operatorframework.io", Version: "v1", Resource: "clustercatalogs"},
+	{Group: "olm.operatorframework.io", Version: "v1alpha1", Resource: "clustercatalogs"},
+}
+
+// clusterContext holds real names from the cluster that a correction may use. A nil list means the names
+// could not be gathered and the corresponding field is not checked; an empty list allows nothing.
+type clusterContext struct {
+	namespaces      []string
+	serviceAccounts []string
+	// serviceAccountNamespace is the namespace serviceAccounts were listed in.
+	serviceAccountNamespace string
+	packages                []string
+	// extensions describes the ClusterExtensions that already exist, for the model's information only.
+	extensions []string
+	// version is the API version of the CR, which decides where the grounded fields are.
+	version string
+}
+
+// groundedField is a CR field whose value must be a name that exists in the cluster.
+type groundedField struct {
+	path       fieldPath
+	what       string
+	candidates func(*clusterContext) []string
+}
+
+// clusterExtensionKind is the kind whose fields are grounded.
+var clusterExtensionKind = schema.GroupKind{Group: "olm.operatorframework.io", Kind: "ClusterExtension"}
+
+// groundedFields lists the ClusterExtension fields checked against the cluster context.
+var groundedFields = []groundedField{
+	{fieldPath{"spec", "install", "namespace"}, "namespace", func(c *clusterContext) []string { return c.namespaces }},
+	{fieldPath{"spec", "install", "serviceAccount", "name"}, "ServiceAccount", func(c *clusterContext) []string { return c.serviceAccounts }},
+	{fieldPath{"spec", "source", "catalog", "packageName"}, "package", func(c *clusterContext) []string { return c.packages }},
+}
+
+// groundedV1Fields are the same fields in the v1 layout, where the namespace and service account are at
+// the top of spec.
+var groundedV1Fields = []groundedField{
+	{fieldPath{"spec", "namespace"}, "namespace", func(c *clusterContext) []string { return c.namespaces }},
+	{fieldPath{"spec", "serviceAccount", "name"}, "ServiceAccount", func(c *clusterContext) []string { return c.serviceAccounts }},
+	{fieldPath{"spec", "source", "catalog", "packageName"}, "package", func(c *clusterContext) []string { return c.packages }},
+}
+
+// groundedFieldsFor returns the grounded fields of a ClusterExtension version.
+func groundedFieldsFor(version string) []groundedField {
+	if version == "v1" {
+		return groundedV1Fields
+	}
+	return groundedFields
+}
+
+// namespacePathFor returns where a ClusterExtension version has its install namespace.
+func namespacePathFor(version string) fieldPath {
+	return groundedFieldsFor(version)[0].path
+}
+
+// clusterContextProvider gathers candidate names for a CR from the cluster.
+type clusterContextProvider interface {
+	gather(ctx context.Context, cr *unstructured.Unstructured) (*clusterContext, error)
+	// listServiceAccounts returns the names of the ServiceAccounts in a namespace.
+	listServiceAccounts(ctx context.Context, namespace string) ([]string, error)
+}
+
+// contextProvider is the provider used for grounding, or nil when CLUSTER_CONTEXT_ENABLED is not "true".
+var contextProvider = newClusterContextProvider()
+
+func newClusterContextProvider() clusterContextProvider {
+	if os.Getenv("CLUSTER_CONTEXT_ENABLED") != "true" {
+		return nil
+	}
+	return &kubeContextProvider{}
+}
+
+// kubeContextProvider reads the cluster context through the Kubernetes API and the catalogd content service.
+type kubeContextProvider struct{}
+
+func (p *kubeContextProvider) gather(ctx context.Context, cr *unstructured.Unstructured) (*clusterContext, error) {
+	clientset, err := kubeClientset()
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := kubeDynamicClient()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &clusterContext{}
+
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.Printf("Failed to list namespaces: %v", err)
+	} else {
+		result.namespaces = []string{}
+		for _, ns := range namespaces.Items {
+			result.namespaces = append(result.namespaces, ns.Name)
+		}
+	}
+
+	value, _ := getPath(cr.Object, namespacePathFor(cr.GroupVersionKind().Version))
+	if namespace, _ := value.(string); namespace != "" {
+		serviceAccounts, err := p.listServiceAccounts(ctx, namespace)
+		if err != nil {
+			log.Printf("Failed to list ServiceAccounts in %s: %v", namespace, err)
+		} else {
+			result.serviceAccountNamespace = namespace
+			result.serviceAccounts = serviceAccounts
+		}
+	}
+
+	for _, gvr := range clusterCatalogResources {
+		catalogs, err := dynamicClient.Resource(gvr).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			log.Printf("Failed to list %s: %v", gvr.String(), err)
+			continue
+		}
+		result.packages = catalogPackages(ctx, catalogs.Items)
+		break
+	}
+
+	gvk := cr.GroupVersionKind()
+	extensions, err := dynamicClient.Resource(gvk.GroupVersion().WithResource("clusterextensions")).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.Printf("Failed to list ClusterExtensions: %v", err)
+	} else {
+		for _, ext := range extensions.Items {
+			packageName, _, _ := unstructured.NestedString(ext.Object, "spec", "source", "catalog", "packageName")
+			result.extensions = append(result.extensions, fmt.Sprintf("%s (package %s)", ext.GetName(), packageName))
+		}
+	}
+
+	for _, list := range [][]string{result.namespaces, result.serviceAccounts, result.packages, result.extensions} {
+		sort.Strings(list)
+	}
+	return result, nil
+}
+
+func (p *kubeContextProvider) listServiceAccounts(ctx context.Context, namespace string) ([]string, error) {
+	clientset, err := kubeClientset()
+	if err != nil {
+		return nil, err
+	}
+	serviceAccounts, err := clientset.CoreV1().ServiceAccounts(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, sa := range serviceAccounts.Items {
+		names = append(names, sa.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// catalogPackages reads the package names served by the given ClusterCatalogs, all at once. It returns nil
+// if no catalog could be read, so the package name is not checked.
+func catalogPackages(ctx context.Context, catalogs []unstructured.Unstructured) []string {
+	client, err := catalogHTTPClient()
+	if err != nil {
+		log.Printf("Failed to set up catalog client: %v", err)
+		return nil
+	}
+
+	read := make([][]string, len(catalogs))
+	var wg sync.WaitGroup
+	for i := range catalogs {
+		catalog := &catalogs[i]
+		url := catalogContentURL(catalog)
+		if url == "" {
+			log.Printf("ClusterCatalog %s has no content URL yet", catalog.GetName())
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			names, err := catalogPackageNames(ctx, client, catalog, url)
+			if err != nil {
+				log.Printf("Failed to read packages of ClusterCatalog %s: %v", catalog.GetName(), err)
+				return
+			}
+			read[i] = names
+		}()
+	}
+	wg.Wait()
+
+	var packages []string
+	seen := map[string]bool{}
+	for _, names := range read {
+		if names == nil {
+			continue
+		}
+		if packages == nil {
+			packages = []string{}
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				packages = append(packages, name)
+			}
+		}
+	}
+	return packages
+}
+
+// catalogPackageCache holds the package names read from each ClusterCatalog, by name, with the revision
+// of the content they were read from.
+var catalogPackageCache = struct {
+	sync.Mutex
+	entries map[string]cachedCatalogPackages
+}{entries: map[string]cachedCatalogPackages{}}
+
+type cachedCatalogPackages struct {
+	revision string
+	names    []string
+}
+
+// catalogPackageNames returns the package names of a catalog, reading its content only if the catalog has
+// unpacked new content since it was last read.
+func catalogPackageNames(ctx context.Context, client *http.Client, catalog *unstructured.Unstructured, url string) ([]string, error) {
+	revision := catalogRevision(catalog)
+	catalogPackageCache.Lock()
+	cached, ok := catalogPackageCache.entries[catalog.GetName()]
+	catalogPackageCache.Unlock()
+	if ok && revision != "" && cached.revision == revision {
+		return cached.names, nil
+	}
+
+	names, err := fetchCatalogPackages(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	if names == nil {
+		names = []string{}
+	}
+	if revision != "" {
+		catalogPackageCache.Lock()
+		catalogPackageCache.entries[catalog.GetName()] = cachedCatalogPackages{revision: revision, names: names}
+		catalogPackageCache.Unlock()
+	}
+	return names, nil
+}
+
+// catalogRevision identifies the content a catalog serves: the image digest it resolved its source to and
+// when it was last unpacked. It is empty if the catalog reports neither, and its packages are not cached.
+func catalogRevision(catalog *unstructured.Unstructured) string {
+	ref, _, _ := unstructured.NestedString(catalog.Object, "status", "resolvedSource", "image", "ref")
+	lastUnpacked, _, _ := unstructured.NestedString(catalog.Object, "status", "lastUnpacked")
+	if ref == "" && lastUnpacked == "" {
+		return ""
+	}
+	return ref + "@" + lastUnpacked
+}
+
+// catalogContentURL returns the URL serving all of a catalog's content, for both the v1 (status.urls.base)
+// and the v1alpha1 (status.contentURL) API.
+func catalogContentURL(catalog *unstructured.Unstructured) string {
+	if base, _, _ := unstructured.NestedString(catalog.Object, "status", "urls", "base"); base != "" {
+		return strings.TrimSuffix(base, "/") + "/api/v1/all"
+	}
+	contentURL, _, _ := unstructured.NestedString(catalog.Object, "status", "contentURL")
+	return contentURL
+}
+
+// catalogHTTPClient returns an HTTP client that trusts CATALOGD_CA_FILE in addition to the system roots.
+func catalogHTTPClient() (*http.Client, error) {
+	client := &http.Client{Timeout: catalogFetchTimeout}
+	caFile := os.Getenv("CATALOGD_CA_FILE")
+	if caFile == "" {
+		return client, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return client, nil
+}
+
+// fetchCatalogPackages streams a catalog's file-based catalog content and returns its package names.
+func fetchCatalogPackages(ctx context.Context, client *http.Client, url string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-OK HTTP status: %s", resp.Status)
+	}
+	return parseCatalogPackages(resp.Body)
+}
+
+// parseCatalogPackages returns the names of the olm.package blobs in a stream of file-based catalog JSON.
+func parseCatalogPackages(r io.Reader) ([]string, error) {
+	var names []string
+	decoder := json.NewDecoder(r)
+	for {
+		var meta struct {
+			Schema string `json:"schema"`
+			Name   string `json:"name"`
+		}
+		if err := decoder.Decode(&meta); err == io.EOF {
+			return names, nil
+		} else if err != nil {
+			return names, err
+		}
+		if meta.Schema == "olm.package" && meta.Name != "" {
+			names = append(names, meta.Name)
+		}
+	}
+}
+
+// gatherClusterContext returns the cluster context for a CR, or nil when grounding is disabled or fails.
+// Only ClusterExtensions are grounded; the names gathered mean nothing for other kinds. What isn't gathered
+// within clusterContextTimeout is left out.
+func gatherClusterContext(ctx context.Context, cr *unstructured.Unstructured) *clusterContext {
+	if contextProvider == nil || cr.GroupVersionKind().GroupKind() != clusterExtensionKind {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterContextTimeout)
+	defer cancel()
+	clusterCtx, err := contextProvider.gather(ctx, cr)
+	if err != nil {
+		log.Printf("Failed to gather cluster context: %v", err)
+		return nil
+	}
+	clusterCtx.version = cr.GroupVersionKind().Version
+	return clusterCtx
+}
+
+// groundServiceAccounts makes the ServiceAccounts of the context those of the corrected CR's namespace. They
+// are listed again when the correction set or changed the namespace, since the submitted CR's namespace, if
+// it had one, is where they were listed. If they can't be listed, no ServiceAccount name the correction sets
+// is accepted.
+func groundServiceAccounts(ctx context.Context, adjusted *unstructured.Unstructured, clusterCtx *clusterContext) {
+	if clusterCtx == nil || contextProvider == nil {
+		return
+	}
+	value, _ := getPath(adjusted.Object, namespacePathFor(clusterCtx.version))
+	namespace, _ := value.(string)
+	if namespace == clusterCtx.serviceAccountNamespace && clusterCtx.serviceAccounts != nil {
+		return
+	}
+
+	clusterCtx.serviceAccountNamespace = namespace
+	clusterCtx.serviceAccounts = []string{}
+	if namespace == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterContextTimeout)
+	defer cancel()
+	serviceAccounts, err := contextProvider.listServiceAccounts(ctx, namespace)
+	if err != nil {
+		log.Printf("Failed to list ServiceAccounts in %s: %v", namespace, err)
+		return
+	}
+	clusterCtx.serviceAccounts = serviceAccounts
+}
+
+// checkGrounding returns an error if the correction set a grounded field to a name that isn't in the
+// cluster context. Values the user wrote themselves are left alone.
+func checkGrounding(original, adjusted *unstructured.Unstructured, clusterCtx *clusterContext) error {
+	if clusterCtx == nil {
+		return nil
+	}
+
+	var problems []string
+	for _, field := range groundedFieldsFor(clusterCtx.version) {
+		candidates := field.candidates(clusterCtx)
+		if candidates == nil {
+			continue
+		}
+		value, ok := getPath(adjusted.Object, field.path)
+		if !ok {
+			continue
+		}
+		if before, ok := getPath(original.Object, field.path); ok && before == value {
+			continue
+		}
+		name, _ := value.(string)
+		if !slices.Contains(candidates, name) {
+			problems = append(problems, fmt.Sprintf("%s %q for %s is not one of the %d known", field.what, name, field.path, len(candidates)))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("corrected CR uses names that don't exist in the cluster: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type fakeContextProvider struct {
+	clusterContext *clusterContext
+	// serviceAccounts are the ServiceAccounts by namespace. Listing them in another namespace fails.
+	serviceAccounts map[string][]string
+}
+
+func (f *fakeContextProvider) gather(ctx context.Context, cr *unstructured.Unstructured) (*clusterContext, error) {
+	return f.clusterContext, nil
+}
+
+func (f *fakeContextProvider) listServiceAccounts(ctx context.Context, namespace string) ([]string, error) {
+	serviceAccounts, ok := f.serviceAccounts[namespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace %q not found", namespace)
+	}
+	return serviceAccounts, nil
+}
+
+const ungroundedCRYAML = `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: argocd
+spec:
+  install:
+    namespace: argocd
+    serviceAccount:
+      name: argocd-installer
+  source:
+    sourceType: Catalog
+    catalog: {}
+`
+
+func withContextProvider(t *testing.T, provider clusterContextProvider) {
+	t.Helper()
+	original := contextProvider
+	t.Cleanup(func() { contextProvider = original })
+	contextProvider = provider
+}
+
+func TestAdjustCRWithLLM_GroundsPackageName(t *testing.T) {
+	withContextProvider(t, &fakeContextProvider{clusterContext: &clusterContext{
+		namespaces: []string{"argocd", "default"},
+		packages:   []string{"argocd-operator", "cert-manager"},
+	}})
+
+	cr := parseCR(t, ungroundedCRYAML)
+	crd, err := mockGetCRD(cr)
+	if err != nil {
+		t.Fatalf("Failed to get CRD: %v", err)
+	}
+
+	client := &promptCapturingClient{response: strings.Replace(ungroundedCRYAML, "catalog: {}", "catalog:\n      packageName: argocd-operator", 1)}
+	adjustedCR, err := AdjustCRWithLLM(cr, crd, client)
+	if err != nil {
+		t.Fatalf("AdjustCRWithLLM failed: %v", err)
+	}
+	if !strings.Contains(client.prompt, "spec.source.catalog.packageName: argocd-operator, cert-manager") {
+		t.Errorf("Expected the known packages in the prompt, got:\n%s", client.prompt)
+	}
+	if strings.Contains(client.prompt, "spec.install.serviceAccount.name") {
+		t.Errorf("Did not expect ServiceAccounts in the prompt when they weren't gathered")
+	}
+	if packageName, _, _ := unstructured.NestedString(adjustedCR.Object, "spec", "source", "catalog", "packageName"); packageName != "argocd-operator" {
+		t.Errorf("Unexpected packageName %q", packageName)
+	}
+}
+
+func TestAdjustCRWithLLM_RejectsInventedNames(t *testing.T) {
+	withContextProvider(t, &fakeContextProvider{clusterContext: &clusterContext{
+		packages: []string{"argocd-operator"},
+	}})
+
+	cr := parseCR(t, ungroundedCRYAML)
+	crd, err := mockGetCRD(cr)
+	if err != nil {
+		t.Fatalf("Failed to get CRD: %v", err)
+	}
+
+	client := &promptCapturingClient{response: strings.Replace(ungroundedCRYAML, "catalog: {}", "catalog:\n      packageName: argo-cd", 1)}
+	if _, err := AdjustCRWithLLM(cr, crd, client); err == nil || !strings.Contains(err.Error(), "argo-cd") {
+		t.Fatalf("Expected the invented package name to be rejected, got %v", err)
+	}
+}
+
+func TestAdjustCRWithLLM_GroundsServiceAccountInCorrectedNamespace(t *testing.T) {
+	withContextProvider(t, &fakeContextProvider{
+		clusterContext:  &clusterContext{namespaces: []string{"argocd", "default"}},
+		serviceAccounts: map[string][]string{"argocd": {"argocd-installer"}, "default": {"default"}},
+	})
+
+	submitted := strings.Replace(ungroundedCRYAML, "    namespace: argocd\n    serviceAccount:\n      name: argocd-installer\n", "", 1)
+	cr := parseCR(t, submitted)
+	crd, err := mockGetCRD(cr)
+	if err != nil {
+		t.Fatalf("Failed to get CRD: %v", err)
+	}
+
+	// The ServiceAccount exists in the namespace the model chose
+	client := &promptCapturingClient{response: ungroundedCRYAML}
+	if _, err := AdjustCRWithLLM(cr, crd, client); err != nil {
+		t.Fatalf("AdjustCRWithLLM failed: %v", err)
+	}
+
+	// It doesn't exist there
+	client = &promptCapturingClient{response: strings.Replace(ungroundedCRYAML, "namespace: argocd", "namespace: default", 1)}
+	if _, err := AdjustCRWithLLM(cr, crd, client); err == nil || !strings.Contains(err.Error(), "argocd-installer") {
+		t.Errorf("Expected the ServiceAccount to be rejected, got %v", err)
+	}
+
+	// Its namespace can't be listed
+	withContextProvider(t, &fakeContextProvider{clusterContext: &clusterContext{}})
+	client = &promptCapturingClient{response: ungroundedCRYAML}
+	if _, err := AdjustCRWithLLM(cr, crd, client); err == nil || !strings.Contains(err.Error(), "argocd-installer") {
+		t.Errorf("Expected the ServiceAccount to be rejected when it can't be listed, got %v", err)
+	}
+}
+
+func TestCheckGrounding_KeepsUserValues(t *testing.T) {
+	cr := parseCR(t, ungroundedCRYAML)
+	clusterCtx := &clusterContext{namespaces: []string{"default"}}
+	if err := checkGrounding(cr, cr, clusterCtx); err != nil {
+		t.Errorf("Expected values written by the user to be accepted, got %v", err)
+	}
+}
+
+func TestParseCatalogPackages(t *testing.T) {
+	content := `{"schema":"olm.package","name":"argocd-operator","defaultChannel":"alpha"}
+{"schema":"olm.channel","name":"alpha","package":"argocd-operator"}
+{"schema":"olm.bundle","name":"argocd-operator.v0.8.0","package":"argocd-operator"}
+{"schema":"olm.package","name":"cert-manager"}
+`
+	names, err := parseCatalogPackages(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parseCatalogPackages failed: %v", err)
+	}
+	if strings.Join(names, ",") != "argocd-operator,cert-manager" {
+		t.Errorf("Unexpected packages %v", names)
+	}
+}
+
+func TestCatalogPackages_CachesByRevision(t *testing.T) {
+	original := catalogPackageCache.entries
+	t.Cleanup(func() { catalogPackageCache.entries = original })
+	catalogPackageCache.entries = map[string]cachedCatalogPackages{}
+
+	var reads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads.Add(1)
+		fmt.Fprintf(w, `{"schema":"olm.package","name":%q}`+"\n", strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/api/v1/all"))
+	}))
+	defer server.Close()
+
+	catalog := func(name, lastUnpacked string) unstructured.Unstructured {
+		return unstructured.Unstructured{Object: map[string]interface{}{
+			"metadata": map[string]interface{}{"name": name},
+			"status": map[string]interface{}{
+				"urls":         map[string]interface{}{"base": server.URL + "/" + name},
+				"lastUnpacked": lastUnpacked,
+			},
+		}}
+	}
+	catalogs := []unstructured.Unstructured{catalog("operators", "2026-01-01T00:00:00Z"), catalog("community", "2026-01-01T00:00:00Z")}
+	for i := 0; i < 2; i++ {
+		if packages := catalogPackages(context.TODO(), catalogs); strings.Join(packages, ",") != "operators,community" {
+			t.Fatalf("Unexpected packages %v", packages)
+		}
+	}
+	if got := reads.Load(); got != 2 {
+		t.Errorf("Expected each catalog to be read once, got %d reads", got)
+	}
+
+	// A catalog is read again once it unpacks new content
+	catalogs[1] = catalog("community", "2026-01-02T00:00:00Z")
+	catalogPackages(context.TODO(), catalogs)
+	if got := reads.Load(); got != 3 {
+		t.Errorf("Expected the changed catalog to be read again, got %d reads", got)
+	}
+}
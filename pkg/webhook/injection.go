@@ -0,0 +1,186 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// injectionActionRedact replaces instruction-like values before the CR is sent to the LLM.
+	injectionActionRedact = "redact"
+	// injectionActionRefuse skips the LLM path entirely when instruction-like values are found.
+	injectionActionRefuse = "refuse"
+)
+
+// redactedValue replaces instruction-like content in the copy of the CR sent to the LLM.
+const redactedValue = "[redacted: instruction-like content]"
+
+// minCopiedValueLength is the shortest corrected value checked against suspicious fields.
+const minCopiedValueLength = 3
+
+// injectionPatterns match text that tries to instruct the model rather than describe the resource.
+var injectionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override|bypass)\b.{0,40}\b(instructions?|prompts?|rules?|directions?|guidelines?)\b`),
+	regexp.MustCompile(`(?i)\b(new|updated|real|actual) instructions?\b`),
+	regexp.MustCompile(`(?i)\byou (are|must) now\b`),
+	regexp.MustCompile(`(?i)\byou (should|must|will|shall|are to) (now )?(act|behave|respond|pretend)\b`),
+	regexp.MustCompile(`(?i)\b(act|behave|respond|pretend) (as|like|to be) (an? |the )?(ai|assistant|model|llm|chatbot|system|root|admin|administrator|developer)\b`),
+	regexp.MustCompile(`(?i)\b(system|assistant|developer) (prompt|message)\b`),
+	regexp.MustCompile(`(?i)\b(you (should|must|need to|have to|will)|please|always|instead,?|when (correcting|fixing)( this| it)?,?) (set|change|use|make|put)\b.{0,40}\b(namespace|packagename|package name|serviceaccount|service account|source ?type|channel|version)\b.{0,20}\bto\b`),
+	regexp.MustCompile(`(?i)\b(do not|don't|never) (follow|obey|validate|mention)\b`),
+	regexp.MustCompile(`(?i)(<\|?(im_start|im_end|system|endoftext)\|?>|\[/?INST\]|</?(think|system)>)`),
+}
+
+// suspiciousValue is a CR value that looks like an instruction to the model.
+type suspiciousValue struct {
+	path  fieldPath
+	value string
+}
+
+// promptInjectionAction returns how instruction-like CR content is handled, from PROMPT_INJECTION_ACTION.
+func promptInjectionAction() string {
+	switch action := os.Getenv("PROMPT_INJECTION_ACTION"); action {
+	case "", injectionActionRedact:
+		return injectionActionRedact
+	case injectionActionRefuse:
+		return injectionActionRefuse
+	default:
+		log.Printf("Ignoring invalid PROMPT_INJECTION_ACTION %q", action)
+		return injectionActionRedact
+	}
+}
+
+// findSuspiciousValues returns every string in the CR, including label and annotation keys, that looks like
+// an instruction. Results are sorted by path.
+func findSuspiciousValues(cr *unstructured.Unstructured) []suspiciousValue {
+	var found []suspiciousValue
+	check := func(path fieldPath, text string) {
+		for _, pattern := range injectionPatterns {
+			if pattern.MatchString(text) {
+				found = append(found, suspiciousValue{path: path, value: text})
+				return
+			}
+		}
+	}
+	walkLeaves(cr.Object, func(path fieldPath, value interface{}) {
+		if text, ok := value.(string); ok {
+			check(path, text)
+		}
+	})
+	for _, field := range []string{"labels", "annotations"} {
+		values, _, _ := unstructured.NestedStringMap(cr.Object, "metadata", field)
+		for key := range values {
+			check(fieldPath{"metadata", field, key}, key)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].path.String() < found[j].path.String() })
+	return found
+}
+
+// redactSuspiciousValues returns a copy of the CR with every suspicious value replaced by redactedValue.
+// Suspicious label and annotation keys are removed together with their values.
+func redactSuspiciousValues(cr *unstructured.Unstructured, suspicious []suspiciousValue) *unstructured.Unstructured {
+	redacted := &unstructured.Unstructured{Object: runtime.DeepCopyJSON(cr.Object)}
+	for _, s := range suspicious {
+		if value, ok := getPath(redacted.Object, s.path); ok && value == s.value {
+			setPath(redacted.Object, s.path, redactedValue)
+			continue
+		}
+		// The key itself is suspicious
+		if len(s.path) == 3 {
+			unstructured.RemoveNestedField(redacted.Object, "metadata", s.path[1].(string), s.path[2].(string))
+		}
+	}
+	return redacted
+}
+
+// restoreRedactedValues puts the original value back wherever the model echoed the redaction marker,
+// so the marker never ends up in the patch.
+func restoreRedactedValues(adjusted *unstructured.Unstructured, suspicious []suspiciousValue) {
+	for _, s := range suspicious {
+		if value, ok := getPath(adjusted.Object, s.path); ok && value == redactedValue {
+			setPath(adjusted.Object, s.path, s.value)
+		}
+	}
+	walkLeaves(adjusted.Object, func(path fieldPath, value interface{}) {
+		if value == redactedValue {
+			log.Printf("Model copied the redaction marker to %s", path)
+		}
+	})
+}
+
+// findCopiedValues returns an error naming the first corrected value that the model appears to have taken
+// from a suspicious field. Only values that are new or changed compared to the original CR are checked.
+func findCopiedValues(original, adjusted *unstructured.Unstructured, suspicious []suspiciousValue) error {
+	if len(suspicious) == 0 {
+		return nil
+	}
+
+	// Lower-case the suspicious values once, not for every leaf
+	values := make([]string, len(suspicious))
+	for i, s := range suspicious {
+		values[i] = strings.ToLower(s.value)
+	}
+
+	var problems []string
+	walkLeaves(adjusted.Object, func(path fieldPath, value interface{}) {
+		text, ok := value.(string)
+		if !ok || len(text) < minCopiedValueLength || text == redactedValue {
+			return
+		}
+		if before, ok := getPath(original.Object, path); ok && before == value {
+			return
+		}
+		word := strings.ToLower(text)
+		for i, s := range suspicious {
+			if containsWord(values[i], word) {
+				problems = append(problems, fmt.Sprintf("%s (%q) appears in suspicious field %s", path, text, s.path))
+				return
+			}
+		}
+	})
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("corrected CR uses values taken from instruction-like content: %s", strings.Join(problems, "; "))
+}
+
+// containsWord reports whether word appears in text between boundaries: the start or end of text, or
+// characters that can't be part of a Kubernetes name.
+func containsWord(text, word string) bool {
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], word)
+		if i < 0 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(word)
+		if (start == 0 || !isNameChar(text[start-1])) && (end == len(text) || !isNameChar(text[end])) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-'
+}
+
+// newFenceID returns a random marker used to fence untrusted content in the prompt, so the content can't
+// close the fence itself.
+func newFenceID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "untrusted-cr"
+	}
+	return "untrusted-cr-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,38 @@
+package webhook
+
+import (
+	"sync"
+
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// kubeClientset returns a clientset for the cluster the webhook runs in. It is created once on first use.
+var kubeClientset = sync.OnceValues(func() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+})
+
+// kubeDynamicClient returns a dynamic client for the cluster the webhook runs in. It is created once on first use.
+var kubeDynamicClient = sync.OnceValues(func() (dynamic.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+})
+
+// kubeAPIExtensionsClient returns an apiextensions clientset for the cluster the webhook runs in. It is created
+// once on first use.
+var kubeAPIExtensionsClient = sync.OnceValues(func() (apiextensionsclientset.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return apiextensionsclientset.NewForConfig(config)
+})
@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"log"
+	"reflect"
+	"slices"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// preservedMetadataFields are the metadata fields reported when the model changed them. They, like every
+// field a correction doesn't change, are always taken from the original object.
+var preservedMetadataFields = []string{"name", "namespace", "labels", "annotations", "finalizers", "ownerReferences"}
+
+// mergeCorrection builds the corrected object from the original and the model's output. Only the corrected
+// fields, spec for most kinds, are taken from the model; apiVersion, kind, metadata, status and any other
+// top-level field come from the original, so a correction can never rename the object or remove its
+// labels, annotations, finalizers or owner references. A corrected field the model didn't return is kept
+// as it was.
+func mergeCorrection(original, adjusted *unstructured.Unstructured, fields []string) *unstructured.Unstructured {
+	merged := original.DeepCopy()
+	for _, field := range ignoredModelFields(original, adjusted, fields) {
+		log.Printf("Ignoring model change to %s", field)
+	}
+
+	for _, field := range fields {
+		if value, ok := adjusted.Object[field]; ok {
+			merged.Object[field] = runtime.DeepCopyJSONValue(value)
+		}
+	}
+	return merged
+}
+
+// correctedValues returns the values of the corrected fields of an object, with nil for those it lacks.
+func correctedValues(obj *unstructured.Unstructured, fields []string) map[string]interface{} {
+	values := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		values[field] = runtime.DeepCopyJSONValue(obj.Object[field])
+	}
+	return values
+}
+
+// setCorrectedValues sets the corrected fields of an object to values, removing those that are nil.
+func setCorrectedValues(obj *unstructured.Unstructured, values map[string]interface{}) {
+	for field, value := range values {
+		if value == nil {
+			delete(obj.Object, field)
+		} else {
+			obj.Object[field] = runtime.DeepCopyJSONValue(value)
+		}
+	}
+}
+
+// hashCorrected hashes what a correction of the object may change. Kinds whose spec is corrected hash the
+// spec alone, so their original-spec-hash is the hash of the spec.
+func hashCorrected(obj *unstructured.Unstructured, fields []string) (string, error) {
+	if len(fields) == 1 && fields[0] == "spec" {
+		return hashJSON(obj.Object["spec"])
+	}
+	return hashJSON(correctedValues(obj, fields))
+}
+
+// ignoredModelFields lists the fields outside the corrected ones where the model's output differs from the
+// original.
+func ignoredModelFields(original, adjusted *unstructured.Unstructured, corrected []string) []string {
+	var fields []string
+	if adjusted.GetAPIVersion() != original.GetAPIVersion() {
+		fields = append(fields, "apiVersion")
+	}
+	if adjusted.GetKind() != original.GetKind() {
+		fields = append(fields, "kind")
+	}
+
+	originalMetadata, _, _ := unstructured.NestedMap(original.Object, "metadata")
+	adjustedMetadata, _, _ := unstructured.NestedMap(adjusted.Object, "metadata")
+	for _, field := range preservedMetadataFields {
+		if !reflect.DeepEqual(originalMetadata[field], adjustedMetadata[field]) {
+			fields = append(fields, "metadata."+field)
+		}
+	}
+
+	var others []string
+	for key := range adjusted.Object {
+		if key == "apiVersion" || key == "kind" || key == "metadata" || slices.Contains(corrected, key) {
+			continue
+		}
+		if !reflect.DeepEqual(original.Object[key], adjusted.Object[key]) {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	return append(fields, others...)
+}
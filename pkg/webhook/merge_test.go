@@ -0,0 +1,136 @@
+package webhook
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+const annotatedCRYAML = `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: example
+  labels:
+    team: platform
+  annotations:
+    owner: platform-team
+  finalizers:
+  - olm.operatorframework.io/cleanup
+  ownerReferences:
+  - apiVersion: v1
+    kind: ConfigMap
+    name: parent
+    uid: 0b4e6a4c-3f57-4c1b-9d65-9a3f0e6c2f11
+spec:
+  install:
+    namespace: example-namespace
+    serviceAccount:
+      name: example-sa
+  source:
+    sourceType: Catalog
+    catalog:
+      packageName:
+`
+
+func withGetCRD(t *testing.T, fn func(*unstructured.Unstructured) (*apiextensionsv1.CustomResourceDefinition, error)) {
+	t.Helper()
+	original := getCRD
+	t.Cleanup(func() { getCRD = original })
+	getCRD = fn
+}
+
+func TestMergeCorrection(t *testing.T) {
+	original := parseCR(t, annotatedCRYAML)
+	adjusted := parseCR(t, `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: renamed
+status:
+  installed: true
+spec:
+  source:
+    catalog:
+      packageName: example-package
+`)
+
+	merged := mergeCorrection(original, adjusted, []string{"spec"})
+	if merged.GetName() != "example" || merged.GetLabels()["team"] != "platform" || merged.GetAnnotations()["owner"] != "platform-team" {
+		t.Errorf("Expected identity metadata from the original, got %v", merged.Object["metadata"])
+	}
+	if len(merged.GetFinalizers()) != 1 || len(merged.GetOwnerReferences()) != 1 {
+		t.Errorf("Expected finalizers and ownerReferences from the original, got %v", merged.Object["metadata"])
+	}
+	if _, ok := merged.Object["status"]; ok {
+		t.Errorf("Did not expect status from the model")
+	}
+
+	got := strings.Join(ignoredModelFields(original, adjusted, []string{"spec"}), ",")
+	if got != "metadata.name,metadata.labels,metadata.annotations,metadata.finalizers,metadata.ownerReferences,status" {
+		t.Errorf("Unexpected ignored fields %s", got)
+	}
+}
+
+func TestMutate_PatchOnlyTouchesSpec(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+
+	crJSON, err := yaml.YAMLToJSON([]byte(annotatedCRYAML))
+	if err != nil {
+		t.Fatalf("Failed to convert CR YAML to JSON: %v", err)
+	}
+	admissionReview := admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Object:    runtime.RawExtension{Raw: crJSON},
+			Operation: admissionv1.Create,
+		},
+	}
+
+	// The model follows the prompt and drops annotations, and also renames the object
+	response := `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: example-fixed
+spec:
+  install:
+    namespace: example-namespace
+    serviceAccount:
+      name: example-sa
+  source:
+    sourceType: Catalog
+    catalog:
+      packageName: example-package
+`
+	admissionResponse := mutate(&admissionReview, &mockOpenAIClient{response: response})
+	if !admissionResponse.Allowed {
+		t.Fatalf("Expected admission response to be allowed: %v", admissionResponse.Result)
+	}
+
+	var patch []struct {
+		Op   string `json:"op"`
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(admissionResponse.Patch, &patch); err != nil {
+		t.Fatalf("Failed to parse patch: %v", err)
+	}
+	if len(patch) == 0 {
+		t.Fatalf("Expected a patch")
+	}
+	for _, op := range patch {
+		if strings.Contains(op.Path, "/clusterextensionhelper.operatorframework.io~1") {
+			// Provenance is added by the webhook, not taken from the model
+			continue
+		}
+		if !strings.HasPrefix(op.Path, "/spec/") {
+			t.Errorf("Expected only spec to be patched, got %s %s", op.Op, op.Path)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"os"
+	pathpkg "path"
+	"strings"
+	"sync"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"sigs.k8s.io/yaml"
+)
+
+// correctionMode is what the webhook does with a correction.
+type correctionMode string
+
+const (
+	// correctionModeAutoFix patches the object with the correction.
+	correctionModeAutoFix correctionMode = "auto-fix"
+	// correctionModeSuggest denies the object and shows the correction, leaving the fix to the user.
+	correctionModeSuggest correctionMode = "suggest"
+	// correctionModeOff leaves the object alone.
+	correctionModeOff correctionMode = "off"
+	// correctionModeShadow admits the object unchanged and records the correction it would have made.
+	correctionModeShadow correctionMode = "shadow"
+	// correctionModeApprove denies the object and proposes the correction in a ClusterExtensionCorrection,
+	// which is applied once a person approves it.
+	correctionModeApprove correctionMode = "approve"
+)
+
+// modeKey is the annotation, or label, that sets the mode of one object. The label lets the webhook
+// configuration's objectSelector keep objects that opted out from reaching the webhook at all.
+const modeKey = provenancePrefix + "mode"
+
+// parseCorrectionMode returns the mode named by value, if it is one.
+func parseCorrectionMode(value string) (correctionMode, bool) {
+	switch mode := correctionMode(strings.ToLower(value)); mode {
+	case correctionModeAutoFix, correctionModeSuggest, correctionModeOff, correctionModeShadow, correctionModeApprove:
+		return mode, true
+	default:
+		return "", false
+	}
+}
+
+// defaultCorrectionMode returns the mode set by CORRECTION_MODE. It defaults to auto-fix.
+func defaultCorrectionMode() correctionMode {
+	value := os.Getenv("CORRECTION_MODE")
+	if value == "" {
+		return correctionModeAutoFix
+	}
+	mode, ok := parseCorrectionMode(value)
+	if !ok {
+		log.Printf("Unknown CORRECTION_MODE %q, using %s", value, correctionModeAutoFix)
+		return correctionModeAutoFix
+	}
+	return mode
+}
+
+// requesterRule sets the mode for requests by the listed users, members of the listed groups, or the
+// listed service accounts, written as namespace/name. Every entry may be a glob as understood by
+// path.Match, like system:serviceaccounts:argocd or argocd/*.
+type requesterRule struct {
+	Mode            correctionMode `json:"mode"`
+	Usernames       []string       `json:"usernames,omitempty"`
+	Groups          []string       `json:"groups,omitempty"`
+	ServiceAccounts []string       `json:"serviceAccounts,omitempty"`
+}
+
+// requesterRules sets the mode by who makes the request. The first rule that matches wins.
+type requesterRules struct {
+	Rules []requesterRule `json:"rules"`
+}
+
+// loadRequesterRules returns the rules in the file named by CORRECTION_MODE_RULES_FILE, or nil if it is
+// not set. It is loaded once on first use.
+var loadRequesterRules = sync.OnceValues(func() (*requesterRules, error) {
+	file := os.Getenv("CORRECTION_MODE_RULES_FILE")
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseRequesterRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	log.Printf("Loaded %d requester rules from %s", len(rules.Rules), file)
+	return rules, nil
+})
+
+// parseRequesterRules decodes YAML rules and checks their modes and globs.
+func parseRequesterRules(data []byte) (*requesterRules, error) {
+	rules := &requesterRules{}
+	if err := yaml.UnmarshalStrict(data, rules); err != nil {
+		return nil, fmt.Errorf("invalid requester rules: %v", err)
+	}
+	for i, rule := range rules.Rules {
+		mode, ok := parseCorrectionMode(string(rule.Mode))
+		if !ok && rule.Mode == "false" {
+			return nil, fmt.Errorf("rule %d: mode is false, quote \"off\" so YAML doesn't read it as a boolean", i+1)
+		}
+		if !ok {
+			return nil, fmt.Errorf("rule %d: unknown mode %q, expected auto-fix, suggest, shadow, approve or off", i+1, rule.Mode)
+		}
+		rules.Rules[i].Mode = mode
+		if len(rule.Usernames)+len(rule.Groups)+len(rule.ServiceAccounts) == 0 {
+			return nil, fmt.Errorf("rule %d matches no one", i+1)
+		}
+		for _, patterns := range [][]string{rule.Usernames, rule.Groups, rule.ServiceAccounts} {
+			for _, pattern := range patterns {
+				if _, err := pathpkg.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("rule %d: invalid pattern %q: %v", i+1, pattern, err)
+				}
+			}
+		}
+	}
+	return rules, nil
+}
+
+// matches reports whether the rule applies to the user.
+func (r requesterRule) matches(user authenticationv1.UserInfo) bool {
+	if matchAny(r.Usernames, user.Username) {
+		return true
+	}
+	for _, group := range user.Groups {
+		if matchAny(r.Groups, group) {
+			return true
+		}
+	}
+	if namespace, name, err := serviceaccount.SplitUsername(user.Username); err == nil {
+		return matchAny(r.ServiceAccounts, namespace+"/"+name)
+	}
+	return false
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := pathpkg.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// modeRestraint orders the modes by how little they change the object, from auto-fix, which patches it,
+// to off, which leaves it alone.
+var modeRestraint = map[correctionMode]int{
+	correctionModeAutoFix: 0,
+	correctionModeApprove: 1,
+	correctionModeSuggest: 2,
+	correctionModeShadow:  3,
+	correctionModeOff:     4,
+}
+
+// correctionModeFor returns the mode for a request and why it applies. The requester rules take precedence
+// over CORRECTION_MODE. The object's mode annotation, then its mode label, can only restrain that mode,
+// so that a manifest can't opt itself into auto-fix against a platform rule.
+func correctionModeFor(req *admissionv1.AdmissionRequest, cr *unstructured.Unstructured) (correctionMode, string, error) {
+	rules, err := loadRequesterRules()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load requester rules: %v", err)
+	}
+	mode, reason := defaultCorrectionMode(), "CORRECTION_MODE"
+	if rules != nil {
+		for i, rule := range rules.Rules {
+			if rule.matches(req.UserInfo) {
+				mode, reason = rule.Mode, fmt.Sprintf("requester rule %d for %s", i+1, req.UserInfo.Username)
+				break
+			}
+		}
+	}
+
+	for _, source := range []struct {
+		kind   string
+		values map[string]string
+	}{{"annotation", cr.GetAnnotations()}, {"label", cr.GetLabels()}} {
+		value, ok := source.values[modeKey]
+		if !ok {
+			continue
+		}
+		objectMode, ok := parseCorrectionMode(value)
+		if !ok {
+			log.Printf("Ignoring unknown mode %q in the object's %s %s", value, modeKey, source.kind)
+			continue
+		}
+		if modeRestraint[objectMode] < modeRestraint[mode] {
+			log.Printf("Ignoring mode %s in the object's %s %s: it can't override %s, set by %s", objectMode, modeKey, source.kind, mode, reason)
+			return mode, reason, nil
+		}
+		return objectMode, "the object's " + modeKey + " " + source.kind, nil
+	}
+	return mode, reason, nil
+}
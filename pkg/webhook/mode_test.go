@@ -0,0 +1,139 @@
+package webhook
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const requesterRulesYAML = `
+rules:
+- mode: suggest
+  serviceAccounts:
+  - argocd/*
+  groups:
+  - system:serviceaccounts:flux-system
+- mode: auto-fix
+  usernames:
+  - kubernetes-admin
+- mode: "off"
+  groups:
+  - release-bots
+`
+
+func withRequesterRules(t *testing.T, rulesYAML string) {
+	t.Helper()
+	rules, err := parseRequesterRules([]byte(rulesYAML))
+	if err != nil {
+		t.Fatalf("parseRequesterRules failed: %v", err)
+	}
+	original := loadRequesterRules
+	t.Cleanup(func() { loadRequesterRules = original })
+	loadRequesterRules = func() (*requesterRules, error) { return rules, nil }
+}
+
+func TestParseRequesterRules_Invalid(t *testing.T) {
+	for name, rulesYAML := range map[string]string{
+		"unknown mode":  "rules:\n- mode: fix\n  usernames: [alice]\n",
+		"unquoted off":  "rules:\n- mode: off\n  usernames: [alice]\n",
+		"no requesters": "rules:\n- mode: suggest\n",
+		"bad pattern":   "rules:\n- mode: suggest\n  groups: ['[']\n",
+		"unknown field": "rules:\n- mode: suggest\n  users: [alice]\n",
+	} {
+		if _, err := parseRequesterRules([]byte(rulesYAML)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCorrectionModeFor(t *testing.T) {
+	withRequesterRules(t, requesterRulesYAML)
+	t.Setenv("CORRECTION_MODE", "suggest")
+
+	argoCD := authenticationv1.UserInfo{Username: "system:serviceaccount:argocd:argocd-application-controller"}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		labels      map[string]string
+		user        authenticationv1.UserInfo
+		want        correctionMode
+	}{
+		{name: "service account rule", user: argoCD, want: correctionModeSuggest},
+		{name: "group rule", user: authenticationv1.UserInfo{Username: "system:serviceaccount:flux-system:kustomize-controller", Groups: []string{"system:serviceaccounts:flux-system"}}, want: correctionModeSuggest},
+		{name: "username rule", user: authenticationv1.UserInfo{Username: "kubernetes-admin"}, want: correctionModeAutoFix},
+		{name: "opted-out group", user: authenticationv1.UserInfo{Username: "bot", Groups: []string{"release-bots"}}, want: correctionModeOff},
+		{name: "default", user: authenticationv1.UserInfo{Username: "alice"}, want: correctionModeSuggest},
+		{name: "annotation can't loosen rule", annotations: map[string]string{modeKey: "auto-fix"}, user: argoCD, want: correctionModeSuggest},
+		{name: "annotation can't loosen default", annotations: map[string]string{modeKey: "approve"}, user: authenticationv1.UserInfo{Username: "alice"}, want: correctionModeSuggest},
+		{name: "annotation restrains rule", annotations: map[string]string{modeKey: "Suggest"}, user: authenticationv1.UserInfo{Username: "kubernetes-admin"}, want: correctionModeSuggest},
+		{name: "label restrains rule", labels: map[string]string{modeKey: "off"}, user: argoCD, want: correctionModeOff},
+		{name: "annotation over label", annotations: map[string]string{modeKey: "shadow"}, labels: map[string]string{modeKey: "off"}, want: correctionModeShadow},
+		{name: "unknown annotation", annotations: map[string]string{modeKey: "never"}, user: authenticationv1.UserInfo{Username: "kubernetes-admin"}, want: correctionModeAutoFix},
+	}
+	for _, tt := range tests {
+		cr := parseCR(t, annotatedCRYAML)
+		cr.SetAnnotations(tt.annotations)
+		cr.SetLabels(tt.labels)
+		mode, reason, err := correctionModeFor(&admissionv1.AdmissionRequest{UserInfo: tt.user}, cr)
+		if err != nil {
+			t.Fatalf("%s: correctionModeFor failed: %v", tt.name, err)
+		}
+		if mode != tt.want {
+			t.Errorf("%s: expected %s, got %s (set by %s)", tt.name, tt.want, mode, reason)
+		}
+	}
+}
+
+func TestMutate_OptedOut(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+
+	crYAML := strings.Replace(annotatedCRYAML, "owner: platform-team", "owner: platform-team\n    "+modeKey+": \"off\"", 1)
+	client := &promptCapturingClient{response: correctedAnnotatedCRYAML}
+	response := mutate(admissionReviewFor(t, crYAML), client)
+	if !response.Allowed || response.Patch != nil {
+		t.Fatalf("Expected the object to be allowed unchanged, got %+v", response)
+	}
+	if client.prompt != "" {
+		t.Errorf("Did not expect the model to be called")
+	}
+}
+
+func TestMutate_OptedOutWithoutCRD(t *testing.T) {
+	withGetCRD(t, func(*unstructured.Unstructured) (*apiextensionsv1.CustomResourceDefinition, error) {
+		return nil, errors.New("the server is currently unable to handle the request")
+	})
+
+	crYAML := strings.Replace(annotatedCRYAML, "owner: platform-team", "owner: platform-team\n    "+modeKey+": \"off\"", 1)
+	response := mutate(admissionReviewFor(t, crYAML), &promptCapturingClient{response: correctedAnnotatedCRYAML})
+	if !response.Allowed || response.Patch != nil {
+		t.Fatalf("Expected the object to be allowed without looking up its CRD, got %+v", response)
+	}
+
+	response = mutate(admissionReviewFor(t, annotatedCRYAML), &promptCapturingClient{response: correctedAnnotatedCRYAML})
+	if response.Allowed {
+		t.Errorf("Expected the CRD lookup failure to deny an object that didn't opt out")
+	}
+}
+
+func TestMutate_RequesterSuggestMode(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withRequesterRules(t, requesterRulesYAML)
+
+	review := admissionReviewFor(t, annotatedCRYAML)
+	review.Request.UserInfo = authenticationv1.UserInfo{Username: "system:serviceaccount:argocd:argocd-application-controller"}
+	response := mutate(review, &mockOpenAIClient{response: correctedAnnotatedCRYAML})
+	if response.Allowed || response.Result.Code != 422 {
+		t.Fatalf("Expected Argo CD to get a suggestion, got %+v", response)
+	}
+
+	review.Request.UserInfo = authenticationv1.UserInfo{Username: "kubernetes-admin"}
+	response = mutate(review, &mockOpenAIClient{response: correctedAnnotatedCRYAML})
+	if !response.Allowed || response.Patch == nil {
+		t.Fatalf("Expected a human to get the object corrected, got %+v", response)
+	}
+}
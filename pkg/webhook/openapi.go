@@ -0,0 +1,331 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// openAPIDiscoveryPath lists the OpenAPI v3 documents of the API server, one per group version.
+const openAPIDiscoveryPath = "/openapi/v3"
+
+// schemaRefPrefix starts the references between the schemas of an OpenAPI v3 document.
+const schemaRefPrefix = "#/components/schemas/"
+
+// maxSchemaDepth bounds how deep references are expanded. Deeper schemas accept any object.
+const maxSchemaDepth = 30
+
+// schemaSourceAnnotation is set on the CRDs made from OpenAPI documents, with the document they come from.
+const schemaSourceAnnotation = "clusterextensionhelper.operatorframework.io/schema-source"
+
+// opaqueSchema accepts any object. It stands in for recursive and too deep schemas.
+var opaqueSchema = map[string]interface{}{"type": "object", "x-kubernetes-preserve-unknown-fields": true}
+
+// builtinSchemaOverrides replace the schemas of types the CRD validator would check differently than the
+// API server does. Object metadata is left to the API server, like it is for custom resources, and may
+// hold nulls, like creationTimestamp, that only the API server accepts.
+var builtinSchemaOverrides = map[string]map[string]interface{}{
+	"io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta":               opaqueSchema,
+	"io.k8s.apimachinery.pkg.runtime.RawExtension":                  opaqueSchema,
+	"io.k8s.apimachinery.pkg.util.intstr.IntOrString":               {"x-kubernetes-int-or-string": true},
+	"io.k8s.apimachinery.pkg.api.resource.Quantity":                 {"anyOf": []interface{}{map[string]interface{}{"type": "number"}, map[string]interface{}{"type": "string"}}},
+	"io.k8s.apimachinery.pkg.apis.meta.v1.Time":                     {"type": "string", "format": "date-time", "nullable": true},
+	"io.k8s.apimachinery.pkg.apis.meta.v1.MicroTime":                {"type": "string", "format": "date-time", "nullable": true},
+	"io.k8s.apiextensions-apiserver.pkg.apis.apiextensions.v1.JSON": {"x-kubernetes-preserve-unknown-fields": true},
+}
+
+// openAPIDocument is the part of an OpenAPI v3 document the webhook reads.
+type openAPIDocument struct {
+	Components struct {
+		Schemas map[string]map[string]interface{} `json:"schemas"`
+	} `json:"components"`
+
+	// crds are the CRDs made from the document, by kind.
+	crds map[schema.GroupVersionKind]*apiextensionsv1.CustomResourceDefinition
+}
+
+// openAPIDocuments caches the documents read from the API server by their URL, which holds a hash of their
+// content, so a changed document is read again. paths caches the discovery document, the URL of each group
+// version's document, until resetOpenAPIDiscovery; it is nil until discovery is read.
+var openAPIDocuments = struct {
+	sync.Mutex
+	byURL map[string]*openAPIDocument
+	paths map[string]string
+}{byURL: map[string]*openAPIDocument{}}
+
+// resetOpenAPIDiscovery makes the next lookup read the discovery document again, and so notice changed and
+// new documents.
+func resetOpenAPIDiscovery() {
+	openAPIDocuments.Lock()
+	defer openAPIDocuments.Unlock()
+	openAPIDocuments.paths = nil
+}
+
+// fetchOpenAPI reads a path of the API server, with its query, as JSON.
+var fetchOpenAPI = func(ctx context.Context, uri string) ([]byte, error) {
+	clientset, err := kubeClientset()
+	if err != nil {
+		return nil, err
+	}
+	return clientset.Discovery().RESTClient().Get().RequestURI(uri).SetHeader("Accept", "application/json").Do(ctx).Raw()
+}
+
+// openAPIPath returns the key of a group version in the OpenAPI v3 discovery document, like apis/apps/v1,
+// or api/v1 for the core group.
+func openAPIPath(gv schema.GroupVersion) string {
+	if gv.Group == "" {
+		return "api/" + gv.Version
+	}
+	return "apis/" + gv.Group + "/" + gv.Version
+}
+
+// builtinCRD describes a resource without a CRD, like a Deployment, with a CRD made from the schema the API
+// server publishes for it in /openapi/v3. The validation, prompt and patch pipeline then work on it as on
+// any custom resource.
+func builtinCRD(ctx context.Context, mapping *meta.RESTMapping) (*apiextensionsv1.CustomResourceDefinition, error) {
+	gvk := mapping.GroupVersionKind
+	openAPIDocuments.Lock()
+	defer openAPIDocuments.Unlock()
+
+	// Discovery is read again when the cached one doesn't list the group version, which may be new
+	fresh := false
+	if openAPIDocuments.paths == nil {
+		if err := readOpenAPIDiscovery(ctx); err != nil {
+			return nil, err
+		}
+		fresh = true
+	}
+	uri, ok := openAPIDocuments.paths[openAPIPath(gvk.GroupVersion())]
+	if !ok && !fresh {
+		if err := readOpenAPIDiscovery(ctx); err != nil {
+			return nil, err
+		}
+		uri, ok = openAPIDocuments.paths[openAPIPath(gvk.GroupVersion())]
+	}
+	if !ok {
+		return nil, fmt.Errorf("the API server publishes no OpenAPI v3 schema for %s", gvk.GroupVersion())
+	}
+
+	doc, err := openAPIDocumentAt(ctx, uri)
+	if err != nil {
+		// The document may have changed since discovery was read, and its old URL be gone
+		openAPIDocuments.paths = nil
+		return nil, err
+	}
+	crd, ok := doc.crds[gvk]
+	if !ok {
+		if crd, err = doc.buildCRD(mapping); err != nil {
+			return nil, err
+		}
+		doc.crds[gvk] = crd
+	}
+	return crd.DeepCopy(), nil
+}
+
+// buildCRD makes the CRD of a kind from its schema in the document.
+func (d *openAPIDocument) buildCRD(mapping *meta.RESTMapping) (*apiextensionsv1.CustomResourceDefinition, error) {
+	gvk := mapping.GroupVersionKind
+	name, ok := d.schemaFor(gvk)
+	if !ok {
+		return nil, fmt.Errorf("the OpenAPI v3 schema of %s doesn't describe %s", gvk.GroupVersion(), gvk.Kind)
+	}
+	resolved := (&schemaResolver{schemas: d.Components.Schemas, resolving: map[string]bool{}}).resolveRef(schemaRefPrefix+name, 0)
+	resolvedJSON, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, err
+	}
+	props := &apiextensionsv1.JSONSchemaProps{}
+	if err := json.Unmarshal(resolvedJSON, props); err != nil {
+		return nil, fmt.Errorf("failed to convert the OpenAPI v3 schema of %s: %v", gvk, err)
+	}
+
+	scope := apiextensionsv1.ClusterScoped
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		scope = apiextensionsv1.NamespaceScoped
+	}
+	crdName := mapping.Resource.Resource
+	if gvk.Group != "" {
+		crdName += "." + gvk.Group
+	}
+	return &apiextensionsv1.CustomResourceDefinition{
+		TypeMeta: metav1.TypeMeta{APIVersion: apiextensionsv1.SchemeGroupVersion.String(), Kind: "CustomResourceDefinition"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        crdName,
+			Annotations: map[string]string{schemaSourceAnnotation: openAPIDiscoveryPath + "/" + openAPIPath(gvk.GroupVersion())},
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: gvk.Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{Kind: gvk.Kind, Plural: mapping.Resource.Resource},
+			Scope: scope,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{
+				Name:    gvk.Version,
+				Served:  true,
+				Storage: true,
+				Schema:  &apiextensionsv1.CustomResourceValidation{OpenAPIV3Schema: props},
+			}},
+		},
+	}, nil
+}
+
+// readOpenAPIDiscovery reads the discovery document into openAPIDocuments.paths. openAPIDocuments must be
+// locked.
+func readOpenAPIDiscovery(ctx context.Context) error {
+	data, err := fetchOpenAPI(ctx, openAPIDiscoveryPath)
+	if err != nil {
+		return fmt.Errorf("failed to read OpenAPI v3 discovery: %v", err)
+	}
+	var discovery struct {
+		Paths map[string]struct {
+			ServerRelativeURL string `json:"serverRelativeURL"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &discovery); err != nil {
+		return fmt.Errorf("failed to parse OpenAPI v3 discovery: %v", err)
+	}
+	paths := map[string]string{}
+	for path, entry := range discovery.Paths {
+		if entry.ServerRelativeURL != "" {
+			paths[path] = entry.ServerRelativeURL
+		}
+	}
+	openAPIDocuments.paths = paths
+	return nil
+}
+
+// openAPIDocumentAt returns the document at a URL from the discovery document, reading it on first use.
+// openAPIDocuments must be locked.
+func openAPIDocumentAt(ctx context.Context, uri string) (*openAPIDocument, error) {
+	if doc, ok := openAPIDocuments.byURL[uri]; ok {
+		return doc, nil
+	}
+
+	data, err := fetchOpenAPI(ctx, uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI v3 document %s: %v", uri, err)
+	}
+	doc := &openAPIDocument{crds: map[schema.GroupVersionKind]*apiextensionsv1.CustomResourceDefinition{}}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI v3 document %s: %v", uri, err)
+	}
+	// Documents of older versions of the group version are dropped
+	path, _, _ := strings.Cut(uri, "?")
+	for cached := range openAPIDocuments.byURL {
+		if cachedPath, _, _ := strings.Cut(cached, "?"); cachedPath == path {
+			delete(openAPIDocuments.byURL, cached)
+		}
+	}
+	openAPIDocuments.byURL[uri] = doc
+	return doc, nil
+}
+
+// schemaFor returns the name of the schema of a kind, found by its x-kubernetes-group-version-kind.
+func (d *openAPIDocument) schemaFor(gvk schema.GroupVersionKind) (string, bool) {
+	for name, s := range d.Components.Schemas {
+		kinds, _ := s["x-kubernetes-group-version-kind"].([]interface{})
+		for _, k := range kinds {
+			entry, _ := k.(map[string]interface{})
+			if entry["group"] == gvk.Group && entry["version"] == gvk.Version && entry["kind"] == gvk.Kind {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// schemaResolver expands the references of an OpenAPI v3 document into a self-contained schema, as a CRD
+// has.
+type schemaResolver struct {
+	schemas map[string]map[string]interface{}
+	// resolving are the schemas being expanded, to detect recursion.
+	resolving map[string]bool
+}
+
+// resolve expands the references in a schema. Values, like defaults and enums, are kept as they are.
+func (r *schemaResolver) resolve(node map[string]interface{}, depth int) map[string]interface{} {
+	if ref, ok := node["$ref"].(string); ok {
+		return r.merge(r.resolveRef(ref, depth), node, "$ref")
+	}
+	// Kubernetes wraps a reference in allOf to give it its own description or default
+	if allOf, ok := node["allOf"].([]interface{}); ok && len(allOf) == 1 {
+		if inner, ok := allOf[0].(map[string]interface{}); ok {
+			if ref, ok := inner["$ref"].(string); ok {
+				return r.merge(r.resolveRef(ref, depth), node, "allOf")
+			}
+		}
+	}
+
+	out := make(map[string]interface{}, len(node))
+	for key, value := range node {
+		switch key {
+		case "properties", "patternProperties", "definitions":
+			if properties, ok := value.(map[string]interface{}); ok {
+				resolved := make(map[string]interface{}, len(properties))
+				for name, property := range properties {
+					if s, ok := property.(map[string]interface{}); ok {
+						resolved[name] = r.resolve(s, depth+1)
+					}
+				}
+				value = resolved
+			}
+		case "items", "additionalProperties", "not":
+			if s, ok := value.(map[string]interface{}); ok {
+				value = r.resolve(s, depth+1)
+			}
+		case "allOf", "anyOf", "oneOf":
+			if list, ok := value.([]interface{}); ok {
+				resolved := make([]interface{}, 0, len(list))
+				for _, item := range list {
+					if s, ok := item.(map[string]interface{}); ok {
+						resolved = append(resolved, r.resolve(s, depth+1))
+					}
+				}
+				value = resolved
+			}
+		case "x-kubernetes-group-version-kind":
+			continue
+		}
+		out[key] = value
+	}
+	return out
+}
+
+// resolveRef returns the expanded schema a reference points to.
+func (r *schemaResolver) resolveRef(ref string, depth int) map[string]interface{} {
+	name := strings.TrimPrefix(ref, schemaRefPrefix)
+	if override, ok := builtinSchemaOverrides[name]; ok {
+		return copyJSONMap(override)
+	}
+	target, ok := r.schemas[name]
+	if !ok || r.resolving[name] || depth > maxSchemaDepth {
+		return copyJSONMap(opaqueSchema)
+	}
+	r.resolving[name] = true
+	defer delete(r.resolving, name)
+	return r.resolve(target, depth)
+}
+
+// merge adds the keys a reference was given next to it, like its description or default, to the schema it
+// points to.
+func (r *schemaResolver) merge(resolved, node map[string]interface{}, skip string) map[string]interface{} {
+	for key, value := range node {
+		if key != skip {
+			resolved[key] = value
+		}
+	}
+	return resolved
+}
+
+// copyJSONMap returns a deep copy of a JSON object.
+func copyJSONMap(m map[string]interface{}) map[string]interface{} {
+	data, _ := json.Marshal(m)
+	out := map[string]interface{}{}
+	_ = json.Unmarshal(data, &out)
+	return out
+}
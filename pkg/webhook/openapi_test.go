@@ -0,0 +1,293 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// appsV1OpenAPI is a trimmed apps/v1 OpenAPI v3 document, in the form the API server publishes it.
+const appsV1OpenAPI = `{
+  "openapi": "3.0.0",
+  "components": {"schemas": {
+    "io.k8s.api.apps.v1.Deployment": {
+      "type": "object",
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"default": {}, "allOf": [{"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"}]},
+        "spec": {"default": {}, "description": "Specification of the desired behavior of the Deployment.", "allOf": [{"$ref": "#/components/schemas/io.k8s.api.apps.v1.DeploymentSpec"}]}
+      },
+      "x-kubernetes-group-version-kind": [{"group": "apps", "kind": "Deployment", "version": "v1"}]
+    },
+    "io.k8s.api.apps.v1.DeploymentSpec": {
+      "type": "object",
+      "required": ["selector", "template"],
+      "properties": {
+        "replicas": {"type": "integer", "format": "int32", "description": "Number of desired pods."},
+        "selector": {"allOf": [{"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.apis.meta.v1.LabelSelector"}]},
+        "strategy": {"type": "object", "properties": {"rollingUpdate": {"type": "object", "properties": {
+          "maxSurge": {"allOf": [{"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.util.intstr.IntOrString"}]}
+        }}}},
+        "template": {"default": {}, "allOf": [{"$ref": "#/components/schemas/io.k8s.api.core.v1.PodTemplateSpec"}]}
+      }
+    },
+    "io.k8s.api.core.v1.PodTemplateSpec": {
+      "type": "object",
+      "properties": {
+        "metadata": {"default": {}, "allOf": [{"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"}]},
+        "spec": {"type": "object", "required": ["containers"], "properties": {
+          "containers": {"type": "array", "items": {"default": {}, "allOf": [{"$ref": "#/components/schemas/io.k8s.api.core.v1.Container"}]}}
+        }}
+      }
+    },
+    "io.k8s.api.core.v1.Container": {
+      "type": "object",
+      "required": ["name"],
+      "properties": {
+        "name": {"type": "string"},
+        "imagePullPolicy": {"type": "string", "enum": ["Always", "IfNotPresent", "Never"]},
+        "resources": {"type": "object", "properties": {"limits": {"type": "object", "additionalProperties": {"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.api.resource.Quantity"}}}}
+      }
+    },
+    "io.k8s.apimachinery.pkg.apis.meta.v1.LabelSelector": {
+      "type": "object",
+      "properties": {
+        "matchLabels": {"type": "object", "additionalProperties": {"type": "string", "default": ""}},
+        "matchExpressions": {"type": "array", "items": {"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.apis.meta.v1.LabelSelector"}}
+      }
+    },
+    "io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta": {"type": "object", "properties": {"creationTimestamp": {"type": "string", "format": "date-time"}}},
+    "io.k8s.apimachinery.pkg.util.intstr.IntOrString": {"type": "string", "format": "int-or-string"},
+    "io.k8s.apimachinery.pkg.api.resource.Quantity": {"type": "string"}
+  }}
+}`
+
+const deploymentYAML = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: example
+  namespace: default
+  creationTimestamp: null
+spec:
+  replicas: "3"
+  selector:
+    matchLabels:
+      app: example
+  strategy:
+    rollingUpdate:
+      maxSurge: 25%
+  template:
+    metadata:
+      creationTimestamp: null
+      labels:
+        app: example
+    spec:
+      containers:
+      - name: example
+        imagePullPolicy: Sometimes
+        resources:
+          limits:
+            cpu: 0.5
+            memory: 128Mi
+`
+
+var deploymentMapping = &meta.RESTMapping{
+	Resource:         schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+	GroupVersionKind: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+	Scope:            meta.RESTScopeNamespace,
+}
+
+// withOpenAPI serves documents as the API server's /openapi/v3, and returns the URIs read.
+func withOpenAPI(t *testing.T, documents map[string]string) *[]string {
+	t.Helper()
+	var fetched []string
+	originalFetch := fetchOpenAPI
+	t.Cleanup(func() {
+		fetchOpenAPI = originalFetch
+		openAPIDocuments.Lock()
+		openAPIDocuments.byURL = map[string]*openAPIDocument{}
+		openAPIDocuments.paths = nil
+		openAPIDocuments.Unlock()
+	})
+	fetchOpenAPI = func(ctx context.Context, uri string) ([]byte, error) {
+		fetched = append(fetched, uri)
+		document, ok := documents[uri]
+		if !ok {
+			return nil, fmt.Errorf("the server could not find the requested resource")
+		}
+		return []byte(document), nil
+	}
+	return &fetched
+}
+
+func openAPIDiscoveryFor(hash string) string {
+	return `{"paths": {"apis/apps/v1": {"serverRelativeURL": "/openapi/v3/apis/apps/v1?hash=` + hash + `"}}}`
+}
+
+func TestBuiltinCRD(t *testing.T) {
+	fetched := withOpenAPI(t, map[string]string{
+		openAPIDiscoveryPath:              openAPIDiscoveryFor("A"),
+		"/openapi/v3/apis/apps/v1?hash=A": appsV1OpenAPI,
+	})
+
+	crd, err := builtinCRD(context.TODO(), deploymentMapping)
+	if err != nil {
+		t.Fatalf("builtinCRD failed: %v", err)
+	}
+	if crd.Name != "deployments.apps" || crd.Spec.Scope != apiextensionsv1.NamespaceScoped {
+		t.Errorf("Unexpected CRD %s with scope %s", crd.Name, crd.Spec.Scope)
+	}
+	if replicas := schemaAt(versionSchema(crd, "v1"), "spec.replicas"); replicas == nil || replicas.Description != "Number of desired pods." {
+		t.Errorf("Expected the referenced DeploymentSpec to be expanded, got %+v", replicas)
+	}
+
+	// Only the type mistakes are reported: metadata nulls, quantities and int-or-strings are accepted
+	problems, err := validateAgainstSchema(context.TODO(), parseCR(t, deploymentYAML), nil, crd)
+	if err != nil {
+		t.Fatalf("validateAgainstSchema failed: %v", err)
+	}
+	var fields []string
+	for _, problem := range problems {
+		fields = append(fields, problem.Field)
+	}
+	if got := strings.Join(fields, ","); got != "spec.replicas,spec.template.spec.containers[0].imagePullPolicy" {
+		t.Errorf("Unexpected problems: %v", problems)
+	}
+
+	if _, err := (&openAPIDocument{}).buildCRD(&meta.RESTMapping{GroupVersionKind: schema.GroupVersionKind{Kind: "Pod"}}); err == nil {
+		t.Errorf("Expected an error for a kind the document doesn't describe")
+	}
+
+	// Discovery and documents are served from memory
+	if _, err := builtinCRD(context.TODO(), deploymentMapping); err != nil {
+		t.Fatal(err)
+	}
+	if len(*fetched) != 2 {
+		t.Errorf("Expected discovery and the document to be read once, got %v", *fetched)
+	}
+
+	// A group version missing from the cached discovery makes it be read again
+	if _, err := builtinCRD(context.TODO(), &meta.RESTMapping{GroupVersionKind: schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}}); err == nil {
+		t.Errorf("Expected an error for a group version without a document")
+	}
+	if len(*fetched) != 3 || (*fetched)[2] != openAPIDiscoveryPath {
+		t.Errorf("Expected discovery to be read again, got %v", *fetched)
+	}
+
+	// Once discovery is reset, a document is read again if its hash changed
+	withOpenAPI(t, map[string]string{openAPIDiscoveryPath: openAPIDiscoveryFor("B"), "/openapi/v3/apis/apps/v1?hash=B": appsV1OpenAPI})
+	resetOpenAPIDiscovery()
+	if _, err := builtinCRD(context.TODO(), deploymentMapping); err != nil {
+		t.Fatal(err)
+	}
+	openAPIDocuments.Lock()
+	defer openAPIDocuments.Unlock()
+	if _, ok := openAPIDocuments.byURL["/openapi/v3/apis/apps/v1?hash=A"]; ok || len(openAPIDocuments.byURL) != 1 {
+		t.Errorf("Expected the changed document to replace the old one")
+	}
+}
+
+func TestMutate_BuiltinTarget(t *testing.T) {
+	withOpenAPI(t, map[string]string{
+		openAPIDiscoveryPath:              openAPIDiscoveryFor("A"),
+		"/openapi/v3/apis/apps/v1?hash=A": appsV1OpenAPI,
+	})
+	withGetCRD(t, func(*unstructured.Unstructured) (*apiextensionsv1.CustomResourceDefinition, error) {
+		return builtinCRD(context.TODO(), deploymentMapping)
+	})
+	withEmptyCorrectionCache(t)
+	withCorrectionTargets(t, `
+targets:
+- group: apps
+  version: v1
+  kind: Deployment
+  resource: deployments
+`)
+
+	answer := strings.NewReplacer(`replicas: "3"`, "replicas: 3", "Sometimes", "IfNotPresent").Replace(deploymentYAML)
+	client := &promptCapturingClient{response: answer}
+	response := mutate(admissionReviewFor(t, deploymentYAML), client)
+	if !response.Allowed {
+		t.Fatalf("Expected the Deployment to be allowed: %v", response.Result)
+	}
+	if !strings.Contains(client.prompt, "int32") {
+		t.Errorf("Expected the OpenAPI schema in the prompt, got:\n%s", client.prompt)
+	}
+	for _, want := range []string{`{"value":3,"op":"replace","path":"/spec/replicas"}`, "IfNotPresent"} {
+		if !strings.Contains(string(response.Patch), want) {
+			t.Errorf("Expected %s in the patch, got %s", want, response.Patch)
+		}
+	}
+}
+
+func TestMutate_BuiltinTargetWithoutSpec(t *testing.T) {
+	withOpenAPI(t, map[string]string{
+		openAPIDiscoveryPath: `{"paths": {"api/v1": {"serverRelativeURL": "/openapi/v3/api/v1?hash=A"}}}`,
+		"/openapi/v3/api/v1?hash=A": `{"components": {"schemas": {"io.k8s.api.core.v1.ConfigMap": {
+		  "type": "object",
+		  "properties": {
+		    "data": {"type": "object", "additionalProperties": {"type": "string"}},
+		    "binaryData": {"type": "object", "additionalProperties": {"type": "string", "format": "byte"}}
+		  },
+		  "x-kubernetes-group-version-kind": [{"group": "", "kind": "ConfigMap", "version": "v1"}]
+		}}}}`,
+	})
+	configMapMapping := &meta.RESTMapping{
+		Resource:         schema.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+		GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Scope:            meta.RESTScopeNamespace,
+	}
+	withGetCRD(t, func(*unstructured.Unstructured) (*apiextensionsv1.CustomResourceDefinition, error) {
+		return builtinCRD(context.TODO(), configMapMapping)
+	})
+	withEmptyCorrectionCache(t)
+	configMapYAML := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n  namespace: default\ndata:\n  replicas: 3\n"
+	answer := strings.Replace(configMapYAML, "replicas: 3", `replicas: "3"`, 1) + "spec:\n  replicas: 3\n"
+
+	// A target that corrects spec doesn't apply to ConfigMaps, which have none: they are admitted without
+	// calling the model
+	withCorrectionTargets(t, `
+targets:
+- group: ""
+  version: v1
+  kind: ConfigMap
+  resource: configmaps
+`)
+	client := &promptCapturingClient{response: answer}
+	response := mutate(admissionReviewFor(t, configMapYAML), client)
+	if !response.Allowed || response.Patch != nil || client.prompt != "" {
+		t.Errorf("Expected the ConfigMap to be admitted unchanged, got %+v", response)
+	}
+
+	// A target that corrects data does
+	withCorrectionTargets(t, `
+targets:
+- group: ""
+  version: v1
+  kind: ConfigMap
+  resource: configmaps
+  fields: [data, binaryData]
+`)
+	client = &promptCapturingClient{response: answer}
+	response = mutate(admissionReviewFor(t, configMapYAML), client)
+	if !response.Allowed {
+		t.Fatalf("Expected the ConfigMap to be allowed: %v", response.Result)
+	}
+	if !strings.Contains(string(response.Patch), `{"value":"3","op":"replace","path":"/data/replicas"}`) {
+		t.Errorf("Expected the data to be corrected, got %s", response.Patch)
+	}
+	if strings.Contains(string(response.Patch), "/spec") {
+		t.Errorf("Did not expect the model's spec to be taken, got %s", response.Patch)
+	}
+	if !strings.Contains(string(response.Patch), originalFieldsAnnotation[len(provenancePrefix):]) {
+		t.Errorf("Expected the original data to be saved, got %s", response.Patch)
+	}
+}
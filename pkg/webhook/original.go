@@ -0,0 +1,330 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Where the spec of a corrected object is saved before the correction.
+const (
+	originalStoreAnnotation = "annotation"
+	originalStoreConfigMap  = "configmap"
+	originalStoreNone       = "none"
+)
+
+// Annotations on the corrected object that hold, or point to, its original spec, or the original values of
+// its corrected fields for kinds whose corrections change other fields.
+const (
+	originalSpecAnnotation      = provenancePrefix + "original-spec"
+	originalFieldsAnnotation    = provenancePrefix + "original-fields"
+	originalConfigMapAnnotation = provenancePrefix + "original-configmap"
+)
+
+// Labels on the ConfigMaps that hold original objects, so they can be found and cleaned up.
+const (
+	originalLabel                 = provenancePrefix + "original"
+	originalObjectNameLabel       = provenancePrefix + "object-name"
+	originalObjectUIDLabel        = provenancePrefix + "object-uid"
+	originalObjectGenerationLabel = provenancePrefix + "object-generation"
+)
+
+// originalConfigMapKey is the ConfigMap key holding the original object as JSON, and
+// originalFieldsConfigMapKey the one listing its corrected fields. ConfigMaps without the list hold
+// originals whose spec was corrected.
+const (
+	originalConfigMapKey       = "object.json"
+	originalFieldsConfigMapKey = "fields.json"
+)
+
+// defaultOriginalTTL is how long ConfigMaps holding originals are kept unless ORIGINAL_STORE_TTL is set.
+const defaultOriginalTTL = 30 * 24 * time.Hour
+
+// originalPruneInterval is how often ConfigMaps holding originals are checked for expiry.
+const originalPruneInterval = time.Hour
+
+// defaultOriginalAnnotationMaxBytes caps the original-spec annotation. The API server limits all
+// annotations of an object to 256 KiB together.
+const defaultOriginalAnnotationMaxBytes = 16 * 1024
+
+// originalStore returns where originals are saved, from ORIGINAL_STORE. It defaults to the annotation.
+func originalStore() string {
+	switch store := strings.ToLower(os.Getenv("ORIGINAL_STORE")); store {
+	case originalStoreConfigMap, originalStoreNone:
+		return store
+	case "", originalStoreAnnotation:
+		return originalStoreAnnotation
+	default:
+		log.Printf("Unknown ORIGINAL_STORE %q, using %s", store, originalStoreAnnotation)
+		return originalStoreAnnotation
+	}
+}
+
+// originalAnnotationMaxBytes returns the largest original spec kept in an annotation, from
+// ORIGINAL_ANNOTATION_MAX_BYTES.
+func originalAnnotationMaxBytes() int {
+	if value := os.Getenv("ORIGINAL_ANNOTATION_MAX_BYTES"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Invalid ORIGINAL_ANNOTATION_MAX_BYTES %q, using %d", value, defaultOriginalAnnotationMaxBytes)
+	}
+	return defaultOriginalAnnotationMaxBytes
+}
+
+// originalStoreNamespace returns the namespace of the ConfigMaps holding originals: ORIGINAL_STORE_NAMESPACE,
+// else the webhook's own namespace from POD_NAMESPACE, else default.
+func originalStoreNamespace() string {
+	for _, name := range []string{"ORIGINAL_STORE_NAMESPACE", "POD_NAMESPACE"} {
+		if namespace := os.Getenv(name); namespace != "" {
+			return namespace
+		}
+	}
+	return "default"
+}
+
+// originalTTL returns how long ConfigMaps holding originals are kept, set by ORIGINAL_STORE_TTL as a Go
+// duration like 168h. 0 keeps them forever.
+func originalTTL() time.Duration {
+	value := os.Getenv("ORIGINAL_STORE_TTL")
+	if value == "" {
+		return defaultOriginalTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		log.Printf("Invalid ORIGINAL_STORE_TTL %q, using %s", value, defaultOriginalTTL)
+		return defaultOriginalTTL
+	}
+	return ttl
+}
+
+// saveOriginal records the original spec, or the original corrected fields, so the correction can be
+// reverted. They go into an annotation on the corrected object unless they are larger than the cap, or
+// ORIGINAL_STORE is configmap; then the whole original object goes into a ConfigMap that the corrected
+// object points to.
+func saveOriginal(ctx context.Context, req *admissionv1.AdmissionRequest, original, adjusted *unstructured.Unstructured) error {
+	store := originalStore()
+	if store == originalStoreNone {
+		return nil
+	}
+
+	fields := correctedFieldsFor(original)
+	if store == originalStoreAnnotation {
+		annotation, value := originalSpecAnnotation, original.Object["spec"]
+		if len(fields) != 1 || fields[0] != "spec" {
+			annotation, value = originalFieldsAnnotation, correctedValues(original, fields)
+		}
+		saved, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if maxBytes := originalAnnotationMaxBytes(); len(saved) > maxBytes {
+			log.Printf("Original is %d bytes, more than the %d allowed in an annotation; saving it in a ConfigMap", len(saved), maxBytes)
+		} else {
+			setAnnotation(adjusted, annotation, string(saved))
+			return nil
+		}
+	}
+
+	ref, err := saveOriginalConfigMap(ctx, req, original, fields)
+	if err != nil {
+		return err
+	}
+	setAnnotation(adjusted, originalConfigMapAnnotation, ref)
+	return nil
+}
+
+// saveOriginalConfigMap writes the original object and its corrected fields to a ConfigMap and returns it
+// as namespace/name. The name comes from the object's UID and generation, or from the request UID when the
+// object is being created and has neither yet.
+func saveOriginalConfigMap(ctx context.Context, req *admissionv1.AdmissionRequest, original *unstructured.Unstructured, fields []string) (string, error) {
+	clientset, err := kubeClientset()
+	if err != nil {
+		return "", err
+	}
+
+	object := original.DeepCopy()
+	unstructured.RemoveNestedField(object.Object, "metadata", "managedFields")
+	data, err := json.Marshal(object.Object)
+	if err != nil {
+		return "", err
+	}
+	fieldsJSON, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+
+	key := "request-" + string(req.UID)
+	if uid := original.GetUID(); uid != "" {
+		key = fmt.Sprintf("%s-%d", uid, original.GetGeneration())
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "clusterextension-original-" + key,
+			Namespace: originalStoreNamespace(),
+			Labels: map[string]string{
+				originalLabel:                 "true",
+				originalObjectNameLabel:       truncateLabelValue(original.GetName()),
+				originalObjectGenerationLabel: strconv.FormatInt(original.GetGeneration(), 10),
+			},
+		},
+		Data: map[string]string{originalConfigMapKey: string(data), originalFieldsConfigMapKey: string(fieldsJSON)},
+	}
+	if uid := original.GetUID(); uid != "" {
+		configMap.Labels[originalObjectUIDLabel] = string(uid)
+	}
+
+	// For dry runs, the API server checks the ConfigMap without persisting it, as it does for the object
+	options := metav1.CreateOptions{}
+	if isDryRun(req) {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+	// A retried request saves the same original under the same name
+	_, err = clientset.CoreV1().ConfigMaps(configMap.Namespace).Create(ctx, configMap, options)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("failed to save original in ConfigMap %s/%s: %v", configMap.Namespace, configMap.Name, err)
+	}
+	return configMap.Namespace + "/" + configMap.Name, nil
+}
+
+// RunOriginalPruner deletes the ConfigMaps holding originals once they are older than ORIGINAL_STORE_TTL,
+// looking for them every hour until ctx is done. The ConfigMaps of corrections that were never persisted,
+// because a later webhook or the API server rejected the object, go the same way.
+func RunOriginalPruner(ctx context.Context) error {
+	ttl := originalTTL()
+	if ttl == 0 {
+		log.Printf("ORIGINAL_STORE_TTL is 0, ConfigMaps holding originals are kept forever")
+		return nil
+	}
+	ticker := time.NewTicker(originalPruneInterval)
+	defer ticker.Stop()
+	for {
+		if err := pruneOriginals(ctx, ttl); err != nil {
+			log.Printf("Failed to prune originals: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneOriginals deletes the ConfigMaps holding originals that are older than ttl.
+func pruneOriginals(ctx context.Context, ttl time.Duration) error {
+	clientset, err := kubeClientset()
+	if err != nil {
+		return err
+	}
+	configMaps := clientset.CoreV1().ConfigMaps(originalStoreNamespace())
+	list, err := configMaps.List(ctx, metav1.ListOptions{LabelSelector: originalLabel + "=true"})
+	if err != nil {
+		return err
+	}
+	for _, configMap := range list.Items {
+		if now().Sub(configMap.CreationTimestamp.Time) < ttl {
+			continue
+		}
+		log.Printf("Deleting expired original %s/%s", configMap.Namespace, configMap.Name)
+		if err := configMaps.Delete(ctx, configMap.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("Failed to delete expired original %s/%s: %v", configMap.Namespace, configMap.Name, err)
+		}
+	}
+	return nil
+}
+
+func setAnnotation(obj *unstructured.Unstructured, key, value string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[key] = value
+	obj.SetAnnotations(annotations)
+}
+
+// OriginalFields returns the values the corrected fields of an object had before the correction, by field,
+// with nil for a field it didn't have: its spec for most kinds. They come from its original-spec or
+// original-fields annotation, or from the ConfigMap its original-configmap annotation points to.
+func OriginalFields(ctx context.Context, clientset kubernetes.Interface, obj *unstructured.Unstructured) (map[string]interface{}, error) {
+	annotations := obj.GetAnnotations()
+	if spec, ok := annotations[originalSpecAnnotation]; ok {
+		var original map[string]interface{}
+		if err := json.Unmarshal([]byte(spec), &original); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", originalSpecAnnotation, err)
+		}
+		if original == nil {
+			return map[string]interface{}{"spec": nil}, nil
+		}
+		return map[string]interface{}{"spec": original}, nil
+	}
+	if fields, ok := annotations[originalFieldsAnnotation]; ok {
+		var original map[string]interface{}
+		if err := json.Unmarshal([]byte(fields), &original); err != nil || original == nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", originalFieldsAnnotation, err)
+		}
+		return original, nil
+	}
+
+	ref, ok := annotations[originalConfigMapAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("%s has no saved original; it was not corrected, or was corrected with ORIGINAL_STORE=none", obj.GetName())
+	}
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid %s annotation %q, expected namespace/name", originalConfigMapAnnotation, ref)
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	original := &unstructured.Unstructured{}
+	if err := original.UnmarshalJSON([]byte(configMap.Data[originalConfigMapKey])); err != nil {
+		return nil, fmt.Errorf("invalid original in ConfigMap %s: %v", ref, err)
+	}
+	fields := []string{"spec"}
+	if fieldsJSON, ok := configMap.Data[originalFieldsConfigMapKey]; ok {
+		if err := json.Unmarshal([]byte(fieldsJSON), &fields); err != nil {
+			return nil, fmt.Errorf("invalid corrected fields in ConfigMap %s: %v", ref, err)
+		}
+	}
+	return correctedValues(original, fields), nil
+}
+
+// RevertPatch returns the JSON patch that restores the original corrected fields of an object, as returned
+// by OriginalFields, and removes the label and annotations the webhook added. It also sets the object's
+// mode to off, or the webhook would correct the restored original, which is usually invalid, again.
+func RevertPatch(current *unstructured.Unstructured, original map[string]interface{}) ([]byte, error) {
+	reverted := current.DeepCopy()
+	setCorrectedValues(reverted, original)
+	reverted.SetLabels(withoutProvenance(reverted.GetLabels()))
+	reverted.SetAnnotations(withoutProvenance(reverted.GetAnnotations()))
+	setAnnotation(reverted, modeKey, string(correctionModeOff))
+	return patchFor(current, reverted)
+}
+
+// withoutProvenance returns a copy of labels or annotations without the keys the webhook adds.
+func withoutProvenance(values map[string]string) map[string]string {
+	var out map[string]string
+	for key, value := range values {
+		if strings.HasPrefix(key, provenancePrefix) && key != modeKey {
+			continue
+		}
+		if out == nil {
+			out = map[string]string{}
+		}
+		out[key] = value
+	}
+	return out
+}
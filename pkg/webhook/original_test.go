@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func withKubeClientset(t *testing.T, clientset kubernetes.Interface) {
+	t.Helper()
+	original := kubeClientset
+	t.Cleanup(func() { kubeClientset = original })
+	kubeClientset = func() (kubernetes.Interface, error) { return clientset, nil }
+}
+
+// correctedCR returns the CR in annotatedCRYAML with its package name filled in, as the model would.
+func correctedCR(t *testing.T) *unstructured.Unstructured {
+	t.Helper()
+	return parseCR(t, strings.Replace(annotatedCRYAML, "packageName:", "packageName: example-package", 1))
+}
+
+func TestSaveOriginal_Annotation(t *testing.T) {
+	original := parseCR(t, annotatedCRYAML)
+	adjusted := correctedCR(t)
+	if err := saveOriginal(context.Background(), &admissionv1.AdmissionRequest{UID: "1234"}, original, adjusted); err != nil {
+		t.Fatalf("saveOriginal failed: %v", err)
+	}
+
+	fields, err := OriginalFields(context.Background(), nil, adjusted)
+	if err != nil {
+		t.Fatalf("OriginalFields failed: %v", err)
+	}
+	if packageName, _, _ := unstructured.NestedFieldNoCopy(fields, "spec", "source", "catalog", "packageName"); packageName != nil {
+		t.Errorf("Expected the original, empty packageName, got %v", packageName)
+	}
+}
+
+func TestSaveOriginal_ConfigMapWhenTooLarge(t *testing.T) {
+	t.Setenv("ORIGINAL_ANNOTATION_MAX_BYTES", "10")
+	t.Setenv("POD_NAMESPACE", "webhook-system")
+	clientset := fake.NewSimpleClientset()
+	withKubeClientset(t, clientset)
+
+	original := parseCR(t, annotatedCRYAML)
+	original.SetUID("0e9f1b52-6c1d-4d5c-8f55-3c2f0a7d9b10")
+	original.SetGeneration(3)
+	adjusted := correctedCR(t)
+	if err := saveOriginal(context.Background(), &admissionv1.AdmissionRequest{UID: "1234"}, original, adjusted); err != nil {
+		t.Fatalf("saveOriginal failed: %v", err)
+	}
+
+	ref := adjusted.GetAnnotations()[originalConfigMapAnnotation]
+	if ref != "webhook-system/clusterextension-original-0e9f1b52-6c1d-4d5c-8f55-3c2f0a7d9b10-3" {
+		t.Fatalf("Unexpected ConfigMap reference %q", ref)
+	}
+	if _, ok := adjusted.GetAnnotations()[originalSpecAnnotation]; ok {
+		t.Errorf("Did not expect the spec in an annotation")
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps("webhook-system").Get(context.Background(), "clusterextension-original-0e9f1b52-6c1d-4d5c-8f55-3c2f0a7d9b10-3", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get ConfigMap: %v", err)
+	}
+	if configMap.Labels[originalObjectNameLabel] != "example" || configMap.Labels[originalObjectGenerationLabel] != "3" {
+		t.Errorf("Unexpected labels %v", configMap.Labels)
+	}
+
+	fields, err := OriginalFields(context.Background(), clientset, adjusted)
+	if err != nil {
+		t.Fatalf("OriginalFields failed: %v", err)
+	}
+	if namespace, _, _ := unstructured.NestedString(fields, "spec", "install", "namespace"); namespace != "example-namespace" {
+		t.Errorf("Unexpected original fields %v", fields)
+	}
+}
+
+func TestSaveOriginal_ConfigMapRetriedWithLongName(t *testing.T) {
+	t.Setenv("ORIGINAL_STORE", "configmap")
+	clientset := fake.NewSimpleClientset()
+	withKubeClientset(t, clientset)
+
+	original := parseCR(t, annotatedCRYAML)
+	original.SetName(strings.Repeat("long-name-", 10))
+	req := &admissionv1.AdmissionRequest{UID: "1234"}
+	for i := 0; i < 2; i++ {
+		adjusted := correctedCR(t)
+		if err := saveOriginal(context.Background(), req, original, adjusted); err != nil {
+			t.Fatalf("saveOriginal %d failed: %v", i+1, err)
+		}
+		if ref := adjusted.GetAnnotations()[originalConfigMapAnnotation]; ref != "default/clusterextension-original-request-1234" {
+			t.Errorf("Unexpected ConfigMap reference %q", ref)
+		}
+	}
+
+	configMaps, err := clientset.CoreV1().ConfigMaps("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil || len(configMaps.Items) != 1 {
+		t.Fatalf("Expected one ConfigMap, got %v, %v", configMaps, err)
+	}
+	if name := configMaps.Items[0].Labels[originalObjectNameLabel]; len(name) > 63 || !strings.HasPrefix(original.GetName(), name) {
+		t.Errorf("Expected the object name label to be truncated, got %q", name)
+	}
+}
+
+func TestPruneOriginals(t *testing.T) {
+	withNow(t, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC))
+	configMap := func(name string, created time.Time, labels map[string]string) runtime.Object {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			Labels:            labels,
+			CreationTimestamp: metav1.NewTime(created),
+		}}
+	}
+	original := map[string]string{originalLabel: "true"}
+	clientset := fake.NewSimpleClientset(
+		configMap("expired", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), original),
+		configMap("recent", time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC), original),
+		configMap("unrelated", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), nil),
+	)
+	withKubeClientset(t, clientset)
+
+	if err := pruneOriginals(context.Background(), 7*24*time.Hour); err != nil {
+		t.Fatalf("pruneOriginals failed: %v", err)
+	}
+	configMaps, err := clientset.CoreV1().ConfigMaps("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, configMap := range configMaps.Items {
+		names = append(names, configMap.Name)
+	}
+	if strings.Join(names, ",") != "recent,unrelated" {
+		t.Errorf("Expected only the expired original to be deleted, got %v", names)
+	}
+}
+
+func TestRevertPatch(t *testing.T) {
+	original := parseCR(t, annotatedCRYAML)
+	current := correctedCR(t)
+	if err := addProvenance(current, original, &mockOpenAIClient{}, nil); err != nil {
+		t.Fatalf("addProvenance failed: %v", err)
+	}
+	if err := saveOriginal(context.Background(), &admissionv1.AdmissionRequest{UID: "1234"}, original, current); err != nil {
+		t.Fatalf("saveOriginal failed: %v", err)
+	}
+
+	fields, err := OriginalFields(context.Background(), nil, current)
+	if err != nil {
+		t.Fatalf("OriginalFields failed: %v", err)
+	}
+	patch, err := RevertPatch(current, fields)
+	if err != nil {
+		t.Fatalf("RevertPatch failed: %v", err)
+	}
+
+	currentJSON, err := json.Marshal(current.Object)
+	if err != nil {
+		t.Fatalf("Failed to marshal CR: %v", err)
+	}
+	revertedJSON, err := applyJSONPatch(currentJSON, patch)
+	if err != nil {
+		t.Fatalf("Failed to apply patch: %v", err)
+	}
+	reverted := &unstructured.Unstructured{}
+	if err := reverted.UnmarshalJSON(revertedJSON); err != nil {
+		t.Fatalf("Failed to unmarshal reverted CR: %v", err)
+	}
+
+	for key := range reverted.GetAnnotations() {
+		if strings.HasPrefix(key, provenancePrefix) && key != modeKey {
+			t.Errorf("Expected annotation %s to be removed", key)
+		}
+	}
+	if mode := reverted.GetAnnotations()[modeKey]; mode != string(correctionModeOff) {
+		t.Errorf("Expected the object's mode to be off, so it isn't corrected again, got %q", mode)
+	}
+	if _, ok := reverted.GetLabels()[correctedLabel]; ok {
+		t.Errorf("Expected the corrected label to be removed")
+	}
+	if reverted.GetAnnotations()["owner"] != "platform-team" || reverted.GetLabels()["team"] != "platform" {
+		t.Errorf("Expected the user's labels and annotations to be kept")
+	}
+	if !equalJSON(t, reverted.Object["spec"], original.Object["spec"]) {
+		t.Errorf("Expected the original spec, got %v", reverted.Object["spec"])
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	diff := LineDiff("a\nb\nc\n", "a\nx\nc\n")
+	if diff != "  a\n- b\n+ x\n  c\n" {
+		t.Errorf("Unexpected diff:\n%s", diff)
+	}
+	if LineDiff("same\n", "same\n") != "" {
+		t.Errorf("Expected no diff for equal texts")
+	}
+}
+
+func equalJSON(t *testing.T, a, b interface{}) bool {
+	t.Helper()
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	return string(aJSON) == string(bJSON)
+}
@@ -0,0 +1,153 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fieldPath addresses a value inside an unstructured object. Elements are map keys (string) or list indexes (int).
+type fieldPath []interface{}
+
+// String renders the path the way Kubernetes field errors do, for example spec.install.namespace,
+// spec.items[0] or metadata.annotations[example.com/note].
+func (p fieldPath) String() string {
+	var b strings.Builder
+	for i, element := range p {
+		switch e := element.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", e)
+		case string:
+			if strings.ContainsAny(e, "./[]") {
+				fmt.Fprintf(&b, "[%s]", e)
+				continue
+			}
+			if i > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(e)
+		}
+	}
+	return b.String()
+}
+
+// child returns a copy of the path extended by one element.
+func (p fieldPath) child(element interface{}) fieldPath {
+	out := make(fieldPath, len(p), len(p)+1)
+	copy(out, p)
+	return append(out, element)
+}
+
+// walkLeaves calls fn for every scalar (non-map, non-list) value in obj.
+func walkLeaves(obj interface{}, fn func(path fieldPath, value interface{})) {
+	walkLeavesFrom(nil, obj, fn)
+}
+
+func walkLeavesFrom(path fieldPath, obj interface{}, fn func(path fieldPath, value interface{})) {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		for key, value := range o {
+			walkLeavesFrom(path.child(key), value, fn)
+		}
+	case []interface{}:
+		for i, value := range o {
+			walkLeavesFrom(path.child(i), value, fn)
+		}
+	default:
+		fn(path, obj)
+	}
+}
+
+// getPath returns the value at path, and whether it exists.
+func getPath(obj interface{}, path fieldPath) (interface{}, bool) {
+	current := obj
+	for _, element := range path {
+		switch e := element.(type) {
+		case string:
+			m, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if current, ok = m[e]; !ok {
+				return nil, false
+			}
+		case int:
+			l, ok := current.([]interface{})
+			if !ok || e < 0 || e >= len(l) {
+				return nil, false
+			}
+			current = l[e]
+		}
+	}
+	return current, true
+}
+
+// setPath replaces the value at an existing path. It returns false if the path doesn't exist.
+func setPath(obj interface{}, path fieldPath, value interface{}) bool {
+	if len(path) == 0 {
+		return false
+	}
+	parent, ok := getPath(obj, path[:len(path)-1])
+	if !ok {
+		return false
+	}
+	switch e := path[len(path)-1].(type) {
+	case string:
+		m, ok := parent.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, exists := m[e]; !exists {
+			return false
+		}
+		m[e] = value
+	case int:
+		l, ok := parent.([]interface{})
+		if !ok || e < 0 || e >= len(l) {
+			return false
+		}
+		l[e] = value
+	}
+	return true
+}
+
+// putPath sets the value at path, creating missing maps along the way. Only map keys are supported.
+func putPath(obj map[string]interface{}, path fieldPath, value interface{}) {
+	current := obj
+	for i, element := range path {
+		key := fmt.Sprint(element)
+		if i == len(path)-1 {
+			current[key] = value
+			return
+		}
+		next, ok := current[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			current[key] = next
+		}
+		current = next
+	}
+}
+
+// deletePath removes the map key at path. It returns false if the path doesn't exist.
+func deletePath(obj interface{}, path fieldPath) bool {
+	if len(path) == 0 {
+		return false
+	}
+	parent, ok := getPath(obj, path[:len(path)-1])
+	if !ok {
+		return false
+	}
+	m, ok := parent.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	key, ok := path[len(path)-1].(string)
+	if !ok {
+		return false
+	}
+	if _, exists := m[key]; !exists {
+		return false
+	}
+	delete(m, key)
+	return true
+}
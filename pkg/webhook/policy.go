@@ -0,0 +1,405 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"os"
+	pathpkg "path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// changeOperation is what a correction does to a field.
+type changeOperation string
+
+const (
+	operationAdd    changeOperation = "add"
+	operationModify changeOperation = "modify"
+	operationRemove changeOperation = "remove"
+)
+
+// policyRule matches the fields listed in Paths for the listed Operations, or for every operation if
+// none are listed. Paths are dotted, like spec.install.namespace, with keys containing dots in brackets,
+// like metadata.annotations[example.com/note]. A segment may be a glob as understood by path.Match, and
+// ** matches any number of segments. A path also matches everything below it.
+type policyRule struct {
+	Paths      []string          `json:"paths"`
+	Operations []changeOperation `json:"operations,omitempty"`
+
+	// patterns are the parsed Paths, set when the policy is loaded.
+	patterns [][]string
+}
+
+// correctionPolicy decides which changes a correction may make. A change is allowed if an Allow rule
+// matches it, or if there are no Allow rules, and no Deny rule matches it. A nil policy allows everything.
+type correctionPolicy struct {
+	Allow []policyRule `json:"allow,omitempty"`
+	Deny  []policyRule `json:"deny,omitempty"`
+}
+
+// fieldChange is one change a correction makes to a scalar field, or to a list, which is treated as a
+// single value.
+type fieldChange struct {
+	operation changeOperation
+	path      fieldPath
+}
+
+func (c fieldChange) String() string {
+	return fmt.Sprintf("%s %s", c.operation, c.path)
+}
+
+// loadCorrectionPolicy returns the policy in the file named by CORRECTION_POLICY_FILE, or nil if it is
+// not set. It is loaded once on first use.
+var loadCorrectionPolicy = sync.OnceValues(func() (*correctionPolicy, error) {
+	file := os.Getenv("CORRECTION_POLICY_FILE")
+	if file == "" {
+		return nil, nil
+	}
+	return readCorrectionPolicy(file)
+})
+
+// readCorrectionPolicy reads the policy in a file.
+func readCorrectionPolicy(file string) (*correctionPolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := parseCorrectionPolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	log.Printf("Loaded correction policy from %s: %d allow and %d deny rules", file, len(policy.Allow), len(policy.Deny))
+	return policy, nil
+}
+
+// parseCorrectionPolicy decodes a YAML policy and checks its paths and operations.
+func parseCorrectionPolicy(data []byte) (*correctionPolicy, error) {
+	policy := &correctionPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("invalid correction policy: %v", err)
+	}
+	for _, rules := range [][]policyRule{policy.Allow, policy.Deny} {
+		for i := range rules {
+			if err := rules[i].compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return policy, nil
+}
+
+func (r *policyRule) compile() error {
+	if len(r.Paths) == 0 {
+		return fmt.Errorf("policy rule has no paths")
+	}
+	for _, operation := range r.Operations {
+		switch operation {
+		case operationAdd, operationModify, operationRemove:
+		default:
+			return fmt.Errorf("unknown operation %q, expected add, modify or remove", operation)
+		}
+	}
+	r.patterns = nil
+	for _, path := range r.Paths {
+		pattern, err := parsePolicyPath(path)
+		if err != nil {
+			return err
+		}
+		r.patterns = append(r.patterns, pattern)
+	}
+	return nil
+}
+
+// parsePolicyPath splits a dotted path into its segments and checks that each is a valid glob.
+func parsePolicyPath(path string) ([]string, error) {
+	var (
+		segments []string
+		current  strings.Builder
+	)
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '.':
+			segments = append(segments, current.String())
+			current.Reset()
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid policy path %q: unclosed [", path)
+			}
+			if current.Len() > 0 {
+				segments = append(segments, current.String())
+				current.Reset()
+			}
+			segments = append(segments, path[i+1:i+end])
+			i += end
+			if i+1 < len(path) && path[i+1] == '.' {
+				i++
+			}
+		default:
+			current.WriteByte(path[i])
+		}
+	}
+	if current.Len() > 0 || len(segments) == 0 {
+		segments = append(segments, current.String())
+	}
+
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid policy path %q: empty segment", path)
+		}
+		if _, err := pathpkg.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid policy path %q: %v", path, err)
+		}
+	}
+	return segments, nil
+}
+
+// matchSegments reports whether pattern matches path or one of its ancestors.
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if ok, _ := pathpkg.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], path[1:])
+}
+
+func (r *policyRule) matches(change fieldChange, segments []string) bool {
+	if len(r.Operations) > 0 && !containsOperation(r.Operations, change.operation) {
+		return false
+	}
+	for _, pattern := range r.patterns {
+		if matchSegments(pattern, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsOperation(operations []changeOperation, operation changeOperation) bool {
+	for _, o := range operations {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the policy permits a change.
+func (p *correctionPolicy) allows(change fieldChange) bool {
+	if p == nil {
+		return true
+	}
+	segments := make([]string, len(change.path))
+	for i, element := range change.path {
+		segments[i] = fmt.Sprint(element)
+	}
+
+	if len(p.Allow) > 0 {
+		allowed := false
+		for i := range p.Allow {
+			if p.Allow[i].matches(change, segments) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for i := range p.Deny {
+		if p.Deny[i].matches(change, segments) {
+			return false
+		}
+	}
+	return true
+}
+
+// enforce checks every change in the JSON patch from original to adjusted against the policy. It returns
+// a copy of adjusted with the forbidden changes undone, and the changes that were dropped.
+func (p *correctionPolicy) enforce(original, adjusted *unstructured.Unstructured) (*unstructured.Unstructured, []fieldChange, error) {
+	if p == nil {
+		return adjusted, nil, nil
+	}
+	changes, err := patchChanges(original, adjusted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filtered := adjusted.DeepCopy()
+	var dropped []fieldChange
+	for _, change := range changes {
+		if p.allows(change) {
+			continue
+		}
+		dropped = append(dropped, change)
+		revertChange(original.Object, filtered.Object, change.path)
+	}
+	return filtered, dropped, nil
+}
+
+// patchChanges lists the field changes made by the JSON patch createJSONPatch generates for the
+// correction. Operations on objects are expanded to the fields inside them; operations inside a list
+// become a change to the whole list.
+func patchChanges(original, adjusted *unstructured.Unstructured) ([]fieldChange, error) {
+	patchBytes, err := patchFor(original, adjusted)
+	if err != nil {
+		return nil, err
+	}
+	operations, err := parsePatch(patchBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var changes []fieldChange
+	for _, operation := range operations {
+		pointers := []string{operation.Path}
+		if operation.From != "" {
+			pointers = append(pointers, operation.From)
+		}
+		for _, pointer := range pointers {
+			path := changedValuePath(original.Object, adjusted.Object, parseJSONPointer(pointer))
+			if seen[path.String()] {
+				continue
+			}
+			seen[path.String()] = true
+			before, inOriginal := getPath(original.Object, path)
+			after, inAdjusted := getPath(adjusted.Object, path)
+			changes = diffFields(path, before, inOriginal, after, inAdjusted, changes)
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].path.String() < changes[j].path.String() })
+	return changes, nil
+}
+
+// parseJSONPointer splits an RFC 6901 JSON pointer into its unescaped tokens.
+func parseJSONPointer(pointer string) []string {
+	if pointer == "" {
+		return nil
+	}
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens
+}
+
+// changedValuePath converts pointer tokens to a path of map keys, stopping at the first list in either
+// object so that list elements are never addressed on their own.
+func changedValuePath(original, adjusted map[string]interface{}, tokens []string) fieldPath {
+	var path fieldPath
+	for _, token := range tokens {
+		for _, obj := range []map[string]interface{}{original, adjusted} {
+			if value, ok := getPath(obj, path); ok {
+				if _, isList := value.([]interface{}); isList {
+					return path
+				}
+			}
+		}
+		path = path.child(token)
+	}
+	return path
+}
+
+// diffFields appends the field changes between two values at path to changes.
+// A null value counts as missing, as it does for the API server.
+func diffFields(path fieldPath, before interface{}, inBefore bool, after interface{}, inAfter bool, changes []fieldChange) []fieldChange {
+	inBefore = inBefore && before != nil
+	inAfter = inAfter && after != nil
+	beforeMap, beforeIsMap := before.(map[string]interface{})
+	afterMap, afterIsMap := after.(map[string]interface{})
+
+	switch {
+	case beforeIsMap && afterIsMap:
+		return diffMaps(path, beforeMap, afterMap, changes)
+	case !inBefore && afterIsMap && len(afterMap) > 0:
+		return diffMaps(path, nil, afterMap, changes)
+	case !inAfter && beforeIsMap && len(beforeMap) > 0:
+		return diffMaps(path, beforeMap, nil, changes)
+	case !inBefore && inAfter:
+		return append(changes, fieldChange{operation: operationAdd, path: path})
+	case inBefore && !inAfter:
+		return append(changes, fieldChange{operation: operationRemove, path: path})
+	case !reflect.DeepEqual(before, after):
+		return append(changes, fieldChange{operation: operationModify, path: path})
+	}
+	return changes
+}
+
+func diffMaps(path fieldPath, before, after map[string]interface{}, changes []fieldChange) []fieldChange {
+	keys := map[string]bool{}
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		beforeValue, inBefore := before[key]
+		afterValue, inAfter := after[key]
+		changes = diffFields(path.child(key), beforeValue, inBefore, afterValue, inAfter, changes)
+	}
+	return changes
+}
+
+// revertChange restores the original value at path in adjusted, or removes the field if the original
+// didn't have it, along with any maps left empty that the original didn't have either.
+func revertChange(original, adjusted map[string]interface{}, path fieldPath) {
+	if len(path) == 0 {
+		return
+	}
+	if value, ok := getPath(original, path); ok {
+		putPath(adjusted, path, runtime.DeepCopyJSONValue(value))
+		return
+	}
+
+	deletePath(adjusted, path)
+	for parent := path[:len(path)-1]; len(parent) > 0; parent = parent[:len(parent)-1] {
+		if _, ok := getPath(original, parent); ok {
+			return
+		}
+		if value, ok := getPath(adjusted, parent); !ok || !isEmptyMap(value) {
+			return
+		}
+		deletePath(adjusted, parent)
+	}
+}
+
+func isEmptyMap(value interface{}) bool {
+	m, ok := value.(map[string]interface{})
+	return ok && len(m) == 0
+}
+
+// describeDroppedChanges renders dropped changes for logs and admission warnings.
+func describeDroppedChanges(dropped []fieldChange) []string {
+	descriptions := make([]string, len(dropped))
+	for i, change := range dropped {
+		descriptions[i] = fmt.Sprintf("correction policy forbids %s", change)
+	}
+	return descriptions
+}
@@ -0,0 +1,208 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+const platformPolicyYAML = `
+allow:
+- paths: ["spec.**"]
+deny:
+- paths:
+  - spec.source.catalog.packageName
+  - spec.install.namespace
+  operations: [add, modify]
+`
+
+func withCorrectionPolicy(t *testing.T, policyYAML string) {
+	t.Helper()
+	policy, err := parseCorrectionPolicy([]byte(policyYAML))
+	if err != nil {
+		t.Fatalf("parseCorrectionPolicy failed: %v", err)
+	}
+	original := loadCorrectionPolicy
+	t.Cleanup(func() { loadCorrectionPolicy = original })
+	loadCorrectionPolicy = func() (*correctionPolicy, error) { return policy, nil }
+}
+
+func TestParsePolicyPath(t *testing.T) {
+	tests := map[string]string{
+		"spec.install.namespace":                   "spec|install|namespace",
+		"metadata.annotations[example.com/note]":   "metadata|annotations|example.com/note",
+		"spec.**.name":                             "spec|**|name",
+		"metadata.labels[app.kubernetes.io/*].foo": "metadata|labels|app.kubernetes.io/*|foo",
+	}
+	for path, want := range tests {
+		segments, err := parsePolicyPath(path)
+		if err != nil {
+			t.Errorf("parsePolicyPath(%q) failed: %v", path, err)
+			continue
+		}
+		if got := strings.Join(segments, "|"); got != want {
+			t.Errorf("parsePolicyPath(%q) = %s, want %s", path, got, want)
+		}
+	}
+
+	for _, path := range []string{"spec..install", "spec[unclosed", "spec.[a-"} {
+		if _, err := parsePolicyPath(path); err == nil {
+			t.Errorf("Expected parsePolicyPath(%q) to fail", path)
+		}
+	}
+}
+
+func TestCorrectionPolicy_Allows(t *testing.T) {
+	policy, err := parseCorrectionPolicy([]byte(platformPolicyYAML))
+	if err != nil {
+		t.Fatalf("parseCorrectionPolicy failed: %v", err)
+	}
+
+	tests := []struct {
+		change fieldChange
+		want   bool
+	}{
+		{fieldChange{operationAdd, fieldPath{"spec", "install", "serviceAccount", "name"}}, true},
+		{fieldChange{operationAdd, fieldPath{"spec", "source", "catalog", "packageName"}}, false},
+		{fieldChange{operationModify, fieldPath{"spec", "install", "namespace"}}, false},
+		{fieldChange{operationRemove, fieldPath{"spec", "install", "namespace"}}, true},
+		{fieldChange{operationModify, fieldPath{"metadata", "labels", "team"}}, false},
+	}
+	for _, tt := range tests {
+		if got := policy.allows(tt.change); got != tt.want {
+			t.Errorf("allows(%s) = %v, want %v", tt.change, got, tt.want)
+		}
+	}
+
+	var none *correctionPolicy
+	if !none.allows(fieldChange{operationRemove, fieldPath{"metadata"}}) {
+		t.Errorf("Expected no policy to allow everything")
+	}
+}
+
+func TestCorrectionPolicy_EnforceExpandsObjects(t *testing.T) {
+	policy, err := parseCorrectionPolicy([]byte(platformPolicyYAML))
+	if err != nil {
+		t.Fatalf("parseCorrectionPolicy failed: %v", err)
+	}
+
+	original := parseCR(t, `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: example
+spec:
+  install:
+    serviceAccount:
+      name: example-sa
+`)
+	// The whole source object is new, so the patch adds it in one operation
+	adjusted := parseCR(t, `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: example
+spec:
+  install:
+    namespace: example-namespace
+    serviceAccount:
+      name: example-sa
+  source:
+    sourceType: Catalog
+    catalog:
+      packageName: example-package
+`)
+
+	filtered, dropped, err := policy.enforce(original, adjusted)
+	if err != nil {
+		t.Fatalf("enforce failed: %v", err)
+	}
+	var got []string
+	for _, change := range dropped {
+		got = append(got, change.String())
+	}
+	if strings.Join(got, ", ") != "add spec.install.namespace, add spec.source.catalog.packageName" {
+		t.Errorf("Unexpected dropped changes %v", got)
+	}
+	if sourceType, _, _ := unstructured.NestedString(filtered.Object, "spec", "source", "sourceType"); sourceType != "Catalog" {
+		t.Errorf("Expected the allowed sourceType to be kept, got %q", sourceType)
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(filtered.Object, "spec", "source", "catalog"); found {
+		t.Errorf("Expected the catalog left empty by the dropped change to be removed")
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(filtered.Object, "spec", "install", "namespace"); found {
+		t.Errorf("Expected the namespace to be dropped")
+	}
+}
+
+func TestMutate_PolicyDropsForbiddenChanges(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withCorrectionPolicy(t, platformPolicyYAML)
+
+	crYAML := `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: example
+spec:
+  install:
+    namespace: example-namespace
+  source:
+    sourceType: Catalog
+    catalog:
+      packageName: example-package
+`
+	response := strings.Replace(crYAML, "namespace: example-namespace", "namespace: other-namespace\n    serviceAccount:\n      name: example-sa", 1)
+	admissionResponse := mutate(admissionReviewFor(t, crYAML), &mockOpenAIClient{response: response})
+	if !admissionResponse.Allowed {
+		t.Fatalf("Expected admission response to be allowed: %v", admissionResponse.Result)
+	}
+	if len(admissionResponse.Warnings) == 0 || !strings.Contains(admissionResponse.Warnings[0], "modify spec.install.namespace") {
+		t.Errorf("Expected a warning about the namespace, got %v", admissionResponse.Warnings)
+	}
+	if strings.Contains(string(admissionResponse.Patch), "other-namespace") {
+		t.Errorf("Expected the namespace change to be dropped, got %s", admissionResponse.Patch)
+	}
+	if !strings.Contains(string(admissionResponse.Patch), "example-sa") {
+		t.Errorf("Expected the serviceAccount to be added, got %s", admissionResponse.Patch)
+	}
+}
+
+func TestMutate_PolicyDeniesWhenRemainderInvalid(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withCorrectionPolicy(t, platformPolicyYAML)
+
+	admissionResponse := mutate(admissionReviewFor(t, unicodeCRYAML), &mockOpenAIClient{
+		response: strings.Replace(unicodeCRYAML, "packageName:", "packageName: example-package", 1),
+	})
+	if admissionResponse.Allowed {
+		t.Fatalf("Expected the request to be denied")
+	}
+	if !strings.Contains(admissionResponse.Result.Message, "add spec.source.catalog.packageName") {
+		t.Errorf("Expected the forbidden change in the message, got %q", admissionResponse.Result.Message)
+	}
+	if admissionResponse.Result.Reason != metav1.StatusReasonForbidden {
+		t.Errorf("Expected a policy violation to be Forbidden, got %s", admissionResponse.Result.Reason)
+	}
+}
+
+// admissionReviewFor wraps a CR in a CREATE admission review.
+func admissionReviewFor(t *testing.T, crYAML string) *admissionv1.AdmissionReview {
+	t.Helper()
+	crJSON, err := yaml.YAMLToJSON([]byte(crYAML))
+	if err != nil {
+		t.Fatalf("Failed to convert CR YAML to JSON: %v", err)
+	}
+	return &admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Object:    runtime.RawExtension{Raw: crJSON},
+			Operation: admissionv1.Create,
+		},
+	}
+}
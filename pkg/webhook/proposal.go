@@ -0,0 +1,281 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// proposalGVR is the cluster-scoped resource that holds corrections waiting for approval. Its CRD is in
+// config/crd/clusterextensioncorrections.yaml.
+var proposalGVR = schema.GroupVersionResource{
+	Group:    "clusterextensionhelper.operatorframework.io",
+	Version:  "v1alpha1",
+	Resource: "clusterextensioncorrections",
+}
+
+const proposalKind = "ClusterExtensionCorrection"
+
+// defaultProposalTTL is how long a proposal lives unless CORRECTION_PROPOSAL_TTL is set.
+const defaultProposalTTL = 24 * time.Hour
+
+// maxProposalNamePrefix keeps proposal names, the target's name and a hash, within the 253 characters
+// allowed.
+const maxProposalNamePrefix = 200
+
+// Proposal phases, in status.phase. A proposal without a phase is pending.
+const (
+	proposalPending = "Pending"
+	proposalApplied = "Applied"
+	proposalFailed  = "Failed"
+)
+
+// proposalSignatureAnnotation holds the webhook's signature of a proposal. The controller only applies
+// proposals with a valid signature, so proposals written by anyone but the webhook are never applied.
+const proposalSignatureAnnotation = provenancePrefix + "signature"
+
+// signedProposalFields are the spec fields covered by the signature, with the proposal's name. They are all
+// immutable, and together decide what the controller writes.
+var signedProposalFields = []string{"target", "operation", "baseResourceVersion", "original", "patch", "expiresAt"}
+
+// proposalSigningKey returns the key proposals are signed with, from PROPOSAL_SIGNING_KEY. Without it, a
+// random key is made, and proposals made before a restart, or by another replica, can't be applied.
+var proposalSigningKey = sync.OnceValue(func() []byte {
+	if key := os.Getenv("PROPOSAL_SIGNING_KEY"); key != "" {
+		return []byte(key)
+	}
+	log.Printf("PROPOSAL_SIGNING_KEY is not set, signing proposals with a random key")
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	utilruntime.Must(err)
+	return key
+})
+
+// signProposal returns the signature of a proposal's name and the signed fields of its spec.
+func signProposal(name string, spec map[string]interface{}) (string, error) {
+	signed := map[string]interface{}{"name": name}
+	for _, field := range signedProposalFields {
+		if value, ok := spec[field]; ok {
+			signed[field] = value
+		}
+	}
+	// Map keys are marshaled in sorted order, so the same fields always give the same signature
+	data, err := json.Marshal(signed)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, proposalSigningKey())
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyProposal checks that the webhook made a proposal and that its signed fields are unchanged.
+func verifyProposal(proposal *unstructured.Unstructured) error {
+	signature := proposal.GetAnnotations()[proposalSignatureAnnotation]
+	if signature == "" {
+		return fmt.Errorf("proposal is not signed by the webhook")
+	}
+	spec, _, _ := unstructured.NestedMap(proposal.Object, "spec")
+	want, err := signProposal(proposal.GetName(), spec)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return fmt.Errorf("proposal signature is invalid")
+	}
+	return nil
+}
+
+// proposalTTL returns the lifetime of a proposal, set by CORRECTION_PROPOSAL_TTL as a Go duration like 4h.
+func proposalTTL() time.Duration {
+	value := os.Getenv("CORRECTION_PROPOSAL_TTL")
+	if value == "" {
+		return defaultProposalTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Printf("Invalid CORRECTION_PROPOSAL_TTL %q, using %s", value, defaultProposalTTL)
+		return defaultProposalTTL
+	}
+	return ttl
+}
+
+// newProposal builds the proposal of a correction: the submitted object, the JSON patch that corrects it,
+// the model's reasoning and the validation status of both. The name is derived from the target and the
+// correction, so a request that is retried unchanged finds the proposal it already made.
+func newProposal(req *admissionv1.AdmissionRequest, cr *unstructured.Unstructured, patch []byte, correction *llmCorrection, validationErrors string, client openaiClientInterface, warnings []string) (*unstructured.Unstructured, error) {
+	original := cr.DeepCopy()
+	unstructured.RemoveNestedField(original.Object, "metadata", "managedFields")
+	delete(original.Object, "status")
+
+	originalJSON, err := original.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	specHash, err := hashCorrected(original, correctedFieldsFor(original))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte(specHash), patch...))
+	prefix := cr.GetName()
+	if prefix == "" {
+		// Objects created with generateName have no name yet
+		prefix = strings.TrimRight(cr.GetGenerateName(), "-.")
+	}
+	if prefix == "" {
+		prefix = strings.ToLower(cr.GetKind())
+	}
+	if len(prefix) > maxProposalNamePrefix {
+		prefix = strings.TrimRight(prefix[:maxProposalNamePrefix], "-.")
+	}
+	name := prefix + "-" + hex.EncodeToString(sum[:])[:10]
+
+	target := map[string]interface{}{
+		"group":     req.Resource.Group,
+		"version":   req.Resource.Version,
+		"resource":  req.Resource.Resource,
+		"namespace": req.Namespace,
+	}
+	if cr.GetName() != "" {
+		target["name"] = cr.GetName()
+	} else {
+		target["generateName"] = cr.GetGenerateName()
+	}
+
+	provider, model := describeClient(client)
+	spec := map[string]interface{}{
+		"target":    target,
+		"operation": string(req.Operation),
+		"original":  string(originalJSON),
+		"patch":     string(patch),
+		"validation": map[string]interface{}{
+			"originalErrors": validationErrors,
+			"correctedValid": true,
+		},
+		"provider":  provider,
+		"model":     model,
+		"requester": req.UserInfo.Username,
+		"approved":  false,
+		"expiresAt": now().Add(proposalTTL()).UTC().Format(time.RFC3339),
+	}
+	if correction != nil && correction.reasoning != "" {
+		spec["reasoning"] = correction.reasoning
+	}
+	if len(warnings) > 0 {
+		changes := make([]interface{}, len(warnings))
+		for i, warning := range warnings {
+			changes[i] = warning
+		}
+		spec["changes"] = changes
+	}
+	// An update is applied on top of the stored object it was made against, or not at all
+	if req.Operation == admissionv1.Update && len(req.OldObject.Raw) > 0 {
+		old := &unstructured.Unstructured{}
+		if err := old.UnmarshalJSON(req.OldObject.Raw); err != nil {
+			return nil, fmt.Errorf("could not decode raw old object: %v", err)
+		}
+		spec["baseResourceVersion"] = old.GetResourceVersion()
+	}
+
+	proposal := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	proposal.SetAPIVersion(proposalGVR.GroupVersion().String())
+	proposal.SetKind(proposalKind)
+	proposal.SetName(name)
+	proposal.SetLabels(map[string]string{originalObjectNameLabel: truncateLabelValue(cr.GetName())})
+	signature, err := signProposal(name, spec)
+	if err != nil {
+		return nil, err
+	}
+	proposal.SetAnnotations(map[string]string{proposalSignatureAnnotation: signature})
+	return proposal, nil
+}
+
+// truncateLabelValue shortens a value to the 63 characters a label value may have.
+func truncateLabelValue(value string) string {
+	if len(value) > 63 {
+		value = strings.TrimRight(value[:63], "-_.")
+	}
+	return value
+}
+
+// createProposal stores a proposal. A proposal that already exists is returned as it is. Dry runs are
+// checked by the API server without being persisted.
+func createProposal(ctx context.Context, proposal *unstructured.Unstructured, dryRun bool) (*unstructured.Unstructured, error) {
+	dynamicClient, err := kubeDynamicClient()
+	if err != nil {
+		return nil, err
+	}
+	proposals := dynamicClient.Resource(proposalGVR)
+
+	options := metav1.CreateOptions{}
+	if dryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+	created, err := proposals.Create(ctx, proposal, options)
+	if apierrors.IsAlreadyExists(err) {
+		log.Printf("Proposal %s already exists", proposal.GetName())
+		return proposals.Get(ctx, proposal.GetName(), metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s %s: %v", proposalKind, proposal.GetName(), err)
+	}
+	return created, nil
+}
+
+// proposalResponse proposes the correction for approval and denies the request, with the diff and the
+// command that approves it.
+func proposalResponse(req *admissionv1.AdmissionRequest, cr, adjusted *unstructured.Unstructured, patch []byte, correction *llmCorrection, validationErrors string, client openaiClientInterface, warnings []string) *admissionv1.AdmissionResponse {
+	proposal, err := newProposal(req, cr, patch, correction, validationErrors, client, warnings)
+	if err != nil {
+		return failureResponse(err, warnings)
+	}
+	created, err := createProposal(context.TODO(), proposal, isDryRun(req))
+	if err != nil {
+		log.Printf("Failed to propose correction: %v", err)
+		return failureResponse(err, warnings)
+	}
+	log.Printf("Proposed correction of %s %s in %s %s", cr.GetKind(), cr.GetName(), proposalKind, created.GetName())
+
+	originalYAML, err := manifestYAML(cr)
+	if err != nil {
+		return failureResponse(err, warnings)
+	}
+	adjustedYAML, err := manifestYAML(adjusted)
+	if err != nil {
+		return failureResponse(err, warnings)
+	}
+	expiresAt, _, _ := unstructured.NestedString(created.Object, "spec", "expiresAt")
+	message := fmt.Sprintf("%s %s is invalid. A correction is waiting for approval in %s %s until %s. Approve it with:\n\n"+
+		"  kubectl patch %s %s --type merge -p '{\"spec\":{\"approved\":true}}'\n\n"+
+		"Changes (- submitted, + corrected):\n\n%s",
+		cr.GetKind(), cr.GetName(), proposalKind, created.GetName(), expiresAt,
+		strings.TrimSuffix(proposalGVR.Resource, "s"), created.GetName(), LineDiff(originalYAML, adjustedYAML))
+
+	return &admissionv1.AdmissionResponse{
+		Allowed:  false,
+		Warnings: limitWarnings(warnings),
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: message,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
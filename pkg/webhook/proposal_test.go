@@ -0,0 +1,361 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var clusterExtensionGVR = schema.GroupVersionResource{Group: "olm.operatorframework.io", Version: "v1alpha1", Resource: "clusterextensions"}
+
+// withFakeDynamicClient gives the test a fake cluster with proposals and ClusterExtensions, holding objects.
+func withFakeDynamicClient(t *testing.T, objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	t.Helper()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		proposalGVR:         "ClusterExtensionCorrectionList",
+		clusterExtensionGVR: "ClusterExtensionList",
+	}, objects...)
+	original := kubeDynamicClient
+	t.Cleanup(func() { kubeDynamicClient = original })
+	kubeDynamicClient = func() (dynamic.Interface, error) { return client, nil }
+	return client
+}
+
+// withNow fixes the time seen by the webhook.
+func withNow(t *testing.T, at time.Time) {
+	t.Helper()
+	originalNow := now
+	t.Cleanup(func() { now = originalNow })
+	now = func() time.Time { return at }
+}
+
+// approveReviewFor returns a CREATE admission review for the CR, with its resource set.
+func approveReviewFor(t *testing.T, crYAML string) *admissionv1.AdmissionReview {
+	t.Helper()
+	review := admissionReviewFor(t, crYAML)
+	review.Request.Resource = metav1.GroupVersionResource(clusterExtensionGVR)
+	review.Request.UserInfo.Username = "alice"
+	return review
+}
+
+func listProposals(t *testing.T, client dynamic.Interface) []unstructured.Unstructured {
+	t.Helper()
+	list, err := client.Resource(proposalGVR).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list proposals: %v", err)
+	}
+	return list.Items
+}
+
+// approve approves a proposal, as a person would after it was created.
+func approve(t *testing.T, proposal *unstructured.Unstructured) {
+	t.Helper()
+	if err := unstructured.SetNestedField(proposal.Object, true, "spec", "approved"); err != nil {
+		t.Fatal(err)
+	}
+	proposal.SetGeneration(proposal.GetGeneration() + 2)
+}
+
+// sign signs a proposal the way the webhook does.
+func sign(t *testing.T, proposal *unstructured.Unstructured) {
+	t.Helper()
+	signature, err := signProposal(proposal.GetName(), proposal.Object["spec"].(map[string]interface{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposal.SetAnnotations(map[string]string{proposalSignatureAnnotation: signature})
+}
+
+// proposalFailure reconciles a proposal and returns the message it failed with.
+func proposalFailure(t *testing.T, client dynamic.Interface, proposal *unstructured.Unstructured) string {
+	t.Helper()
+	(&proposalController{client: client}).reconcile(context.TODO(), proposal)
+	stored, err := client.Resource(proposalGVR).Get(context.TODO(), proposal.GetName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get proposal: %v", err)
+	}
+	if phase, _, _ := unstructured.NestedString(stored.Object, "status", "phase"); phase != proposalFailed {
+		return ""
+	}
+	message, _, _ := unstructured.NestedString(stored.Object, "status", "message")
+	return message
+}
+
+func TestMutate_ApproveMode(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withEmptyCorrectionCache(t)
+	withNow(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	dynamicClient := withFakeDynamicClient(t)
+	t.Setenv("CORRECTION_MODE", "approve")
+	t.Setenv("CORRECTION_PROPOSAL_TTL", "2h")
+
+	client := &promptCapturingClient{response: correctedAnnotatedCRYAML}
+	response := mutate(approveReviewFor(t, annotatedCRYAML), client)
+	if response.Allowed || response.Patch != nil {
+		t.Fatalf("Expected the object to be denied without a patch, got %+v", response)
+	}
+	if response.Result.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422, got %d", response.Result.Code)
+	}
+
+	proposals := listProposals(t, dynamicClient)
+	if len(proposals) != 1 {
+		t.Fatalf("Expected one proposal, got %d", len(proposals))
+	}
+	proposal := proposals[0]
+	if !strings.HasPrefix(proposal.GetName(), "example-") || !strings.Contains(response.Result.Message, proposal.GetName()) {
+		t.Errorf("Expected the message to name proposal %s, got:\n%s", proposal.GetName(), response.Result.Message)
+	}
+	for field, want := range map[string]string{
+		"operation": "CREATE",
+		"requester": "alice",
+		"expiresAt": "2026-01-02T05:04:05Z",
+	} {
+		if got, _, _ := unstructured.NestedString(proposal.Object, "spec", field); got != want {
+			t.Errorf("Expected spec.%s to be %q, got %q", field, want, got)
+		}
+	}
+	if target, _, _ := unstructured.NestedString(proposal.Object, "spec", "target", "resource"); target != "clusterextensions" {
+		t.Errorf("Unexpected target resource %q", target)
+	}
+	if patch, _, _ := unstructured.NestedString(proposal.Object, "spec", "patch"); !strings.Contains(patch, "example-package") {
+		t.Errorf("Expected the correction in the patch, got %s", patch)
+	}
+
+	// Retrying the same request finds the same proposal
+	if response := mutate(approveReviewFor(t, annotatedCRYAML), client); !strings.Contains(response.Result.Message, proposal.GetName()) {
+		t.Errorf("Expected the retry to name proposal %s, got:\n%s", proposal.GetName(), response.Result.Message)
+	}
+	if len(listProposals(t, dynamicClient)) != 1 {
+		t.Errorf("Expected the retry to reuse the proposal")
+	}
+}
+
+func TestProposalController_AppliesApprovedCreate(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withEmptyCorrectionCache(t)
+	withNow(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	dynamicClient := withFakeDynamicClient(t)
+	clientset := fake.NewSimpleClientset()
+	withKubeClientset(t, clientset)
+	t.Setenv("CORRECTION_MODE", "approve")
+	t.Setenv("ORIGINAL_STORE", "configmap")
+	mutate(approveReviewFor(t, annotatedCRYAML), &promptCapturingClient{response: correctedAnnotatedCRYAML})
+	proposal := listProposals(t, dynamicClient)[0]
+
+	// The original is only saved once the proposal is applied
+	configMaps, err := clientset.CoreV1().ConfigMaps("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil || len(configMaps.Items) != 0 {
+		t.Fatalf("Did not expect the original to be saved before approval, got %v, %v", configMaps, err)
+	}
+
+	// A proposal that isn't approved is left alone
+	controller := &proposalController{client: dynamicClient}
+	controller.reconcile(context.TODO(), &proposal)
+	if _, err := dynamicClient.Resource(clusterExtensionGVR).Get(context.TODO(), "example", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("Did not expect the object to be created before approval, got %v", err)
+	}
+
+	approve(t, &proposal)
+	controller.reconcile(context.TODO(), &proposal)
+	created, err := dynamicClient.Resource(clusterExtensionGVR).Get(context.TODO(), "example", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the corrected object to be created: %v", err)
+	}
+	if packageName, _, _ := unstructured.NestedString(created.Object, "spec", "source", "catalog", "packageName"); packageName != "example-package" {
+		t.Errorf("Expected the corrected package name, got %q", packageName)
+	}
+	if created.GetLabels()[correctedLabel] != "true" {
+		t.Errorf("Expected the provenance label on the applied object, got %v", created.GetLabels())
+	}
+	configMaps, err = clientset.CoreV1().ConfigMaps("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil || len(configMaps.Items) != 1 {
+		t.Fatalf("Expected the original to be saved, got %v, %v", configMaps, err)
+	}
+	if ref := created.GetAnnotations()[originalConfigMapAnnotation]; ref != configMaps.Items[0].Namespace+"/"+configMaps.Items[0].Name {
+		t.Errorf("Expected the applied object to point to its original, got %q", ref)
+	}
+
+	stored, err := dynamicClient.Resource(proposalGVR).Get(context.TODO(), proposal.GetName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get proposal: %v", err)
+	}
+	if phase, _, _ := unstructured.NestedString(stored.Object, "status", "phase"); phase != proposalApplied {
+		t.Errorf("Expected the proposal to be %s, got %q", proposalApplied, phase)
+	}
+}
+
+func TestProposalController_RefusesStaleUpdate(t *testing.T) {
+	current := parseCR(t, validCRYAML)
+	current.SetResourceVersion("8")
+	dynamicClient := withFakeDynamicClient(t, current)
+
+	proposal := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": proposalGVR.GroupVersion().String(),
+		"kind":       proposalKind,
+		"metadata":   map[string]interface{}{"name": "stale"},
+		"spec": map[string]interface{}{
+			"target": map[string]interface{}{
+				"group":    clusterExtensionGVR.Group,
+				"version":  clusterExtensionGVR.Version,
+				"resource": clusterExtensionGVR.Resource,
+				"name":     current.GetName(),
+			},
+			"operation":           "UPDATE",
+			"baseResourceVersion": "7",
+			"original":            string(mustJSON(t, validCRYAML)),
+			"patch":               "[]",
+			"approved":            true,
+			"expiresAt":           now().Add(time.Hour).UTC().Format(time.RFC3339),
+		},
+	}}
+	sign(t, proposal)
+	proposal.SetGeneration(2)
+	if _, err := dynamicClient.Resource(proposalGVR).Create(context.TODO(), proposal, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	(&proposalController{client: dynamicClient}).reconcile(context.TODO(), proposal)
+	stored, err := dynamicClient.Resource(proposalGVR).Get(context.TODO(), "stale", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get proposal: %v", err)
+	}
+	phase, _, _ := unstructured.NestedString(stored.Object, "status", "phase")
+	message, _, _ := unstructured.NestedString(stored.Object, "status", "message")
+	if phase != proposalFailed || !strings.Contains(message, "changed since the correction was proposed") {
+		t.Errorf("Expected the stale update to fail, got %s: %s", phase, message)
+	}
+}
+
+func TestProposalController_DeletesExpired(t *testing.T) {
+	proposal := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": proposalGVR.GroupVersion().String(),
+		"kind":       proposalKind,
+		"metadata":   map[string]interface{}{"name": "expired"},
+		"spec": map[string]interface{}{
+			"approved":  true,
+			"expiresAt": "2026-01-02T03:04:05Z",
+		},
+	}}
+	dynamicClient := withFakeDynamicClient(t, proposal)
+	withNow(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	(&proposalController{client: dynamicClient}).reconcile(context.TODO(), proposal)
+	if _, err := dynamicClient.Resource(proposalGVR).Get(context.TODO(), "expired", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the expired proposal to be deleted, got %v", err)
+	}
+}
+
+func TestProposalController_OnlyAppliesWebhookProposals(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withEmptyCorrectionCache(t)
+	withNow(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	dynamicClient := withFakeDynamicClient(t)
+	t.Setenv("CORRECTION_MODE", "approve")
+	mutate(approveReviewFor(t, annotatedCRYAML), &promptCapturingClient{response: correctedAnnotatedCRYAML})
+	proposal := listProposals(t, dynamicClient)[0]
+
+	for name, test := range map[string]struct {
+		change func(*unstructured.Unstructured)
+		want   string
+	}{
+		"unsigned": {func(p *unstructured.Unstructured) { p.SetAnnotations(nil) }, "not signed"},
+		"tampered": {func(p *unstructured.Unstructured) {
+			_ = unstructured.SetNestedField(p.Object, `[{"op":"add","path":"/spec/x","value":1}]`, "spec", "patch")
+		}, "signature is invalid"},
+		"created approved": {func(p *unstructured.Unstructured) { p.SetGeneration(1) }, "approved when it was created"},
+		"not a target": {func(p *unstructured.Unstructured) {
+			_ = unstructured.SetNestedField(p.Object, "configmaps", "spec", "target", "resource")
+			_ = unstructured.SetNestedField(p.Object, "", "spec", "target", "group")
+			sign(t, p)
+		}, "is not a correction target"},
+	} {
+		forged := proposal.DeepCopy()
+		approve(t, forged)
+		test.change(forged)
+		if message := proposalFailure(t, dynamicClient, forged); !strings.Contains(message, test.want) {
+			t.Errorf("%s: expected the proposal to fail with %q, got %q", name, test.want, message)
+		}
+	}
+	if _, err := dynamicClient.Resource(clusterExtensionGVR).Get(context.TODO(), "example", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Did not expect any proposal to be applied, got %v", err)
+	}
+}
+
+func TestProposalController_AppliesGenerateName(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withEmptyCorrectionCache(t)
+	withNow(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	dynamicClient := withFakeDynamicClient(t)
+	t.Setenv("CORRECTION_MODE", "approve")
+	generated := func(crYAML string) string {
+		return strings.Replace(crYAML, "  name: example\n", "  generateName: example-\n", 1)
+	}
+	mutate(approveReviewFor(t, generated(annotatedCRYAML)), &promptCapturingClient{response: generated(correctedAnnotatedCRYAML)})
+
+	proposals := listProposals(t, dynamicClient)
+	if len(proposals) != 1 {
+		t.Fatalf("Expected one proposal, got %d", len(proposals))
+	}
+	proposal := proposals[0]
+	if !strings.HasPrefix(proposal.GetName(), "example-") || strings.HasPrefix(proposal.GetName(), "example--") {
+		t.Errorf("Expected the proposal to be named after the generateName, got %q", proposal.GetName())
+	}
+	approve(t, &proposal)
+	if message := proposalFailure(t, dynamicClient, &proposal); message != "" {
+		t.Fatalf("Expected the proposal to be applied, got %s", message)
+	}
+	created, err := dynamicClient.Resource(clusterExtensionGVR).List(context.TODO(), metav1.ListOptions{})
+	if err != nil || len(created.Items) != 1 || created.Items[0].GetGenerateName() != "example-" {
+		t.Errorf("Expected the object to be created with its generateName, got %v, %v", created, err)
+	}
+}
+
+func TestProposalController_AppliesOtherTargets(t *testing.T) {
+	withNow(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	withCorrectionTargets(t, `
+targets:
+- group: example.com
+  kind: Widget
+  resource: widgets
+`)
+	dynamicClient := withFakeDynamicClient(t)
+	widgetGVR := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	req := &admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Namespace: "default",
+		Resource:  metav1.GroupVersionResource(widgetGVR),
+	}
+	patch := []byte(`[{"op":"replace","path":"/spec/size","value":"large"}]`)
+	proposal, err := newProposal(req, parseCR(t, widgetYAML), patch, nil, "spec.size: Unsupported value", nil, nil)
+	if err != nil {
+		t.Fatalf("newProposal failed: %v", err)
+	}
+	if proposal, err = dynamicClient.Resource(proposalGVR).Create(context.TODO(), proposal, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create proposal: %v", err)
+	}
+
+	approve(t, proposal)
+	if message := proposalFailure(t, dynamicClient, proposal); message != "" {
+		t.Fatalf("Expected the proposal to be applied, got %s", message)
+	}
+	created, err := dynamicClient.Resource(widgetGVR).Namespace("default").Get(context.TODO(), "example", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the corrected Widget to be created: %v", err)
+	}
+	if size, _, _ := unstructured.NestedString(created.Object, "spec", "size"); size != "large" {
+		t.Errorf("Expected the corrected size, got %q", size)
+	}
+}
@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// provenancePrefix is the prefix of the label and annotations recording that an object was corrected.
+const provenancePrefix = "clusterextensionhelper.operatorframework.io/"
+
+// Provenance label and annotations. The label lets corrected objects be found with a label selector:
+//
+//	kubectl get clusterextensions -l clusterextensionhelper.operatorframework.io/corrected=true
+const (
+	correctedLabel               = provenancePrefix + "corrected"
+	providerAnnotation           = provenancePrefix + "provider"
+	modelAnnotation              = provenancePrefix + "model"
+	promptTemplateHashAnnotation = provenancePrefix + "prompt-template-hash"
+	correctedAtAnnotation        = provenancePrefix + "corrected-at"
+	originalSpecHashAnnotation   = provenancePrefix + "original-spec-hash"
+	changesAnnotation            = provenancePrefix + "changes"
+)
+
+// maxChangesSummaryLength bounds the changes annotation, which is meant to be read at a glance.
+const maxChangesSummaryLength = 256
+
+// now returns the current time. Tests replace it.
+var now = time.Now
+
+// operationVerbs are the words used for patch operations in the changes summary. Adding or replacing a
+// missing or null value is "set"; replacing any other value is "changed".
+var operationVerbs = map[string]string{
+	"add":     "set",
+	"replace": "set",
+	"remove":  "removed",
+	"move":    "moved",
+	"copy":    "copied",
+}
+
+// addProvenance labels and annotates the corrected object with who corrected it, when, from which
+// original spec, or original corrected fields, and how. operations is the patch from the original to the
+// corrected object.
+func addProvenance(adjusted, original *unstructured.Unstructured, client openaiClientInterface, operations []patchOperation) error {
+	originalSpecHash, err := hashCorrected(original, correctedFieldsFor(original))
+	if err != nil {
+		return err
+	}
+	provider, model := describeClient(client)
+
+	labels := adjusted.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[correctedLabel] = "true"
+	adjusted.SetLabels(labels)
+
+	annotations := adjusted.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[providerAnnotation] = provider
+	annotations[modelAnnotation] = model
+	annotations[promptTemplateHashAnnotation] = promptTemplateHash()
+	annotations[correctedAtAnnotation] = now().UTC().Format(time.RFC3339)
+	annotations[originalSpecHashAnnotation] = originalSpecHash
+	annotations[changesAnnotation] = summarizeChanges(original.Object, operations)
+	adjusted.SetAnnotations(annotations)
+	return nil
+}
+
+// promptTemplateHash identifies the version of the prompt template a correction was made with.
+func promptTemplateHash() string {
+	sum := sha256.Sum256([]byte(promptTemplate))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// hashJSON hashes the JSON encoding of a value. encoding/json sorts map keys, so equal values hash equally.
+func hashJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// summarizeChanges lists the changed paths, for example "set spec.source.catalog.packageName; changed
+// spec.install.namespace", shortened to maxChangesSummaryLength.
+func summarizeChanges(original map[string]interface{}, operations []patchOperation) string {
+	parts := make([]string, 0, len(operations))
+	for _, operation := range operations {
+		path := pointerPath(original, operation.Path)
+		verb, ok := operationVerbs[operation.Op]
+		if !ok {
+			verb = operation.Op
+		}
+		if old, existed := getPath(original, path); existed && old != nil && operation.Op == "replace" {
+			verb = "changed"
+		}
+		parts = append(parts, verb+" "+path.String())
+	}
+	return truncateRunes(strings.Join(parts, "; "), maxChangesSummaryLength)
+}
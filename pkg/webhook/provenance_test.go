@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestMutate_AddsProvenance(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	originalNow := now
+	t.Cleanup(func() { now = originalNow })
+	now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	client := &mockOpenAIClient{response: strings.Replace(annotatedCRYAML, "packageName:", "packageName: example-package", 1)}
+	admissionResponse := mutate(admissionReviewFor(t, annotatedCRYAML), client)
+	if !admissionResponse.Allowed {
+		t.Fatalf("Expected admission response to be allowed: %v", admissionResponse.Result)
+	}
+
+	crJSON := admissionReviewFor(t, annotatedCRYAML).Request.Object.Raw
+	patchedJSON, err := applyJSONPatch(crJSON, admissionResponse.Patch)
+	if err != nil {
+		t.Fatalf("Failed to apply patch: %v", err)
+	}
+	patched := &unstructured.Unstructured{}
+	if err := patched.UnmarshalJSON(patchedJSON); err != nil {
+		t.Fatalf("Failed to unmarshal patched CR: %v", err)
+	}
+
+	if patched.GetLabels()[correctedLabel] != "true" || patched.GetLabels()["team"] != "platform" {
+		t.Errorf("Unexpected labels %v", patched.GetLabels())
+	}
+	annotations := patched.GetAnnotations()
+	want := map[string]string{
+		providerAnnotation:           "unknown",
+		modelAnnotation:              "unknown",
+		promptTemplateHashAnnotation: promptTemplateHash(),
+		correctedAtAnnotation:        "2026-01-02T03:04:05Z",
+		changesAnnotation:            "set spec.source.catalog.packageName",
+		"owner":                      "platform-team",
+	}
+	for key, value := range want {
+		if annotations[key] != value {
+			t.Errorf("Expected annotation %s=%q, got %q", key, value, annotations[key])
+		}
+	}
+
+	originalSpecHash, err := hashJSON(parseCR(t, annotatedCRYAML).Object["spec"])
+	if err != nil {
+		t.Fatalf("hashJSON failed: %v", err)
+	}
+	if annotations[originalSpecHashAnnotation] != originalSpecHash {
+		t.Errorf("Unexpected original spec hash %q", annotations[originalSpecHashAnnotation])
+	}
+	for _, warning := range admissionResponse.Warnings {
+		if strings.Contains(warning, provenancePrefix) {
+			t.Errorf("Did not expect provenance in the warnings, got %q", warning)
+		}
+	}
+}
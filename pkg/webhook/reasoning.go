@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// webhookTimeout is the timeoutSeconds of the webhook configurations. Past it, the API server gives up on
+// the webhook and the failure policy of the configuration applies instead of FAILURE_POLICY.
+const webhookTimeout = 30 * time.Second
+
+// defaultLLMTimeout bounds a model call unless LLM_TIMEOUT is set. It leaves the rest of the webhook's time
+// to the other steps of a correction.
+const defaultLLMTimeout = 20 * time.Second
+
+// llmTimeout returns how long a model call may take, set by LLM_TIMEOUT as a Go duration like 15s. Values
+// that don't leave time to gather the cluster context within the webhook's timeout are ignored.
+func llmTimeout() time.Duration {
+	value := os.Getenv("LLM_TIMEOUT")
+	if value == "" {
+		return defaultLLMTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 || timeout >= webhookTimeout-clusterContextTimeout {
+		log.Printf("Invalid LLM_TIMEOUT %q, it must be positive and below %s; using %s", value, webhookTimeout-clusterContextTimeout, defaultLLMTimeout)
+		return defaultLLMTimeout
+	}
+	return timeout
+}
+
+// tokenUsage is the token count reported for one completion. ReasoningTokens are part of CompletionTokens
+// for models that think before answering; they are reported, and billed, separately by most providers.
+type tokenUsage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	ReasoningTokens  int `json:"reasoningTokens"`
+}
+
+// chatCompletion is a model's answer split into the answer itself and the reasoning that preceded it.
+type chatCompletion struct {
+	content   string
+	reasoning string
+	usage     tokenUsage
+}
+
+// detailedCompletionClient is implemented by clients that can return reasoning and token usage alongside
+// the answer.
+type detailedCompletionClient interface {
+	createDetailedChatCompletion(ctx context.Context, prompt string) (*chatCompletion, error)
+}
+
+// reasoningBlockPattern matches the thinking sections reasoning models put before their answer.
+var reasoningBlockPattern = regexp.MustCompile(`(?is)<(think|thinking|reasoning)>(.*?)</(?:think|thinking|reasoning)>`)
+
+// reasoningOpenPattern and reasoningClosePattern match the tags of a thinking section left open, for
+// example when the response was cut off, or whose opening tag was part of the prompt template.
+var (
+	reasoningOpenPattern  = regexp.MustCompile(`(?is)<(?:think|thinking|reasoning)>`)
+	reasoningClosePattern = regexp.MustCompile(`(?is)</(?:think|thinking|reasoning)>`)
+)
+
+// complete asks the client for a completion and separates the reasoning from the answer, whether the
+// server returned it in a separate field or inline between thinking tags. A call that takes longer than
+// llmTimeout is cancelled and fails as llm-unavailable.
+func complete(ctx context.Context, client openaiClientInterface, prompt string) (*chatCompletion, error) {
+	timeout := llmTimeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var completion *chatCompletion
+	var err error
+	if detailed, ok := client.(detailedCompletionClient); ok {
+		completion, err = detailed.createDetailedChatCompletion(ctx, prompt)
+	} else {
+		var content string
+		content, err = client.CreateChatCompletion(ctx, prompt)
+		completion = &chatCompletion{content: content}
+	}
+	if err != nil && (errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded)) {
+		return nil, classify(failureLLMUnavailable, fmt.Errorf("model did not answer within %s: %v", timeout, err))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	content, inline := splitReasoning(completion.content)
+	completion.content = content
+	completion.reasoning = strings.TrimSpace(strings.Join(append([]string{completion.reasoning}, inline...), "\n\n"))
+	return completion, nil
+}
+
+// splitReasoning removes thinking sections from a response and returns the remaining answer and the
+// text of each section. Text before an orphaned closing tag is reasoning; text after an unclosed opening
+// tag is reasoning too, since no answer follows it.
+func splitReasoning(response string) (string, []string) {
+	var reasoning []string
+	answer := reasoningBlockPattern.ReplaceAllStringFunc(response, func(block string) string {
+		reasoning = append(reasoning, strings.TrimSpace(reasoningBlockPattern.FindStringSubmatch(block)[2]))
+		return ""
+	})
+
+	if loc := reasoningClosePattern.FindStringIndex(answer); loc != nil {
+		reasoning = append(reasoning, strings.TrimSpace(answer[:loc[0]]))
+		answer = answer[loc[1]:]
+	}
+	if loc := reasoningOpenPattern.FindStringIndex(answer); loc != nil {
+		reasoning = append(reasoning, strings.TrimSpace(answer[loc[1]:]))
+		answer = answer[:loc[0]]
+	}
+	return strings.TrimSpace(answer), reasoning
+}
@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSplitReasoning(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  string
+		answer    string
+		reasoning []string
+	}{
+		{
+			name:      "think block",
+			response:  "<think>\nkind: Deployment\n</think>\nkind: ClusterExtension",
+			answer:    "kind: ClusterExtension",
+			reasoning: []string{"kind: Deployment"},
+		},
+		{
+			name:      "thinking block in mixed case",
+			response:  "<Thinking>first</Thinking>answer<reasoning>second</reasoning>",
+			answer:    "answer",
+			reasoning: []string{"first", "second"},
+		},
+		{
+			name:      "opening tag in the prompt template",
+			response:  "the CR lacks a package\n</think>\n\nkind: ClusterExtension",
+			answer:    "kind: ClusterExtension",
+			reasoning: []string{"the CR lacks a package"},
+		},
+		{
+			name:      "cut off while thinking",
+			response:  "<think>spec:\n  install:",
+			answer:    "",
+			reasoning: []string{"spec:\n  install:"},
+		},
+		{
+			name:     "no reasoning",
+			response: "kind: ClusterExtension",
+			answer:   "kind: ClusterExtension",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer, reasoning := splitReasoning(tt.response)
+			if answer != tt.answer {
+				t.Errorf("Unexpected answer %q", answer)
+			}
+			if strings.Join(reasoning, "|") != strings.Join(tt.reasoning, "|") {
+				t.Errorf("Unexpected reasoning %q", reasoning)
+			}
+		})
+	}
+}
+
+func TestAdjustCRWithLLM_IgnoresReasoningFragments(t *testing.T) {
+	cr := parseCR(t, unicodeCRYAML)
+	crd, err := mockGetCRD(cr)
+	if err != nil {
+		t.Fatalf("Failed to get CRD: %v", err)
+	}
+
+	// The YAML-like fragment in the reasoning comes first and would otherwise be mistaken for the answer
+	reasoning := "The user wants this:\n```yaml\napiVersion: olm.operatorframework.io/v1alpha1\nkind: ClusterExtension\nspec:\n  source:\n    catalog:\n      packageName: wrong-package\n```\n"
+	response := "<think>" + reasoning + "</think>\n" + strings.Replace(unicodeCRYAML, "packageName:", "packageName: example-package", 1)
+	correction, err := adjustCRWithLLM(cr, crd, &mockOpenAIClient{response: response}, nil)
+	if err != nil {
+		t.Fatalf("adjustCRWithLLM failed: %v", err)
+	}
+	packageName, _, _ := unstructured.NestedString(correction.adjusted.Object, "spec", "source", "catalog", "packageName")
+	if packageName != "example-package" {
+		t.Errorf("Unexpected packageName %q", packageName)
+	}
+	if !strings.Contains(correction.reasoning, "wrong-package") {
+		t.Errorf("Expected the reasoning to be kept, got %q", correction.reasoning)
+	}
+	if correction.usage.ReasoningTokens == 0 {
+		t.Errorf("Expected reasoning tokens to be estimated")
+	}
+}
+
+func TestLocalLLMClient_ReasoningContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+  "choices": [{"message": {"role": "assistant", "content": "kind: ClusterExtension", "reasoning_content": "Check the package first."}}],
+  "usage": {"prompt_tokens": 120, "completion_tokens": 40, "completion_tokens_details": {"reasoning_tokens": 30}}
+}`))
+	}))
+	defer server.Close()
+
+	client := &localLLMClient{url: server.URL, model: "deepseek-r1"}
+	completion, err := complete(context.Background(), client, "prompt")
+	if err != nil {
+		t.Fatalf("complete failed: %v", err)
+	}
+	if completion.content != "kind: ClusterExtension" || completion.reasoning != "Check the package first." {
+		t.Errorf("Unexpected completion %+v", completion)
+	}
+	if completion.usage != (tokenUsage{PromptTokens: 120, CompletionTokens: 40, ReasoningTokens: 30}) {
+		t.Errorf("Unexpected usage %+v", completion.usage)
+	}
+}
+
+func TestAuditCorrection_WritesReasoning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	t.Setenv("AUDIT_LOG_PATH", path)
+
+	cr := parseCR(t, unicodeCRYAML)
+	req := &admissionv1.AdmissionRequest{UID: "1234"}
+	auditCorrection(req, cr, &localLLMClient{model: "qwq"}, &llmCorrection{reasoning: "Check the package first."}, nil)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	for _, want := range []string{`"uid":"1234"`, `"model":"qwq"`, `"reasoning":"Check the package first."`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected %s in audit record, got %s", want, data)
+		}
+	}
+}
+
+func TestComplete_Timeout(t *testing.T) {
+	t.Setenv("LLM_TIMEOUT", "50ms")
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	_, err := complete(context.Background(), &localLLMClient{url: server.URL, model: "slow"}, "prompt")
+	if err == nil || classOf(err) != failureLLMUnavailable || !strings.Contains(err.Error(), "within 50ms") {
+		t.Errorf("Expected a slow model to be llm-unavailable, got %v", err)
+	}
+
+	t.Setenv("LLM_TIMEOUT", "45s")
+	if timeout := llmTimeout(); timeout != defaultLLMTimeout {
+		t.Errorf("Expected a timeout past the webhook's to be ignored, got %s", timeout)
+	}
+}
@@ -0,0 +1,175 @@
+package webhook
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+)
+
+// fencedBlockPattern matches Markdown code fences, with an optional language tag.
+var fencedBlockPattern = regexp.MustCompile("(?ms)^[ \t\uE000]*```[ \t]*([A-Za-z0-9_-]*)[^\n]*\n(.*?)^[ \t\uE000]*```")
+
+// documentSeparatorPattern matches YAML document separators and end markers on their own line.
+var documentSeparatorPattern = regexp.MustCompile(`(?m)^(---|\.\.\.)[ \t]*(#.*)?$`)
+
+// topLevelKeyPattern matches the first line of an unfenced CR: a top-level key of a Kubernetes object.
+var topLevelKeyPattern = regexp.MustCompile(`^\x{E000}*(apiVersion|kind|metadata|spec)\s*:`)
+
+// responseCandidate is a piece of the model's answer that may hold the corrected CR.
+type responseCandidate struct {
+	source string
+	text   string
+}
+
+// parseLLMResponse finds the corrected CR in the model's answer. It tries every fenced code block in
+// order, then the whole answer, then the text from the first top-level key onwards. Each candidate may be
+// YAML or JSON and may hold several documents; the first document whose apiVersion and kind match the
+// original CR wins. A document without apiVersion and kind, but with a corrected field like spec, is used
+// only if nothing matches.
+// The response may contain removedMarker characters left by markUnsafeRunes; they are stripped from every
+// document, and the paths of the values they were in are returned with the CR.
+func parseLLMResponse(response string, original *unstructured.Unstructured) (*unstructured.Unstructured, []fieldPath, error) {
+	var (
+		reasons           []string
+		fallback          *unstructured.Unstructured
+		fallbackSanitized []fieldPath
+		fields            = correctedFieldsFor(original)
+	)
+
+	for _, candidate := range responseCandidates(response) {
+		docs, problems := parseDocuments(candidate.text)
+		for _, problem := range problems {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", candidate.source, problem))
+		}
+		if len(docs) == 0 && len(problems) == 0 {
+			reasons = append(reasons, fmt.Sprintf("%s: no documents", candidate.source))
+		}
+		for i, doc := range docs {
+			sanitized := stripRemovedMarkers(doc)
+			obj := &unstructured.Unstructured{Object: doc}
+			switch {
+			case obj.GetAPIVersion() == original.GetAPIVersion() && obj.GetKind() == original.GetKind():
+				return obj, sanitized, nil
+			case obj.GetAPIVersion() == "" && obj.GetKind() == "" && slices.ContainsFunc(fields, func(field string) bool { return doc[field] != nil }):
+				if fallback == nil {
+					fallback, fallbackSanitized = obj, sanitized
+				}
+				reasons = append(reasons, fmt.Sprintf("%s document %d: no apiVersion or kind", candidate.source, i+1))
+			default:
+				reasons = append(reasons, fmt.Sprintf("%s document %d: got %s %s, want %s %s", candidate.source, i+1,
+					obj.GetAPIVersion(), obj.GetKind(), original.GetAPIVersion(), original.GetKind()))
+			}
+		}
+	}
+
+	if fallback != nil {
+		fallback.SetAPIVersion(original.GetAPIVersion())
+		fallback.SetKind(original.GetKind())
+		return fallback, fallbackSanitized, nil
+	}
+	if len(reasons) == 0 {
+		return nil, nil, fmt.Errorf("model response is empty")
+	}
+	return nil, nil, fmt.Errorf("model response has no usable %s: %s", original.GetKind(), strings.Join(reasons, "; "))
+}
+
+// responseCandidates lists the parts of a response that may hold the CR, in the order they are tried.
+func responseCandidates(response string) []responseCandidate {
+	var candidates []responseCandidate
+	for i, match := range fencedBlockPattern.FindAllStringSubmatch(response, -1) {
+		source := fmt.Sprintf("code block %d", i+1)
+		if match[1] != "" {
+			source = fmt.Sprintf("%s code block %d", match[1], i+1)
+		}
+		candidates = append(candidates, responseCandidate{source: source, text: match[2]})
+	}
+
+	if strings.TrimSpace(response) != "" {
+		candidates = append(candidates, responseCandidate{source: "whole response", text: response})
+	}
+
+	if text := fromFirstTopLevelKey(response); text != "" {
+		candidates = append(candidates, responseCandidate{source: "text after prose", text: text})
+	}
+	return candidates
+}
+
+// fromFirstTopLevelKey returns the response from the first line that starts a Kubernetes object up to a
+// closing fence or a trailing "Note:", for answers that wrap an unfenced CR in prose.
+func fromFirstTopLevelKey(response string) string {
+	var lines []string
+	collecting := false
+	for _, line := range strings.Split(response, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !collecting && topLevelKeyPattern.MatchString(line) {
+			collecting = true
+		}
+		if !collecting {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "Note:") {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseDocuments decodes a JSON value, a JSON array of objects or a stream of YAML documents into objects.
+// Documents that can't be decoded are reported as problems without discarding the others.
+func parseDocuments(text string) ([]map[string]interface{}, []string) {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "[") {
+		var list []interface{}
+		if err := utiljson.Unmarshal([]byte(trimmed), &list); err != nil {
+			return nil, []string{fmt.Sprintf("invalid JSON array: %v", err)}
+		}
+		var (
+			docs     []map[string]interface{}
+			problems []string
+		)
+		for i, item := range list {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("array item %d is not an object", i+1))
+				continue
+			}
+			docs = append(docs, obj)
+		}
+		return docs, problems
+	}
+	if strings.HasPrefix(trimmed, "{") {
+		var obj map[string]interface{}
+		if err := utiljson.Unmarshal([]byte(trimmed), &obj); err == nil {
+			return []map[string]interface{}{obj}, nil
+		}
+		// Fall through: flow-style YAML is a superset of JSON
+	}
+
+	var (
+		docs     []map[string]interface{}
+		problems []string
+	)
+	for i, part := range documentSeparatorPattern.Split(text, -1) {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		data, err := yaml.YAMLToJSON([]byte(part))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("document %d is not valid YAML: %v", i+1, err))
+			continue
+		}
+		var obj map[string]interface{}
+		if err := utiljson.Unmarshal(data, &obj); err != nil || obj == nil {
+			problems = append(problems, fmt.Sprintf("document %d is not an object", i+1))
+			continue
+		}
+		docs = append(docs, obj)
+	}
+	return docs, problems
+}
@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestParseLLMResponse(t *testing.T) {
+	original := &unstructured.Unstructured{}
+	original.SetAPIVersion("olm.operatorframework.io/v1alpha1")
+	original.SetKind("ClusterExtension")
+
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{
+			name: "plain YAML",
+			response: `apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+spec:
+  source:
+    catalog:
+      packageName: fixed`,
+		},
+		{
+			name:     "fenced YAML after prose",
+			response: "Here is the corrected CR:\n\n```yaml\n# corrected\nmetadata:\n  name: example\napiVersion: olm.operatorframework.io/v1alpha1\nkind: ClusterExtension\nspec:\n  source:\n    catalog:\n      packageName: fixed\n```\n\nNote: packageName was added.",
+		},
+		{
+			name:     "JSON reply",
+			response: "```json\n{\"apiVersion\": \"olm.operatorframework.io/v1alpha1\", \"kind\": \"ClusterExtension\", \"spec\": {\"source\": {\"catalog\": {\"packageName\": \"fixed\"}}}}\n```",
+		},
+		{
+			name: "multiple documents",
+			response: `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: installer
+---
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+spec:
+  source:
+    catalog:
+      packageName: fixed
+`,
+		},
+		{
+			name:     "unfenced YAML after prose",
+			response: "Sure! The fixed resource is below.\nmetadata:\n  name: example\napiVersion: olm.operatorframework.io/v1alpha1\nkind: ClusterExtension\nspec:\n  source:\n    catalog:\n      packageName: fixed\nNote: I added the package.",
+		},
+		{
+			name:     "missing apiVersion and kind",
+			response: "```yaml\nspec:\n  source:\n    catalog:\n      packageName: fixed\n```",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr, _, err := parseLLMResponse(tt.response, original)
+			if err != nil {
+				t.Fatalf("parseLLMResponse failed: %v", err)
+			}
+			if cr.GetKind() != "ClusterExtension" {
+				t.Errorf("Unexpected kind %q", cr.GetKind())
+			}
+			packageName, _, _ := unstructured.NestedString(cr.Object, "spec", "source", "catalog", "packageName")
+			if packageName != "fixed" {
+				t.Errorf("Unexpected packageName %q", packageName)
+			}
+		})
+	}
+}
+
+func TestParseLLMResponse_Rejections(t *testing.T) {
+	original := &unstructured.Unstructured{}
+	original.SetAPIVersion("olm.operatorframework.io/v1alpha1")
+	original.SetKind("ClusterExtension")
+
+	_, _, err := parseLLMResponse("I'm sorry, I can't help with that.", original)
+	if err == nil {
+		t.Fatalf("Expected prose to be rejected")
+	}
+
+	_, _, err = parseLLMResponse("apiVersion: apps/v1\nkind: Deployment\nspec: {}\n", original)
+	if err == nil || !strings.Contains(err.Error(), "got apps/v1 Deployment") {
+		t.Fatalf("Expected a GVK mismatch to be explained, got %v", err)
+	}
+
+	if _, _, err := parseLLMResponse("", original); err == nil {
+		t.Fatalf("Expected an empty response to be rejected")
+	}
+}
@@ -0,0 +1,139 @@
+package webhook
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// removedMarker stands in for every removed character between sanitizing the response text and parsing it,
+// so the values that contained one can be found afterwards. It is a private-use character, which YAML accepts.
+const removedMarker = '\uE000'
+
+// zeroWidthRunes are invisible characters that can hide differences between values.
+var zeroWidthRunes = map[rune]string{
+	'\u200B': "ZERO WIDTH SPACE",
+	'\u200C': "ZERO WIDTH NON-JOINER",
+	'\u200D': "ZERO WIDTH JOINER",
+	'\u2060': "WORD JOINER",
+	'\u180E': "MONGOLIAN VOWEL SEPARATOR",
+	'\uFEFF': "BYTE ORDER MARK",
+}
+
+// removedRune records one character removed from the model's response.
+type removedRune struct {
+	line, column int
+	description  string
+}
+
+func (r removedRune) String() string {
+	return fmt.Sprintf("%d:%d %s", r.line, r.column, r.description)
+}
+
+// markUnsafeRunes replaces control characters (other than tab, newline and carriage return), zero-width
+// characters, byte order marks and invalid UTF-8 with removedMarker. All other valid UTF-8 is kept.
+// It returns the marked text and where each character was.
+func markUnsafeRunes(text string) (string, []removedRune) {
+	var (
+		b       strings.Builder
+		removed []removedRune
+	)
+	line, column := 1, 0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		column++
+
+		description := ""
+		switch {
+		case r == utf8.RuneError && size == 1:
+			description = fmt.Sprintf("invalid UTF-8 byte 0x%02X", text[i-1])
+		case r == '\n':
+			line, column = line+1, 0
+		case r == '\t' || r == '\r':
+		case unicode.Is(unicode.Cc, r):
+			description = fmt.Sprintf("control character U+%04X", r)
+		case r == removedMarker:
+			description = fmt.Sprintf("private-use character U+%04X", r)
+		default:
+			if name, ok := zeroWidthRunes[r]; ok {
+				description = fmt.Sprintf("U+%04X %s", r, name)
+			}
+		}
+
+		if description == "" {
+			b.WriteRune(r)
+			continue
+		}
+		removed = append(removed, removedRune{line: line, column: column, description: description})
+		b.WriteRune(removedMarker)
+	}
+	return b.String(), removed
+}
+
+// stripRemovedMarkers deletes removedMarker from every key and string value of obj and returns the paths
+// that changed, sorted.
+func stripRemovedMarkers(obj map[string]interface{}) []fieldPath {
+	var changed []fieldPath
+	stripMarkersFrom(nil, obj, &changed)
+	sort.Slice(changed, func(i, j int) bool { return changed[i].String() < changed[j].String() })
+	return changed
+}
+
+func stripMarkersFrom(path fieldPath, value interface{}, changed *[]fieldPath) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		for _, key := range keys {
+			child := v[key]
+			cleanKey := strings.ReplaceAll(key, string(removedMarker), "")
+			if cleanKey != key {
+				delete(v, key)
+				*changed = append(*changed, path.child(cleanKey))
+			}
+			v[cleanKey] = stripMarkersFrom(path.child(cleanKey), child, changed)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = stripMarkersFrom(path.child(i), child, changed)
+		}
+		return v
+	case string:
+		clean := strings.ReplaceAll(v, string(removedMarker), "")
+		if clean != v {
+			*changed = append(*changed, path)
+		}
+		return clean
+	default:
+		return value
+	}
+}
+
+// checkSanitizedPaths returns an error if a value changed by sanitization would end up in the patch, that
+// is if it differs from the original CR. Sanitized values equal to the original are harmless.
+func checkSanitizedPaths(original, adjusted *unstructured.Unstructured, changed []fieldPath) error {
+	var problems []string
+	for _, path := range changed {
+		after, inAdjusted := getPath(adjusted.Object, path)
+		if !inAdjusted {
+			continue
+		}
+		if before, ok := getPath(original.Object, path); ok && reflect.DeepEqual(before, after) {
+			continue
+		}
+		problems = append(problems, path.String())
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("sanitizing the model response changed values that would be patched: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const unicodeCRYAML = `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: example
+  annotations:
+    description: "Opérateur de démonstration ✓"
+spec:
+  install:
+    namespace: example-namespace
+    serviceAccount:
+      name: example-sa
+  source:
+    sourceType: Catalog
+    catalog:
+      packageName:
+`
+
+func TestMarkUnsafeRunes(t *testing.T) {
+	marked, removed := markUnsafeRunes("name: café\u200B\nnote: \x07ok ✓")
+	if strings.ContainsRune(marked, '\u200B') || strings.ContainsRune(marked, '\x07') {
+		t.Errorf("Expected unsafe characters to be replaced, got %q", marked)
+	}
+	if !strings.Contains(marked, "café") || !strings.Contains(marked, "✓") {
+		t.Errorf("Expected valid non-ASCII characters to be kept, got %q", marked)
+	}
+	if len(removed) != 2 {
+		t.Fatalf("Expected two removed characters, got %v", removed)
+	}
+	if got := removed[0].String(); got != "1:11 U+200B ZERO WIDTH SPACE" {
+		t.Errorf("Unexpected report %q", got)
+	}
+	if got := removed[1].String(); got != "2:7 control character U+0007" {
+		t.Errorf("Unexpected report %q", got)
+	}
+}
+
+func TestAdjustCRWithLLM_KeepsNonASCIIValues(t *testing.T) {
+	cr := parseCR(t, unicodeCRYAML)
+	crd, err := mockGetCRD(cr)
+	if err != nil {
+		t.Fatalf("Failed to get CRD: %v", err)
+	}
+
+	// A BOM before the document and a zero-width space in an unchanged value are harmless
+	response := "\uFEFF" + strings.Replace(unicodeCRYAML, "packageName:", "packageName: example-package", 1)
+	response = strings.Replace(response, "example-sa", "example\u200B-sa", 1)
+	adjustedCR, err := AdjustCRWithLLM(cr, crd, &mockOpenAIClient{response: response})
+	if err != nil {
+		t.Fatalf("AdjustCRWithLLM failed: %v", err)
+	}
+	description, _, _ := unstructured.NestedString(adjustedCR.Object, "metadata", "annotations", "description")
+	if description != "Opérateur de démonstration ✓" {
+		t.Errorf("Expected the non-ASCII annotation to survive, got %q", description)
+	}
+	name, _, _ := unstructured.NestedString(adjustedCR.Object, "spec", "install", "serviceAccount", "name")
+	if name != "example-sa" {
+		t.Errorf("Expected the zero-width space to be removed, got %q", name)
+	}
+}
+
+func TestAdjustCRWithLLM_RejectsSanitizedPatchValues(t *testing.T) {
+	cr := parseCR(t, unicodeCRYAML)
+	crd, err := mockGetCRD(cr)
+	if err != nil {
+		t.Fatalf("Failed to get CRD: %v", err)
+	}
+
+	response := strings.Replace(unicodeCRYAML, "packageName:", "packageName: example\u200B-package", 1)
+	_, err = AdjustCRWithLLM(cr, crd, &mockOpenAIClient{response: response})
+	if err == nil || !strings.Contains(err.Error(), "spec.source.catalog.packageName") {
+		t.Fatalf("Expected the sanitized packageName to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	celconfig "k8s.io/apiserver/pkg/apis/cel"
+)
+
+// versionSchema returns the OpenAPI schema of a CRD version, or nil if the CRD doesn't serve it.
+func versionSchema(crd *apiextensionsv1.CustomResourceDefinition, version string) *apiextensionsv1.JSONSchemaProps {
+	for _, v := range crd.Spec.Versions {
+		if v.Name == version && v.Schema != nil {
+			return v.Schema.OpenAPIV3Schema
+		}
+	}
+	return nil
+}
+
+// validateAgainstSchema validates obj the way the API server would: against the OpenAPI schema of its
+// version in the CRD, then against the schema's x-kubernetes-validations CEL rules. oldObj is the stored
+// object for updates and nil for creates; transition rules are only evaluated when it is set.
+func validateAgainstSchema(ctx context.Context, obj, oldObj *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition) (field.ErrorList, error) {
+	schema := versionSchema(crd, obj.GroupVersionKind().Version)
+	if schema == nil {
+		return nil, fmt.Errorf("CRD %s has no schema for version %s", crd.Name, obj.GroupVersionKind().Version)
+	}
+	internal := &apiextensions.JSONSchemaProps{}
+	if err := apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(schema, internal, nil); err != nil {
+		return nil, fmt.Errorf("failed to convert schema: %v", err)
+	}
+
+	validator, _, err := validation.NewSchemaValidator(internal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build schema validator: %v", err)
+	}
+	errs := validation.ValidateCustomResource(nil, obj.UnstructuredContent(), validator)
+	// The validator walks properties in map order; sort its problems so they are reported the same way every time
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+
+	structural, err := structuralschema.NewStructural(internal)
+	if err != nil {
+		log.Printf("Skipping CEL validation, the schema of %s is not structural: %v", crd.Name, err)
+		return errs, nil
+	}
+	if celValidator := cel.NewValidator(structural, true, celconfig.PerCallLimit); celValidator != nil {
+		var old interface{}
+		if oldObj != nil {
+			old = oldObj.Object
+		}
+		celErrs, _ := celValidator.Validate(ctx, nil, structural, obj.Object, old, celconfig.RuntimeCELCostBudget)
+		errs = append(errs, celErrs...)
+	}
+	return errs, nil
+}
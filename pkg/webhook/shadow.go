@@ -0,0 +1,222 @@
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// defaultShadowConcurrency is how many shadow corrections run at once unless SHADOW_MAX_CONCURRENT is set.
+const defaultShadowConcurrency = 4
+
+// defaultReportFields is how many of the most corrected fields the report lists unless ?top= is set.
+const defaultReportFields = 10
+
+// shadowRecord is written for every correction run in shadow mode.
+type shadowRecord struct {
+	Time             time.Time       `json:"time"`
+	UID              string          `json:"uid,omitempty"`
+	Operation        string          `json:"operation"`
+	Kind             string          `json:"kind"`
+	Namespace        string          `json:"namespace,omitempty"`
+	Name             string          `json:"name"`
+	User             string          `json:"user,omitempty"`
+	ValidationErrors string          `json:"validationErrors"`
+	Provider         string          `json:"provider"`
+	Model            string          `json:"model"`
+	Usage            tokenUsage      `json:"usage"`
+	WouldApply       bool            `json:"wouldApply"`
+	FailureClass     failureClass    `json:"failureClass,omitempty"`
+	Error            string          `json:"error,omitempty"`
+	Patch            json.RawMessage `json:"patch,omitempty"`
+	Fields           []string        `json:"fields,omitempty"`
+	Warnings         []string        `json:"warnings,omitempty"`
+}
+
+// shadowStats aggregates the shadow records since the webhook started.
+type shadowStats struct {
+	mu         sync.Mutex
+	runs       int
+	wouldApply int
+	noChanges  int
+	skipped    int
+	failures   map[failureClass]int
+	fields     map[string]int
+}
+
+var shadow = &shadowStats{failures: map[failureClass]int{}, fields: map[string]int{}}
+
+// shadowSlots bounds the shadow corrections running at once. It is sized by SHADOW_MAX_CONCURRENT.
+var shadowSlots = sync.OnceValue(func() chan struct{} {
+	size := defaultShadowConcurrency
+	if value := os.Getenv("SHADOW_MAX_CONCURRENT"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			size = parsed
+		} else {
+			log.Printf("Ignoring invalid SHADOW_MAX_CONCURRENT %q", value)
+		}
+	}
+	return make(chan struct{}, size)
+})
+
+// startShadow runs a shadow correction after the admission response is sent.
+var startShadow = func(run func()) { go run() }
+
+// shadowCorrection runs the correction pipeline in the background and records what it would have done.
+// When the concurrency limit is reached, the object is counted as skipped instead, so shadow mode can't
+// pile up model calls.
+func shadowCorrection(req *admissionv1.AdmissionRequest, cr *unstructured.Unstructured, validationErrors string, client openaiClientInterface) {
+	slots := shadowSlots()
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("Skipping shadow correction of %s %s: %d already running", cr.GetKind(), cr.GetName(), cap(slots))
+		shadow.mu.Lock()
+		shadow.skipped++
+		shadow.mu.Unlock()
+		return
+	}
+
+	startShadow(func() {
+		defer func() { <-slots }()
+		record := runShadowCorrection(req, cr, validationErrors, client)
+		writeRecord("SHADOW_LOG_PATH", "Shadow", record)
+		shadow.add(record)
+	})
+}
+
+// runShadowCorrection runs the correction pipeline as auto-fix would, without saving an original, and
+// describes the result.
+func runShadowCorrection(req *admissionv1.AdmissionRequest, cr *unstructured.Unstructured, validationErrors string, client openaiClientInterface) shadowRecord {
+	provider, model := describeClient(client)
+	record := shadowRecord{
+		Time:             time.Now().UTC(),
+		UID:              string(req.UID),
+		Operation:        string(req.Operation),
+		Kind:             cr.GetKind(),
+		Namespace:        cr.GetNamespace(),
+		Name:             cr.GetName(),
+		User:             req.UserInfo.Username,
+		ValidationErrors: validationErrors,
+		Provider:         provider,
+		Model:            model,
+	}
+
+	result, err := correctObject(req, cr, client, false)
+	if result.correction != nil {
+		record.Usage = result.correction.usage
+	}
+	record.Warnings = result.warnings
+	if err != nil {
+		record.FailureClass = classOf(err)
+		record.Error = err.Error()
+		return record
+	}
+
+	record.WouldApply = len(result.operations) > 0
+	if record.WouldApply {
+		record.Patch = result.patch
+	}
+	changes, err := patchChanges(cr, result.adjusted)
+	if err != nil {
+		log.Printf("Failed to list the fields of the shadow correction: %v", err)
+	}
+	for _, change := range changes {
+		record.Fields = append(record.Fields, change.path.String())
+	}
+	return record
+}
+
+func (s *shadowStats) add(record shadowRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs++
+	switch {
+	case record.FailureClass != "":
+		s.failures[record.FailureClass]++
+	case record.WouldApply:
+		s.wouldApply++
+	default:
+		s.noChanges++
+	}
+	for _, field := range record.Fields {
+		s.fields[field]++
+	}
+}
+
+// fieldCount is how many shadow corrections touched a field.
+type fieldCount struct {
+	Field string `json:"field"`
+	Count int    `json:"count"`
+}
+
+// shadowReport is the aggregate served by ShadowReport.
+type shadowReport struct {
+	Runs       int                  `json:"runs"`
+	WouldApply int                  `json:"wouldApply"`
+	NoChanges  int                  `json:"noChanges"`
+	Skipped    int                  `json:"skipped"`
+	ApplyRate  float64              `json:"applyRate"`
+	Failures   map[failureClass]int `json:"failures"`
+	TopFields  []fieldCount         `json:"topFields"`
+}
+
+// report aggregates the records, listing at most top fields, the most corrected first.
+func (s *shadowStats) report(top int) shadowReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := shadowReport{
+		Runs:       s.runs,
+		WouldApply: s.wouldApply,
+		NoChanges:  s.noChanges,
+		Skipped:    s.skipped,
+		Failures:   map[failureClass]int{},
+		TopFields:  []fieldCount{},
+	}
+	if s.runs > 0 {
+		report.ApplyRate = float64(s.wouldApply) / float64(s.runs)
+	}
+	for class, count := range s.failures {
+		report.Failures[class] = count
+	}
+	for field, count := range s.fields {
+		report.TopFields = append(report.TopFields, fieldCount{Field: field, Count: count})
+	}
+	sort.Slice(report.TopFields, func(i, j int) bool {
+		if report.TopFields[i].Count != report.TopFields[j].Count {
+			return report.TopFields[i].Count > report.TopFields[j].Count
+		}
+		return report.TopFields[i].Field < report.TopFields[j].Field
+	})
+	if len(report.TopFields) > top {
+		report.TopFields = report.TopFields[:top]
+	}
+	return report
+}
+
+// ShadowReport serves the aggregate of the shadow corrections since the webhook started, as JSON: how
+// often a correction would have been applied, how often and why it failed, and the most corrected fields.
+func ShadowReport(w http.ResponseWriter, r *http.Request) {
+	top := defaultReportFields
+	if value := r.URL.Query().Get("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "top must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		top = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(shadow.report(top)); err != nil {
+		log.Printf("Failed to write shadow report: %v", err)
+	}
+}
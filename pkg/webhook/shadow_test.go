@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withShadowRuns runs shadow corrections synchronously, into empty totals.
+func withShadowRuns(t *testing.T) {
+	t.Helper()
+	previousStart, previousStats := startShadow, shadow
+	startShadow = func(run func()) { run() }
+	shadow = &shadowStats{failures: map[failureClass]int{}, fields: map[string]int{}}
+	t.Cleanup(func() { startShadow, shadow = previousStart, previousStats })
+}
+
+func TestMutate_ShadowMode(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	withEmptyCorrectionCache(t)
+	withShadowRuns(t)
+	shadowPath := filepath.Join(t.TempDir(), "shadow.log")
+	t.Setenv("SHADOW_LOG_PATH", shadowPath)
+	t.Setenv("CORRECTION_MODE", "shadow")
+
+	client := &promptCapturingClient{response: correctedAnnotatedCRYAML}
+	response := mutate(admissionReviewFor(t, annotatedCRYAML), client)
+	if !response.Allowed || response.Patch != nil || len(response.Warnings) > 0 {
+		t.Fatalf("Expected the object to be allowed unchanged, got %+v", response)
+	}
+
+	data, err := os.ReadFile(shadowPath)
+	if err != nil {
+		t.Fatalf("Failed to read shadow log: %v", err)
+	}
+	var record shadowRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("Failed to decode shadow record: %v", err)
+	}
+	if !record.WouldApply || record.Patch == nil || record.ValidationErrors == "" || record.Model == "" {
+		t.Errorf("Expected a record of the candidate patch, got %+v", record)
+	}
+	if strings.Join(record.Fields, ",") != "spec.source.catalog.packageName" {
+		t.Errorf("Expected the package name in the fields, got %q", record.Fields)
+	}
+
+	// A dry run is allowed without running the correction
+	if response := mutate(dryRunReviewFor(t, annotatedCRYAML), client); !response.Allowed || response.Patch != nil {
+		t.Fatalf("Expected the dry run to be allowed unchanged, got %+v", response)
+	}
+	if report := shadow.report(defaultReportFields); report.Runs != 1 {
+		t.Errorf("Did not expect the dry run in the report, got %d runs", report.Runs)
+	}
+}
+
+func TestShadowReport(t *testing.T) {
+	withShadowRuns(t)
+	for _, record := range []shadowRecord{
+		{WouldApply: true, Fields: []string{"spec.source.catalog.packageName", "spec.install.namespace"}},
+		{WouldApply: true, Fields: []string{"spec.source.catalog.packageName"}},
+		{Fields: []string{}},
+		{FailureClass: failureLLMUnavailable, Error: "timeout"},
+	} {
+		shadow.add(record)
+	}
+
+	recorder := httptest.NewRecorder()
+	ShadowReport(recorder, httptest.NewRequest(http.MethodGet, "/shadow/report?top=1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", recorder.Code, recorder.Body)
+	}
+	var report shadowReport
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.Runs != 4 || report.WouldApply != 2 || report.NoChanges != 1 || report.ApplyRate != 0.5 {
+		t.Errorf("Unexpected totals %+v", report)
+	}
+	if report.Failures[failureLLMUnavailable] != 1 {
+		t.Errorf("Expected one unavailable model, got %v", report.Failures)
+	}
+	if len(report.TopFields) != 1 || report.TopFields[0] != (fieldCount{Field: "spec.source.catalog.packageName", Count: 2}) {
+		t.Errorf("Unexpected top fields %+v", report.TopFields)
+	}
+
+	recorder = httptest.NewRecorder()
+	ShadowReport(recorder, httptest.NewRequest(http.MethodGet, "/shadow/report?top=many", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid top to be rejected, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// serverManagedMetadata are the metadata fields the API server sets, which don't belong in a manifest.
+var serverManagedMetadata = []string{"uid", "resourceVersion", "generation", "creationTimestamp", "managedFields", "selfLink"}
+
+// suggestionResponse denies the request with a diff and the complete corrected manifest, so the user can
+// fix the source of the object instead of the cluster drifting from it.
+func suggestionResponse(original, adjusted *unstructured.Unstructured, warnings []string) *admissionv1.AdmissionResponse {
+	originalYAML, err := manifestYAML(original)
+	if err != nil {
+		return toAdmissionResponse(err)
+	}
+	adjustedYAML, err := manifestYAML(adjusted)
+	if err != nil {
+		return toAdmissionResponse(err)
+	}
+
+	message := fmt.Sprintf("%s %s is invalid. A corrected manifest is suggested below; apply it from your source instead.\n\n"+
+		"Changes (- submitted, + suggested):\n\n%s\nCorrected manifest:\n\n%s",
+		original.GetKind(), original.GetName(), LineDiff(originalYAML, adjustedYAML), adjustedYAML)
+
+	return &admissionv1.AdmissionResponse{
+		Allowed:  false,
+		Warnings: limitWarnings(warnings),
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: message,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
+
+// manifestYAML renders an object as a manifest, without status and server-managed metadata.
+func manifestYAML(obj *unstructured.Unstructured) (string, error) {
+	manifest := obj.DeepCopy()
+	delete(manifest.Object, "status")
+	for _, field := range serverManagedMetadata {
+		unstructured.RemoveNestedField(manifest.Object, "metadata", field)
+	}
+	data, err := yaml.Marshal(manifest.Object)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMutate_SuggestMode(t *testing.T) {
+	withGetCRD(t, mockGetCRD)
+	t.Setenv("CORRECTION_MODE", "suggest")
+
+	review := admissionReviewFor(t, annotatedCRYAML)
+	admissionResponse := mutate(review, &mockOpenAIClient{
+		response: strings.Replace(annotatedCRYAML, "packageName:", "packageName: example-package", 1),
+	})
+	if admissionResponse.Allowed {
+		t.Fatalf("Expected the request to be denied in suggest mode")
+	}
+	if admissionResponse.Patch != nil {
+		t.Errorf("Did not expect a patch in suggest mode")
+	}
+	if admissionResponse.Result.Code != 422 {
+		t.Errorf("Unexpected status code %d", admissionResponse.Result.Code)
+	}
+
+	message := admissionResponse.Result.Message
+	for _, want := range []string{
+		"-       packageName: null",
+		"+       packageName: example-package",
+		"Corrected manifest:\n\napiVersion: olm.operatorframework.io/v1alpha1",
+		"owner: platform-team",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("Expected %q in the message, got:\n%s", want, message)
+		}
+	}
+	if strings.Contains(message, provenancePrefix) {
+		t.Errorf("Did not expect provenance in a suggestion, got:\n%s", message)
+	}
+}
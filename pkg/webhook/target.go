@@ -0,0 +1,320 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// correctionTarget is a kind of object the webhook corrects, with the settings that apply to it.
+type correctionTarget struct {
+	Group string `json:"group"`
+	// Version is the API version, or empty for every version of the kind.
+	Version string `json:"version,omitempty"`
+	Kind    string `json:"kind"`
+	// Resource is the plural resource name the webhook rules use, like clusterextensions.
+	Resource string `json:"resource"`
+	// Instructions are added to the correction prompt for this kind.
+	Instructions string `json:"instructions,omitempty"`
+	// PolicyFile is the correction policy for this kind, instead of CORRECTION_POLICY_FILE.
+	PolicyFile string `json:"policyFile,omitempty"`
+	// ExamplesDir and ExamplesConfigMap hold the few-shot examples for this kind, instead of
+	// FEW_SHOT_EXAMPLES_DIR and FEW_SHOT_EXAMPLES_CONFIGMAP.
+	ExamplesDir       string `json:"examplesDir,omitempty"`
+	ExamplesConfigMap string `json:"examplesConfigMap,omitempty"`
+	// Fields are the top-level fields a correction may change, spec if empty. Kinds without a spec, like
+	// ConfigMaps, name theirs, like data and binaryData.
+	Fields []string `json:"fields,omitempty"`
+
+	policy   *correctionPolicy
+	examples func() *exampleLibrary
+}
+
+// correctionTargets lists the kinds the webhook corrects. The first target that matches an object applies.
+type correctionTargets struct {
+	Targets []*correctionTarget `json:"targets"`
+}
+
+// defaultCorrectionTargets is used when CORRECTION_TARGETS_FILE is not set: v1 and v1alpha1
+// ClusterExtensions, with the settings from the environment.
+func defaultCorrectionTargets() *correctionTargets {
+	return &correctionTargets{Targets: []*correctionTarget{{
+		Group:    "olm.operatorframework.io",
+		Version:  "v1",
+		Kind:     "ClusterExtension",
+		Resource: "clusterextensions",
+	}, {
+		Group:    "olm.operatorframework.io",
+		Version:  "v1alpha1",
+		Kind:     "ClusterExtension",
+		Resource: "clusterextensions",
+	}}}
+}
+
+// loadCorrectionTargets returns the targets in the file named by CORRECTION_TARGETS_FILE, or the default
+// ones if it is not set. It is loaded once on first use.
+var loadCorrectionTargets = sync.OnceValues(func() (*correctionTargets, error) {
+	file := os.Getenv("CORRECTION_TARGETS_FILE")
+	if file == "" {
+		return defaultCorrectionTargets(), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := parseCorrectionTargets(data)
+	if err == nil {
+		err = targets.loadSettings()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	log.Printf("Loaded %d correction targets from %s", len(targets.Targets), file)
+	return targets, nil
+})
+
+// parseCorrectionTargets decodes YAML targets and checks them.
+func parseCorrectionTargets(data []byte) (*correctionTargets, error) {
+	targets := &correctionTargets{}
+	if err := yaml.UnmarshalStrict(data, targets); err != nil {
+		return nil, fmt.Errorf("invalid correction targets: %v", err)
+	}
+	if len(targets.Targets) == 0 {
+		return nil, fmt.Errorf("no correction targets")
+	}
+	for i, target := range targets.Targets {
+		if target.Kind == "" || target.Resource == "" {
+			return nil, fmt.Errorf("target %d: kind and resource are required", i+1)
+		}
+		for _, field := range target.Fields {
+			if slices.Contains(uncorrectedFields, field) {
+				return nil, fmt.Errorf("target %d: %s can't be corrected", i+1, field)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// loadSettings reads the policies of the targets. Their examples are read on first use.
+func (t *correctionTargets) loadSettings() error {
+	for i, target := range t.Targets {
+		if target.PolicyFile != "" {
+			policy, err := readCorrectionPolicy(target.PolicyFile)
+			if err != nil {
+				return fmt.Errorf("target %d: %v", i+1, err)
+			}
+			target.policy = policy
+		}
+		if target.ExamplesDir != "" || target.ExamplesConfigMap != "" {
+			dir, configMapRef := target.ExamplesDir, target.ExamplesConfigMap
+			target.examples = sync.OnceValue(func() *exampleLibrary { return loadExampleLibrary(dir, configMapRef) })
+		}
+	}
+	return nil
+}
+
+// lookup returns the first target for the kind, or nil if the webhook doesn't correct it.
+func (t *correctionTargets) lookup(gvk schema.GroupVersionKind) *correctionTarget {
+	for _, target := range t.Targets {
+		if target.Group == gvk.Group && target.Kind == gvk.Kind && (target.Version == "" || target.Version == gvk.Version) {
+			return target
+		}
+	}
+	return nil
+}
+
+// lookupResource returns the first target for the resource, or nil if the webhook doesn't correct it.
+func (t *correctionTargets) lookupResource(gvr schema.GroupVersionResource) *correctionTarget {
+	for _, target := range t.Targets {
+		if target.Group == gvr.Group && target.Resource == gvr.Resource && (target.Version == "" || target.Version == gvr.Version) {
+			return target
+		}
+	}
+	return nil
+}
+
+// targetFor returns the target for an object, or nil if the webhook doesn't correct its kind.
+func targetFor(cr *unstructured.Unstructured) (*correctionTarget, error) {
+	targets, err := loadCorrectionTargets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load correction targets: %v", err)
+	}
+	return targets.lookup(cr.GroupVersionKind()), nil
+}
+
+// correctionPolicy returns the policy for the target, or the one from CORRECTION_POLICY_FILE if the target
+// has none.
+func (t *correctionTarget) correctionPolicy() (*correctionPolicy, error) {
+	if t == nil || t.PolicyFile == "" {
+		return loadCorrectionPolicy()
+	}
+	return t.policy, nil
+}
+
+// exampleLibrary returns the few-shot examples for the target, or the ones from the environment if the
+// target has none.
+func (t *correctionTarget) exampleLibrary() *exampleLibrary {
+	if t == nil || t.examples == nil {
+		return fewShotLibrary()
+	}
+	return t.examples()
+}
+
+// uncorrectedFields are the top-level fields a correction never changes: the object's identity, its
+// metadata and the status its controller writes.
+var uncorrectedFields = []string{"apiVersion", "kind", "metadata", "status"}
+
+// correctedFields returns the top-level fields corrections of the target change: its fields, or spec.
+func (t *correctionTarget) correctedFields() []string {
+	if t == nil || len(t.Fields) == 0 {
+		return []string{"spec"}
+	}
+	return t.Fields
+}
+
+// correctedFieldsFor returns the top-level fields corrections of an object change, from its target. An
+// object whose targets can't be loaded, or that is no longer a target, has its spec corrected.
+func correctedFieldsFor(obj *unstructured.Unstructured) []string {
+	targets, err := loadCorrectionTargets()
+	if err != nil {
+		return []string{"spec"}
+	}
+	return targets.lookup(obj.GroupVersionKind()).correctedFields()
+}
+
+// instructions returns the target's prompt instructions, or nothing for a nil target.
+func (t *correctionTarget) instructions() string {
+	if t == nil {
+		return ""
+	}
+	return t.Instructions
+}
+
+// semanticChecks are the checks of kinds with rules beyond their schema. Other kinds are validated against
+// their CRD.
+var semanticChecks = map[schema.GroupKind]func(*unstructured.Unstructured) (bool, string){
+	clusterExtensionKind: ValidateCR,
+}
+
+// hasSemanticChecks reports whether the object's kind has its own checks, so validating it doesn't need
+// its CRD.
+func hasSemanticChecks(cr *unstructured.Unstructured) bool {
+	_, ok := semanticChecks[cr.GroupVersionKind().GroupKind()]
+	return ok
+}
+
+// validateObject reports whether an object is valid, and why not. Kinds with semantic checks, like
+// ClusterExtension, are validated by them; other kinds against the schema and CEL rules of their CRD.
+func validateObject(cr *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition) (bool, string) {
+	if check, ok := semanticChecks[cr.GroupVersionKind().GroupKind()]; ok {
+		return check(cr)
+	}
+	if crd == nil {
+		return false, fmt.Sprintf("no CRD to validate %s against", cr.GetKind())
+	}
+	problems, err := validateAgainstSchema(context.TODO(), cr, nil, crd)
+	if err != nil {
+		return false, err.Error()
+	}
+	if len(problems) == 0 {
+		return true, ""
+	}
+	return false, problems.ToAggregate().Error()
+}
+
+// WebhookRules returns the webhook rules that send the kinds in a targets file to the webhook, on create
+// and update. Kinds of the same resource are merged into one rule. Empty data gives the rules for the
+// default targets.
+func WebhookRules(data []byte) ([]admissionregistrationv1.RuleWithOperations, error) {
+	targets, err := targetsFromData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	type resourceKey struct{ group, resource string }
+	versions := map[resourceKey][]string{}
+	var keys []resourceKey
+	for _, target := range targets.Targets {
+		key := resourceKey{target.Group, target.Resource}
+		if _, ok := versions[key]; !ok {
+			keys = append(keys, key)
+		}
+		version := target.Version
+		if version == "" {
+			version = "*"
+		}
+		if !slices.Contains(versions[key], version) {
+			versions[key] = append(versions[key], version)
+		}
+	}
+
+	rules := make([]admissionregistrationv1.RuleWithOperations, 0, len(keys))
+	for _, key := range keys {
+		apiVersions := versions[key]
+		if slices.Contains(apiVersions, "*") {
+			apiVersions = []string{"*"}
+		}
+		sort.Strings(apiVersions)
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{key.group},
+				APIVersions: apiVersions,
+				Resources:   []string{key.resource},
+			},
+		})
+	}
+	return rules, nil
+}
+
+// TargetRBACRules returns the RBAC rules the webhook's service account needs to apply approved corrections
+// to the kinds in a targets file. Resources of the same group are merged into one rule. Empty data gives
+// the rules for the default targets.
+func TargetRBACRules(data []byte) ([]rbacv1.PolicyRule, error) {
+	targets, err := targetsFromData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := map[string][]string{}
+	var groups []string
+	for _, target := range targets.Targets {
+		if _, ok := resources[target.Group]; !ok {
+			groups = append(groups, target.Group)
+		}
+		if !slices.Contains(resources[target.Group], target.Resource) {
+			resources[target.Group] = append(resources[target.Group], target.Resource)
+		}
+	}
+
+	rules := make([]rbacv1.PolicyRule, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(resources[group])
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups: []string{group},
+			Resources: resources[group],
+			Verbs:     []string{"get", "create", "update"},
+		})
+	}
+	return rules, nil
+}
+
+// targetsFromData decodes the targets of a correction targets file, or returns the default ones if data is
+// empty.
+func targetsFromData(data []byte) (*correctionTargets, error) {
+	if len(data) == 0 {
+		return defaultCorrectionTargets(), nil
+	}
+	return parseCorrectionTargets(data)
+}
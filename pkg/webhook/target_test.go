@@ -0,0 +1,206 @@
+package webhook
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const widgetCRDYAML = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  scope: Namespaced
+  names:
+    kind: Widget
+    plural: widgets
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            required: ["size"]
+            properties:
+              size:
+                type: string
+                enum: ["small", "large"]
+              replicas:
+                type: integer
+                minimum: 1
+`
+
+const widgetYAML = `
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: example
+  namespace: default
+spec:
+  size: Large
+  replicas: 2
+`
+
+// withCorrectionTargets makes the webhook use the targets in targetsYAML.
+func withCorrectionTargets(t *testing.T, targetsYAML string) {
+	t.Helper()
+	targets, err := parseCorrectionTargets([]byte(targetsYAML))
+	if err == nil {
+		err = targets.loadSettings()
+	}
+	if err != nil {
+		t.Fatalf("Failed to load correction targets: %v", err)
+	}
+	original := loadCorrectionTargets
+	t.Cleanup(func() { loadCorrectionTargets = original })
+	loadCorrectionTargets = func() (*correctionTargets, error) { return targets, nil }
+}
+
+func widgetCRD(t *testing.T) *apiextensionsv1.CustomResourceDefinition {
+	t.Helper()
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := yaml.Unmarshal([]byte(widgetCRDYAML), crd); err != nil {
+		t.Fatalf("Failed to parse Widget CRD: %v", err)
+	}
+	return crd
+}
+
+func TestParseCorrectionTargets_Invalid(t *testing.T) {
+	for name, targetsYAML := range map[string]string{
+		"empty":            "targets: []\n",
+		"missing resource": "targets:\n- group: example.com\n  kind: Widget\n",
+		"unknown field":    "targets:\n- group: example.com\n  kind: Widget\n  resource: widgets\n  prompt: be nice\n",
+		"metadata field":   "targets:\n- group: example.com\n  kind: Widget\n  resource: widgets\n  fields: [spec, metadata]\n",
+	} {
+		if _, err := parseCorrectionTargets([]byte(targetsYAML)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestWebhookRules(t *testing.T) {
+	rules, err := WebhookRules([]byte(`
+targets:
+- group: olm.operatorframework.io
+  version: v1alpha1
+  kind: ClusterExtension
+  resource: clusterextensions
+- group: olm.operatorframework.io
+  version: v1
+  kind: ClusterExtension
+  resource: clusterextensions
+- group: example.com
+  kind: Widget
+  resource: widgets
+  policyFile: /does/not/exist.yaml
+`))
+	if err != nil {
+		t.Fatalf("WebhookRules failed: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected one rule per resource, got %+v", rules)
+	}
+	if got := strings.Join(rules[0].APIVersions, ","); got != "v1,v1alpha1" || rules[0].Resources[0] != "clusterextensions" {
+		t.Errorf("Unexpected ClusterExtension rule %+v", rules[0])
+	}
+	if got := strings.Join(rules[1].APIVersions, ","); got != "*" || rules[1].APIGroups[0] != "example.com" {
+		t.Errorf("Unexpected Widget rule %+v", rules[1])
+	}
+	if len(rules[1].Operations) != 2 {
+		t.Errorf("Expected CREATE and UPDATE, got %v", rules[1].Operations)
+	}
+}
+
+func TestTargetRBACRules(t *testing.T) {
+	rules, err := TargetRBACRules([]byte(`
+targets:
+- group: olm.operatorframework.io
+  version: v1
+  kind: ClusterExtension
+  resource: clusterextensions
+- group: olm.operatorframework.io
+  version: v1alpha1
+  kind: ClusterExtension
+  resource: clusterextensions
+- group: apps
+  version: v1
+  kind: Deployment
+  resource: deployments
+- group: apps
+  version: v1
+  kind: StatefulSet
+  resource: statefulsets
+`))
+	if err != nil {
+		t.Fatalf("TargetRBACRules failed: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected one rule per group, got %+v", rules)
+	}
+	if rules[0].APIGroups[0] != "olm.operatorframework.io" || strings.Join(rules[0].Resources, ",") != "clusterextensions" {
+		t.Errorf("Unexpected ClusterExtension rule %+v", rules[0])
+	}
+	if rules[1].APIGroups[0] != "apps" || strings.Join(rules[1].Resources, ",") != "deployments,statefulsets" {
+		t.Errorf("Unexpected apps rule %+v", rules[1])
+	}
+	if got := strings.Join(rules[1].Verbs, ","); got != "get,create,update" {
+		t.Errorf("Expected the verbs the proposal controller uses, got %s", got)
+	}
+}
+
+func TestMutate_GenericTarget(t *testing.T) {
+	crd := widgetCRD(t)
+	withGetCRD(t, func(*unstructured.Unstructured) (*apiextensionsv1.CustomResourceDefinition, error) { return crd, nil })
+	withEmptyCorrectionCache(t)
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(policyFile, []byte("deny:\n- paths: [spec.replicas]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	withCorrectionTargets(t, `
+targets:
+- group: example.com
+  kind: Widget
+  resource: widgets
+  instructions: Widget sizes are always lowercase.
+  policyFile: `+policyFile+`
+`)
+
+	// The schema is what makes the Widget invalid
+	if isValid, message := validateObject(parseCR(t, widgetYAML), crd); isValid || !strings.Contains(message, "spec.size") {
+		t.Fatalf("Expected the size to be invalid, got %v: %s", isValid, message)
+	}
+
+	answer := strings.NewReplacer("size: Large", "size: large", "replicas: 2", "replicas: 3").Replace(widgetYAML)
+	client := &promptCapturingClient{response: answer}
+	response := mutate(admissionReviewFor(t, widgetYAML), client)
+	if !response.Allowed {
+		t.Fatalf("Expected the Widget to be allowed: %v", response.Result)
+	}
+	if !strings.Contains(client.prompt, "Widget sizes are always lowercase.") {
+		t.Errorf("Expected the target's instructions in the prompt, got:\n%s", client.prompt)
+	}
+	if !strings.Contains(string(response.Patch), `"large"`) {
+		t.Errorf("Expected the size to be corrected, got %s", response.Patch)
+	}
+	if strings.Contains(string(response.Patch), "/spec/replicas") {
+		t.Errorf("Expected the target's policy to drop the replicas change, got %s", response.Patch)
+	}
+
+	// Kinds that aren't targets are left alone
+	client.prompt = ""
+	if response := mutate(admissionReviewFor(t, validCRYAML), client); !response.Allowed || response.Patch != nil || client.prompt != "" {
+		t.Errorf("Expected a ClusterExtension to be ignored, got %+v", response)
+	}
+}
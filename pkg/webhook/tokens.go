@@ -0,0 +1,141 @@
+package webhook
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// defaultLocalContextTokens is the context window assumed for local models we know nothing about (Ollama's default num_ctx).
+const defaultLocalContextTokens = 2048
+
+// defaultCharsPerToken is the conservative characters-per-token ratio used for models without a known tokenizer.
+const defaultCharsPerToken = 3.0
+
+// contextWindows maps model name prefixes to their context window in tokens. Longer prefixes win.
+// The local entries match the num_ctx set by scripts/pull_and_bump_num_ctx_ollama.sh.
+var contextWindows = map[string]int{
+	"gpt-4o":        128000,
+	"gpt-4-turbo":   128000,
+	"gpt-4":         8192,
+	"gpt-3.5-turbo": 16385,
+	"mistral-nemo":  16384,
+	"granite-code":  16384,
+	"granite3":      16384,
+}
+
+// charsPerToken maps model name prefixes to a characters-per-token ratio calibrated on CRD and CR YAML.
+var charsPerToken = map[string]float64{
+	"mistral":   3.2,
+	"granite":   3.0,
+	"llama":     3.3,
+	"codellama": 2.9,
+}
+
+func init() {
+	// Use the BPE files embedded in the binary instead of downloading them at runtime
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+// tokenEstimator counts the tokens a piece of text uses for a particular model.
+type tokenEstimator interface {
+	countTokens(text string) int
+}
+
+// tiktokenEstimator counts tokens exactly using the BPE encoding of an OpenAI model.
+type tiktokenEstimator struct {
+	encoding *tiktoken.Tiktoken
+}
+
+func (e *tiktokenEstimator) countTokens(text string) int {
+	return len(e.encoding.Encode(text, nil, nil))
+}
+
+// charRatioEstimator approximates token counts from the number of characters.
+type charRatioEstimator struct {
+	charsPerToken float64
+}
+
+func (e *charRatioEstimator) countTokens(text string) int {
+	return int(math.Ceil(float64(len([]rune(text))) / e.charsPerToken))
+}
+
+var (
+	estimatorsMu sync.Mutex
+	estimators   = map[string]tokenEstimator{}
+)
+
+// estimatorForModel returns the token estimator for a provider and model. OpenAI models use their tiktoken
+// encoding; everything else uses a calibrated character ratio, which LLM_CHARS_PER_TOKEN can override.
+func estimatorForModel(provider, model string) tokenEstimator {
+	key := provider + "/" + model
+	estimatorsMu.Lock()
+	defer estimatorsMu.Unlock()
+	if estimator, ok := estimators[key]; ok {
+		return estimator
+	}
+
+	var estimator tokenEstimator
+	if provider == providerOpenAI {
+		encoding, err := tiktoken.EncodingForModel(model)
+		if err != nil {
+			log.Printf("No tiktoken encoding for model %s, falling back to an estimate: %v", model, err)
+		} else {
+			estimator = &tiktokenEstimator{encoding: encoding}
+		}
+	}
+	if estimator == nil {
+		ratio, ok := lookupByPrefix(charsPerToken, model)
+		if !ok {
+			ratio = defaultCharsPerToken
+		}
+		if value := os.Getenv("LLM_CHARS_PER_TOKEN"); value != "" {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed > 0 {
+				ratio = parsed
+			} else {
+				log.Printf("Ignoring invalid LLM_CHARS_PER_TOKEN %q", value)
+			}
+		}
+		estimator = &charRatioEstimator{charsPerToken: ratio}
+	}
+
+	estimators[key] = estimator
+	return estimator
+}
+
+// contextWindowForModel returns the context size of a model in tokens. LLM_CONTEXT_TOKENS overrides the built-in table.
+func contextWindowForModel(provider, model string) int {
+	if value := os.Getenv("LLM_CONTEXT_TOKENS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+		log.Printf("Ignoring invalid LLM_CONTEXT_TOKENS %q", value)
+	}
+	if window, ok := lookupByPrefix(contextWindows, model); ok {
+		return window
+	}
+	if provider == providerOpenAI {
+		return contextWindows["gpt-4o"]
+	}
+	return defaultLocalContextTokens
+}
+
+// lookupByPrefix returns the value of the longest key that is a prefix of name.
+func lookupByPrefix[V any](table map[string]V, name string) (V, bool) {
+	var (
+		value   V
+		longest = -1
+	)
+	for prefix, v := range table {
+		if strings.HasPrefix(name, prefix) && len(prefix) > longest {
+			value, longest = v, len(prefix)
+		}
+	}
+	return value, longest >= 0
+}
@@ -0,0 +1,208 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// immutableRule is the CEL rule CRDs use to make a field immutable.
+const immutableRule = "self==oldSelf"
+
+// updateScope limits the correction of an UPDATE to the fields the user changed and the required fields
+// that are missing, and keeps it away from immutable fields.
+type updateScope struct {
+	old *unstructured.Unstructured
+	// changed are the fields the update changed, within the corrected ones.
+	changed []fieldPath
+	// required are the fields the schema or the semantic checks require that the object is missing.
+	required []fieldPath
+	// immutable are the fields the schema makes immutable.
+	immutable []fieldPath
+}
+
+// newUpdateScope compares the stored object with the updated one. It returns nil when there is no stored
+// object, as for a CREATE.
+func newUpdateScope(old, cr *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition) *updateScope {
+	if old == nil {
+		return nil
+	}
+	scope := &updateScope{old: old}
+
+	fields := correctedFieldsFor(cr)
+	for _, field := range fields {
+		oldValue, inOld := old.Object[field]
+		newValue, inNew := cr.Object[field]
+		for _, change := range diffFields(fieldPath{field}, oldValue, inOld, newValue, inNew, nil) {
+			scope.changed = append(scope.changed, change.path)
+		}
+	}
+
+	seen := map[string]bool{}
+	addRequired := func(path fieldPath) {
+		if !seen[path.String()] {
+			seen[path.String()] = true
+			scope.required = append(scope.required, path)
+		}
+	}
+	if isValid, message := validateObject(cr, crd); !isValid {
+		if failure, ok := validationFailures[message]; ok {
+			addRequired(parseDottedPath(failure.path))
+		}
+	}
+	schema := versionSchema(crd, cr.GroupVersionKind().Version)
+	if schema != nil {
+		for _, field := range fields {
+			if fieldSchema, ok := schema.Properties[field]; ok {
+				for _, path := range missingRequiredFields(fieldPath{field}, &fieldSchema, cr.Object[field]) {
+					addRequired(path)
+				}
+				scope.immutable = immutableFields(fieldPath{field}, &fieldSchema, scope.immutable)
+			}
+		}
+	}
+	return scope
+}
+
+// parseDottedPath splits a path of map keys, like spec.install.namespace.
+func parseDottedPath(path string) fieldPath {
+	var out fieldPath
+	for _, key := range strings.Split(path, ".") {
+		out = append(out, key)
+	}
+	return out
+}
+
+// missingRequiredFields lists the required fields missing, or null, in the objects of value that are
+// present. Lists are not descended into.
+func missingRequiredFields(path fieldPath, schema *apiextensionsv1.JSONSchemaProps, value interface{}) []fieldPath {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var missing []fieldPath
+	for _, name := range schema.Required {
+		if v, ok := obj[name]; !ok || v == nil {
+			missing = append(missing, path.child(name))
+		}
+	}
+	names := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		props := schema.Properties[name]
+		missing = append(missing, missingRequiredFields(path.child(name), &props, obj[name])...)
+	}
+	return missing
+}
+
+// immutableFields lists the fields of the schema with a self == oldSelf validation rule.
+func immutableFields(path fieldPath, schema *apiextensionsv1.JSONSchemaProps, fields []fieldPath) []fieldPath {
+	for _, rule := range schema.XValidations {
+		if strings.Join(strings.Fields(rule.Rule), "") == immutableRule {
+			fields = append(fields, path)
+			break
+		}
+	}
+	names := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		props := schema.Properties[name]
+		fields = immutableFields(path.child(name), &props, fields)
+	}
+	return fields
+}
+
+// policySegments converts a path to policy segments that match it literally.
+func policySegments(path fieldPath) []string {
+	escaper := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+	segments := make([]string, len(path))
+	for i, element := range path {
+		segments[i] = escaper.Replace(fmt.Sprint(element))
+	}
+	return segments
+}
+
+// restrict undoes the changes of a correction outside the update's scope and to stored immutable values,
+// and puts back the stored value of every field the correction adds that the stored object had. It
+// returns the restricted correction and descriptions of the changes it undid.
+func (s *updateScope) restrict(cr, adjusted *unstructured.Unstructured) (*unstructured.Unstructured, []string, error) {
+	changes, err := patchChanges(cr, adjusted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	restricted := adjusted.DeepCopy()
+	var dropped []string
+	for _, change := range changes {
+		stored, inStored := getPath(s.old.Object, change.path)
+		inStored = inStored && stored != nil
+		switch {
+		case !matchAnyPath(s.changed, change.path) && !matchAnyPath(s.required, change.path):
+			dropped = append(dropped, fmt.Sprintf("not correcting %s: the update didn't change it", change.path))
+		case change.operation == operationAdd && inStored:
+			log.Printf("Using the stored value of %s instead of the model's", change.path)
+			putPath(restricted.Object, change.path, runtime.DeepCopyJSONValue(stored))
+			continue
+		case inStored && matchAnyPath(s.immutable, change.path):
+			dropped = append(dropped, fmt.Sprintf("not correcting %s: it is immutable", change.path))
+		default:
+			continue
+		}
+		revertChange(cr.Object, restricted.Object, change.path)
+	}
+	return restricted, dropped, nil
+}
+
+// matchAnyPath reports whether path is one of paths or below one of them.
+func matchAnyPath(paths []fieldPath, path fieldPath) bool {
+	segments := policySegments(path)
+	for _, p := range paths {
+		if matchSegments(policySegments(p), segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderUpdateScope formats the update section of the prompt. It is empty for a CREATE.
+func renderUpdateScope(s *updateScope) string {
+	if s == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("\nThis CR is an update of an existing object. ")
+	if len(s.changed) > 0 {
+		fmt.Fprintf(&b, "The user only changed these fields: %s. ", joinPaths(s.changed))
+	} else {
+		b.WriteString("The user didn't change any field of spec. ")
+	}
+	if len(s.required) > 0 {
+		fmt.Fprintf(&b, "These required fields are missing: %s. ", joinPaths(s.required))
+	}
+	b.WriteString("Only correct these fields and keep every other field exactly as it is.")
+	if len(s.immutable) > 0 {
+		fmt.Fprintf(&b, " Never change these immutable fields: %s.", joinPaths(s.immutable))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func joinPaths(paths []fieldPath) string {
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = path.String()
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// updatedCRYAML is validCRYAML after an update that dropped the package name and added channels.
+var updatedCRYAML = strings.Replace(validCRYAML, "      packageName: argocd-operator\n", "      channels:\n      - Stable\n", 1)
+
+// updateReviewFor wraps a CR and its stored version in an UPDATE admission review.
+func updateReviewFor(t *testing.T, oldYAML, crYAML string) *admissionv1.AdmissionReview {
+	t.Helper()
+	review := admissionReviewFor(t, crYAML)
+	oldJSON, err := yaml.YAMLToJSON([]byte(oldYAML))
+	if err != nil {
+		t.Fatalf("Failed to convert old CR YAML to JSON: %v", err)
+	}
+	review.Request.Operation = admissionv1.Update
+	review.Request.OldObject = runtime.RawExtension{Raw: oldJSON}
+	return review
+}
+
+func TestNewUpdateScope(t *testing.T) {
+	crd := loadClusterExtensionCRD(t)
+	scope := newUpdateScope(parseCR(t, validCRYAML), parseCR(t, updatedCRYAML), crd)
+
+	if got := joinPaths(scope.changed); got != "spec.source.catalog.channels, spec.source.catalog.packageName" {
+		t.Errorf("Unexpected changed fields %s", got)
+	}
+	if got := joinPaths(scope.required); got != "spec.source.catalog.packageName" {
+		t.Errorf("Unexpected required fields %s", got)
+	}
+	if got := joinPaths(scope.immutable); got != "spec.install.namespace, spec.install.serviceAccount.name, spec.source.catalog.packageName" {
+		t.Errorf("Unexpected immutable fields %s", got)
+	}
+	if newUpdateScope(nil, parseCR(t, validCRYAML), crd) != nil {
+		t.Errorf("Expected no scope without a stored object")
+	}
+}
+
+func TestMutate_UpdateOnlyTouchesChangedFields(t *testing.T) {
+	withClusterExtensionCRD(t)
+	t.Setenv("LLM_CONTEXT_TOKENS", "100000")
+
+	// The model renames the namespace, fixes the channel's case and invents a package name
+	answer := strings.NewReplacer(
+		"namespace: argocd", "namespace: argocd-system",
+		"- Stable", "- stable",
+		"      channels:", "      packageName: argo-cd\n      channels:",
+	).Replace(updatedCRYAML)
+	client := &promptCapturingClient{response: answer}
+
+	response := mutate(updateReviewFor(t, validCRYAML, updatedCRYAML), client)
+	if !response.Allowed {
+		t.Fatalf("Expected the update to be allowed: %v", response.Result)
+	}
+	if !strings.Contains(client.prompt, "The user only changed these fields: spec.source.catalog.channels, spec.source.catalog.packageName.") {
+		t.Errorf("Expected the changed fields in the prompt, got:\n%s", client.prompt)
+	}
+
+	patched, err := applyJSONPatch(mustJSON(t, updatedCRYAML), response.Patch)
+	if err != nil {
+		t.Fatalf("Failed to apply patch: %v", err)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(patched, &obj); err != nil {
+		t.Fatalf("Failed to unmarshal patched CR: %v", err)
+	}
+	for path, want := range map[string]interface{}{
+		"spec.install.namespace":          "argocd",
+		"spec.source.catalog.packageName": "argocd-operator",
+	} {
+		if got, _ := getPath(obj, parseDottedPath(path)); got != want {
+			t.Errorf("Expected %s to be %v, got %v", path, want, got)
+		}
+	}
+	if got, _ := getPath(obj, parseDottedPath("spec.source.catalog.channels")); len(got.([]interface{})) != 1 || got.([]interface{})[0] != "stable" {
+		t.Errorf("Expected the channels the user changed to be corrected, got %v", got)
+	}
+	if !strings.Contains(strings.Join(response.Warnings, "\n"), "not correcting spec.install.namespace: the update didn't change it") {
+		t.Errorf("Expected a warning for the namespace, got %q", response.Warnings)
+	}
+}
+
+func mustJSON(t *testing.T, crYAML string) []byte {
+	t.Helper()
+	data, err := yaml.YAMLToJSON([]byte(crYAML))
+	if err != nil {
+		t.Fatalf("Failed to convert YAML to JSON: %v", err)
+	}
+	return data
+}
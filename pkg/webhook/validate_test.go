@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const validCRYAML = `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: argocd
+spec:
+  install:
+    namespace: argocd
+    serviceAccount:
+      name: argocd-installer
+  source:
+    sourceType: Catalog
+    catalog:
+      packageName: argocd-operator
+`
+
+func withClusterExtensionCRD(t *testing.T) {
+	t.Helper()
+	crd := loadClusterExtensionCRD(t)
+	withGetCRD(t, func(*unstructured.Unstructured) (*apiextensionsv1.CustomResourceDefinition, error) { return crd, nil })
+}
+
+func TestValidate_Valid(t *testing.T) {
+	withClusterExtensionCRD(t)
+	if response := validate(admissionReviewFor(t, validCRYAML), nil); !response.Allowed {
+		t.Fatalf("Expected a valid CR to be allowed: %v", response.Result)
+	}
+}
+
+func TestValidate_SchemaFallbackExplanation(t *testing.T) {
+	withClusterExtensionCRD(t)
+
+	crYAML := strings.Replace(validCRYAML, "sourceType: Catalog", "sourceType: catalog", 1)
+	response := validate(admissionReviewFor(t, crYAML), &mockOpenAIClient{err: fmt.Errorf("connection refused")})
+	if response.Allowed {
+		t.Fatalf("Expected the request to be denied")
+	}
+	if response.Result.Code != 422 || len(response.Result.Details.Causes) == 0 {
+		t.Errorf("Expected a 422 with causes, got %+v", response.Result)
+	}
+	if cause := response.Result.Details.Causes[0]; cause.Field != "spec.source.sourceType" {
+		t.Errorf("Unexpected cause %+v", cause)
+	}
+	for _, want := range []string{
+		`spec.source.sourceType: Unsupported value: "catalog"`,
+		`spec.source.sourceType: sourceType is a required reference to the type of install source. Allowed values: "Catalog".`,
+	} {
+		if !strings.Contains(response.Result.Message, want) {
+			t.Errorf("Expected %q in the message, got:\n%s", want, response.Result.Message)
+		}
+	}
+}
+
+func TestValidate_CELRule(t *testing.T) {
+	withClusterExtensionCRD(t)
+
+	crYAML := strings.Replace(validCRYAML, "    catalog:\n      packageName: argocd-operator\n", "", 1)
+	response := validate(admissionReviewFor(t, crYAML), nil)
+	if response.Allowed {
+		t.Fatalf("Expected the request to be denied")
+	}
+	if !strings.Contains(response.Result.Message, "sourceType Catalog requires catalog field") {
+		t.Errorf("Expected the CEL rule message, got:\n%s", response.Result.Message)
+	}
+}
+
+func TestValidate_LLMExplanation(t *testing.T) {
+	withClusterExtensionCRD(t)
+
+	client := &promptCapturingClient{response: "<think>The enum is case sensitive.</think>sourceType must be \"Catalog\" with a capital C."}
+	crYAML := strings.Replace(validCRYAML, "sourceType: Catalog", "sourceType: catalog", 1)
+	response := validate(admissionReviewFor(t, crYAML), client)
+	if response.Allowed {
+		t.Fatalf("Expected the request to be denied")
+	}
+	if !strings.HasSuffix(response.Result.Message, "sourceType must be \"Catalog\" with a capital C.") {
+		t.Errorf("Expected the model's explanation, got:\n%s", response.Result.Message)
+	}
+	if strings.Contains(response.Result.Message, "case sensitive") {
+		t.Errorf("Did not expect the model's reasoning in the message")
+	}
+	for _, want := range []string{"Unsupported value: \"catalog\"", "Allowed values: \"Catalog\"", "sourceType: catalog"} {
+		if !strings.Contains(client.prompt, want) {
+			t.Errorf("Expected %q in the prompt, got:\n%s", want, client.prompt)
+		}
+	}
+}
+
+func TestValidate_IgnoresDelete(t *testing.T) {
+	review := admissionReviewFor(t, validCRYAML)
+	review.Request.Operation = admissionv1.Delete
+	if response := validate(review, nil); !response.Allowed {
+		t.Fatalf("Expected DELETE to be allowed")
+	}
+}
@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The API server truncates warnings longer than maxWarningLength and drops warnings once their total size
+// reaches maxWarningsSize, so the webhook stays within both limits itself.
+const (
+	maxWarningLength = 256
+	maxWarningsSize  = 4096
+	maxValueLength   = 64
+)
+
+// patchOperation is one operation of a JSON patch generated by createJSONPatch.
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// parsePatch decodes a JSON patch.
+func parsePatch(patchBytes []byte) ([]patchOperation, error) {
+	var operations []patchOperation
+	if err := json.Unmarshal(patchBytes, &operations); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON Patch: %v", err)
+	}
+	return operations, nil
+}
+
+// describeOperation returns a plain-language line for a patch operation, using original for the old value.
+func describeOperation(original map[string]interface{}, operation patchOperation) string {
+	path := pointerPath(original, operation.Path)
+	old, existed := getPath(original, path)
+	existed = existed && old != nil
+
+	switch operation.Op {
+	case "add", "replace":
+		if !existed {
+			return fmt.Sprintf("%s: set to %s (was missing)", path, formatValue(operation.Value))
+		}
+		return fmt.Sprintf("%s: changed from %s to %s", path, formatValue(old), formatValue(operation.Value))
+	case "remove":
+		if !existed {
+			return fmt.Sprintf("%s: removed", path)
+		}
+		return fmt.Sprintf("%s: removed (was %s)", path, formatValue(old))
+	case "move":
+		return fmt.Sprintf("%s: moved from %s", path, pointerPath(original, operation.From))
+	case "copy":
+		return fmt.Sprintf("%s: copied from %s", path, pointerPath(original, operation.From))
+	default:
+		return fmt.Sprintf("%s: %s", path, operation.Op)
+	}
+}
+
+// pointerPath converts a JSON pointer to a fieldPath, treating a token as a list index where obj has a
+// list. The "-" token, which appends to a list, becomes the index of the new element.
+func pointerPath(obj map[string]interface{}, pointer string) fieldPath {
+	var path fieldPath
+	for _, token := range parseJSONPointer(pointer) {
+		if parent, ok := getPath(obj, path); ok {
+			if list, isList := parent.([]interface{}); isList {
+				if token == "-" {
+					path = path.child(len(list))
+					continue
+				}
+				if index, err := strconv.Atoi(token); err == nil {
+					path = path.child(index)
+					continue
+				}
+			}
+		}
+		path = path.child(token)
+	}
+	return path
+}
+
+// formatValue renders a value as compact JSON, shortened to maxValueLength characters.
+func formatValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return truncateRunes(string(data), maxValueLength)
+}
+
+// truncateRunes shortens s to at most max runes, ending it with "..." if anything was cut.
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:max-3]) + "..."
+}
+
+// limitWarnings shortens each warning to maxWarningLength and keeps as many as fit in maxWarningsSize,
+// replacing the rest with a count.
+func limitWarnings(warnings []string) []string {
+	var (
+		limited []string
+		size    int
+	)
+	for i, warning := range warnings {
+		warning = truncateRunes(strings.TrimSpace(warning), maxWarningLength)
+		remaining := len(warnings) - i - 1
+		// Keep room for the summary line if more warnings follow
+		reserve := 0
+		if remaining > 0 {
+			reserve = len(fmt.Sprintf("... and %d more changes", remaining+1))
+		}
+		if size+len(warning)+reserve > maxWarningsSize {
+			limited = append(limited, fmt.Sprintf("... and %d more changes", len(warnings)-i))
+			return limited
+		}
+		limited = append(limited, warning)
+		size += len(warning)
+	}
+	return limited
+}
@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDescribeOperation(t *testing.T) {
+	original := parseCR(t, `
+apiVersion: olm.operatorframework.io/v1alpha1
+kind: ClusterExtension
+metadata:
+  name: example
+spec:
+  install:
+    namespace: old-namespace
+  source:
+    catalog:
+      packageName:
+      channels: [stable]
+  extra: unused
+`)
+	patch := `[
+  {"op": "replace", "path": "/spec/source/catalog/packageName", "value": "argocd-operator"},
+  {"op": "replace", "path": "/spec/install/namespace", "value": "argocd"},
+  {"op": "add", "path": "/spec/install/serviceAccount", "value": {"name": "argocd-installer"}},
+  {"op": "add", "path": "/spec/source/catalog/channels/-", "value": "fast"},
+  {"op": "remove", "path": "/spec/extra"}
+]`
+
+	operations, err := parsePatch([]byte(patch))
+	if err != nil {
+		t.Fatalf("parsePatch failed: %v", err)
+	}
+	var lines []string
+	for _, operation := range operations {
+		lines = append(lines, describeOperation(original.Object, operation))
+	}
+	want := []string{
+		`spec.source.catalog.packageName: set to "argocd-operator" (was missing)`,
+		`spec.install.namespace: changed from "old-namespace" to "argocd"`,
+		`spec.install.serviceAccount: set to {"name":"argocd-installer"} (was missing)`,
+		`spec.source.catalog.channels[1]: set to "fast" (was missing)`,
+		`spec.extra: removed (was "unused")`,
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected descriptions:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestLimitWarnings(t *testing.T) {
+	long := strings.Repeat("ü", maxWarningLength+10)
+	limited := limitWarnings([]string{long})
+	if got := len([]rune(limited[0])); got != maxWarningLength || !strings.HasSuffix(limited[0], "...") {
+		t.Errorf("Expected a warning shortened to %d characters, got %d", maxWarningLength, got)
+	}
+
+	var many []string
+	for i := 0; i < 100; i++ {
+		many = append(many, strings.Repeat("x", 100))
+	}
+	limited = limitWarnings(many)
+	size := 0
+	for _, warning := range limited {
+		size += len(warning)
+	}
+	if size > maxWarningsSize {
+		t.Errorf("Expected warnings to fit in %d bytes, got %d", maxWarningsSize, size)
+	}
+	if last := limited[len(limited)-1]; last != "... and 60 more changes" {
+		t.Errorf("Unexpected summary %q", last)
+	}
+}
@@ -11,18 +11,15 @@ import (
 	"io"
 	admissionv1 "k8s.io/api/admission/v1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
-	"k8s.io/client-go/discovery"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/restmapper"
 	"log"
 	"net/http"
 	"os"
 	"sigs.k8s.io/yaml"
+	"slices"
 	"strings"
 )
 
@@ -37,44 +34,132 @@ type openaiClientInterface interface {
 	CreateChatCompletion(ctx context.Context, prompt string) (string, error)
 }
 
+const (
+	providerOpenAI = "openai"
+	providerLocal  = "local"
+
+	defaultOpenAIModel = "gpt-4o" // Use "gpt-3.5-turbo" if "gpt-4o" is not accessible
+	defaultLocalModel  = "mistral-nemo"
+)
+
+// modelInfo is implemented by LLM clients that can report which provider and model they use.
+type modelInfo interface {
+	providerName() string
+	modelName() string
+}
+
 // openAIClient is a wrapper around the OpenAI client.
 type openAIClient struct {
 	client *openai.Client
+	model  string
 }
 
 // localLLMClient is a client for the local LLM.
 type localLLMClient struct {
-	url string
+	url   string
+	model string
+}
+
+func (c *openAIClient) providerName() string { return providerOpenAI }
+func (c *openAIClient) modelName() string    { return c.model }
+
+func (c *localLLMClient) providerName() string { return providerLocal }
+func (c *localLLMClient) modelName() string    { return c.model }
+
+// describeClient returns the provider and model of an LLM client, or "unknown" for clients that don't say.
+func describeClient(client openaiClientInterface) (provider, model string) {
+	if info, ok := client.(modelInfo); ok {
+		return info.providerName(), info.modelName()
+	}
+	return "unknown", "unknown"
+}
+
+// newLLMClient initializes the client based on the presence of LOCAL_LLM_URL. LLM_MODEL overrides the default model.
+var newLLMClient = func() (openaiClientInterface, error) {
+	model := os.Getenv("LLM_MODEL")
+
+	localLLMURL := os.Getenv("LOCAL_LLM_URL")
+	if localLLMURL != "" {
+		if model == "" {
+			model = defaultLocalModel
+		}
+		return &localLLMClient{
+			url:   localLLMURL,
+			model: model,
+		}, nil
+	}
+
+	// Initialize the OpenAI client
+	openaiAPIKey := os.Getenv("OPENAI_API_KEY")
+	if openaiAPIKey == "" {
+		return nil, fmt.Errorf("neither LOCAL_LLM_URL nor OPENAI_API_KEY environment variable is set")
+	}
+	if model == "" {
+		model = defaultOpenAIModel
+	}
+	return &openAIClient{
+		client: openai.NewClient(
+			option.WithAPIKey(openaiAPIKey),
+		),
+		model: model,
+	}, nil
 }
 
 func (c *openAIClient) CreateChatCompletion(ctx context.Context, prompt string) (string, error) {
-	chatCompletion, err := c.client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+	completion, err := c.createDetailedChatCompletion(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return completion.content, nil
+}
+
+func (c *openAIClient) createDetailedChatCompletion(ctx context.Context, prompt string) (*chatCompletion, error) {
+	response, err := c.client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
 		Messages: openai.F([]openai.ChatCompletionMessageParamUnion{
 			openai.UserMessage(prompt),
 		}),
-		Model: openai.F("gpt-4o"), // Use "gpt-3.5-turbo" if "gpt-4o" is not accessible
+		Model: openai.F(c.model),
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if len(chatCompletion.Choices) == 0 {
-		return "", fmt.Errorf("no response from OpenAI")
+	if len(response.Choices) == 0 {
+		return nil, fmt.Errorf("no response from OpenAI")
 	}
 
-	return chatCompletion.Choices[0].Message.Content, nil
+	// OpenAI-compatible servers for reasoning models return the chain of thought in an extra field
+	message := response.Choices[0].Message
+	var reasoning string
+	if field, ok := message.JSON.ExtraFields["reasoning_content"]; ok {
+		_ = json.Unmarshal([]byte(field.Raw()), &reasoning)
+	}
+
+	return &chatCompletion{
+		content:   message.Content,
+		reasoning: reasoning,
+		usage: tokenUsage{
+			PromptTokens:     int(response.Usage.PromptTokens),
+			CompletionTokens: int(response.Usage.CompletionTokens),
+			ReasoningTokens:  int(response.Usage.CompletionTokensDetails.ReasoningTokens),
+		},
+	}, nil
 }
 
 func (c *localLLMClient) CreateChatCompletion(ctx context.Context, prompt string) (string, error) {
+	completion, err := c.createDetailedChatCompletion(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return completion.content, nil
+}
+
+func (c *localLLMClient) createDetailedChatCompletion(ctx context.Context, prompt string) (*chatCompletion, error) {
 	// Create the request body
 	requestBody := map[string]interface{}{
-		//"model": "granite-code:3b-instruct-128k-fp16",
-		//"model": "granite-code:8b-instruct-128k-q4_1",
-		//"model": "granite3-moe:3b",
-		//"model": "granite3-dense:8b",
-		//"model": "eas/codellama:13b-16k",
-		//"model": "llama2:13b-chat",
-		"model": "mistral-nemo",
+		// Other models tried: granite-code:3b-instruct-128k-fp16, granite-code:8b-instruct-128k-q4_1,
+		// granite3-moe:3b, granite3-dense:8b, eas/codellama:13b-16k, llama2:13b-chat
+		"model": c.model,
 
 		"messages": []map[string]string{
 			{
@@ -90,120 +175,82 @@ func (c *localLLMClient) CreateChatCompletion(ctx context.Context, prompt string
 
 	requestBodyBytes, err := json.Marshal(requestBody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Create the request
 	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(requestBodyBytes))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	// Send the request
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("non-OK HTTP status: %s, body: %s", resp.Status, string(bodyBytes))
+		return nil, fmt.Errorf("non-OK HTTP status: %s, body: %s", resp.Status, string(bodyBytes))
 	}
 
-	// Parse the response
+	// Parse the response. Reasoning models served by vLLM, llama.cpp or LM Studio return their chain of
+	// thought in reasoning_content, Ollama in reasoning.
 	var responseBody struct {
 		Choices []struct {
 			Message struct {
-				Content string `json:"content"`
+				Content          string `json:"content"`
+				ReasoningContent string `json:"reasoning_content"`
+				Reasoning        string `json:"reasoning"`
 			} `json:"message"`
 		} `json:"choices"`
+		Usage struct {
+			PromptTokens            int `json:"prompt_tokens"`
+			CompletionTokens        int `json:"completion_tokens"`
+			CompletionTokensDetails struct {
+				ReasoningTokens int `json:"reasoning_tokens"`
+			} `json:"completion_tokens_details"`
+		} `json:"usage"`
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&responseBody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(responseBody.Choices) == 0 {
-		return "", fmt.Errorf("no choices in response")
+		return nil, fmt.Errorf("no choices in response")
 	}
 
-	return responseBody.Choices[0].Message.Content, nil
+	message := responseBody.Choices[0].Message
+	reasoning := message.ReasoningContent
+	if reasoning == "" {
+		reasoning = message.Reasoning
+	}
+	return &chatCompletion{
+		content:   message.Content,
+		reasoning: reasoning,
+		usage: tokenUsage{
+			PromptTokens:     responseBody.Usage.PromptTokens,
+			CompletionTokens: responseBody.Usage.CompletionTokens,
+			ReasoningTokens:  responseBody.Usage.CompletionTokensDetails.ReasoningTokens,
+		},
+	}, nil
 }
 
 // Mutate handles the admission review requests
 func Mutate(w http.ResponseWriter, r *http.Request) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := io.ReadAll(r.Body); err == nil {
-			body = data
-		}
-	}
-
-	if len(body) == 0 {
-		http.Error(w, "Empty request body", http.StatusBadRequest)
-		return
-	}
-
-	// Verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		http.Error(w, "Invalid Content-Type, expected application/json", http.StatusUnsupportedMediaType)
-		return
-	}
-
-	var admissionReview admissionv1.AdmissionReview
-	if _, _, err := deserializer.Decode(body, nil, &admissionReview); err != nil {
-		log.Printf("Could not decode body: %v", err)
-		http.Error(w, fmt.Sprintf("Could not decode body: %v", err), http.StatusBadRequest)
-		return
-	}
-
-	// Initialize the client based on the presence of LOCAL_LLM_URL
-	var client openaiClientInterface
-	localLLMURL := os.Getenv("LOCAL_LLM_URL")
-	if localLLMURL != "" {
-		client = &localLLMClient{
-			url: localLLMURL,
-		}
-	} else {
-		// Initialize the OpenAI client
-		openaiAPIKey := os.Getenv("OPENAI_API_KEY")
-		if openaiAPIKey == "" {
-			log.Printf("Neither LOCAL_LLM_URL nor OPENAI_API_KEY environment variable is set")
-			http.Error(w, "Neither LOCAL_LLM_URL nor OPENAI_API_KEY environment variable is set", http.StatusInternalServerError)
-			return
-		}
-		client = &openAIClient{
-			client: openai.NewClient(
-				option.WithAPIKey(openaiAPIKey),
-			),
+	serveAdmission(w, r, func(ar *admissionv1.AdmissionReview) (*admissionv1.AdmissionResponse, error) {
+		client, err := newLLMClient()
+		if err != nil {
+			log.Printf("Failed to initialize LLM client: %v", err)
+			client = &unavailableClient{err: fmt.Errorf("failed to initialize LLM client: %v", err)}
 		}
-	}
-
-	// Process the AdmissionRequest
-	admissionResponse := mutate(&admissionReview, client)
-
-	// Send response
-	admissionReview.Response = admissionResponse
-	admissionReview.Response.UID = admissionReview.Request.UID
-
-	respBytes, err := json.Marshal(admissionReview)
-	if err != nil {
-		log.Printf("Could not encode response: %v", err)
-		http.Error(w, fmt.Sprintf("Could not encode response: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, writeErr := w.Write(respBytes)
-	if writeErr != nil {
-		log.Printf("Error while sending response: %v", writeErr)
-		return
-	}
+		return mutate(ar, client), nil
+	})
 }
 
 func mutate(ar *admissionv1.AdmissionReview, client openaiClientInterface) *admissionv1.AdmissionResponse {
@@ -221,11 +268,54 @@ func mutate(ar *admissionv1.AdmissionReview, client openaiClientInterface) *admi
 	cr := &unstructured.Unstructured{}
 	if _, _, err := deserializer.Decode(raw, nil, cr); err != nil {
 		log.Printf("Could not decode raw object: %v", err)
-		return toAdmissionResponse(err)
+		return failureResponse(err, nil)
 	}
 
-	// Validate the CR
-	isValid, validationErrors := ValidateCR(cr)
+	// Only correct the kinds the webhook is configured for
+	target, err := targetFor(cr)
+	if err != nil {
+		log.Printf("Failed to find correction target: %v", err)
+		return failureResponse(err, nil)
+	}
+	if target == nil {
+		log.Printf("Not correcting %s: it is not a correction target", cr.GroupVersionKind())
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// Leave the object alone if it or its requester opted out, before looking anything up in the cluster
+	mode, reason, err := correctionModeFor(req, cr)
+	if err != nil {
+		log.Printf("Failed to determine correction mode: %v", err)
+		return failureResponse(err, nil)
+	}
+	if mode == correctionModeOff {
+		log.Printf("Not correcting %s: correction mode is off, set by %s", cr.GroupVersionKind(), reason)
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// Validate the CR, against its CRD unless its kind has checks of its own
+	var crd *apiextensionsv1.CustomResourceDefinition
+	if !hasSemanticChecks(cr) {
+		if crd, err = getCRD(cr); err != nil {
+			log.Printf("Failed to retrieve CRD: %v", err)
+			return failureResponse(err, nil)
+		}
+		// Corrections only change the target's fields, spec unless it names others, like data for ConfigMaps
+		if schema := versionSchema(crd, cr.GroupVersionKind().Version); schema != nil {
+			fields := target.correctedFields()
+			if !slices.ContainsFunc(fields, func(field string) bool { _, ok := schema.Properties[field]; return ok }) {
+				log.Printf("Not correcting %s: its schema has none of the corrected fields %s; set the fields of its target", cr.GroupVersionKind(), strings.Join(fields, ", "))
+				return &admissionv1.AdmissionResponse{
+					Allowed: true,
+				}
+			}
+		}
+	}
+	isValid, validationErrors := validateObject(cr, crd)
 	if isValid {
 		// CR is valid, allow it
 		return &admissionv1.AdmissionResponse{
@@ -234,45 +324,71 @@ func mutate(ar *admissionv1.AdmissionReview, client openaiClientInterface) *admi
 	}
 
 	log.Printf("CR is invalid: %s", validationErrors)
+	log.Printf("Correction mode is %s, set by %s", mode, reason)
 
-	crd, err := getCRD(cr)
-	if err != nil {
-		log.Printf("Failed to retrieve CRD: %v", err)
-		return toAdmissionResponse(err)
+	// In shadow mode, admit the object unchanged and correct it in the background. Dry runs aren't recorded
+	dryRun := isDryRun(req)
+	if mode == correctionModeShadow {
+		if !dryRun {
+			shadowCorrection(req, cr, validationErrors, client)
+		}
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
 	}
 
-	// Adjust the CR using an LLM
-	adjustedCR, err := AdjustCRWithLLM(cr, crd, client)
+	if dryRun && defaultDryRunPolicy() == dryRunSkip {
+		log.Printf("Not correcting dry-run request")
+		return dryRunResponse(validationErrors)
+	}
+
+	result, err := correctObject(req, cr, client, dryRun)
 	if err != nil {
-		log.Printf("Failed to adjust CR with LLM: %v", err)
-		return toAdmissionResponse(err)
+		return failureResponse(err, result.warnings)
+	}
+	if result == nil {
+		return dryRunResponse(validationErrors)
 	}
+	adjustedCR, operations, warnings := result.adjusted, result.operations, result.warnings
 
-	// Validate the adjusted CR
-	isValid, validationErrors = ValidateCR(adjustedCR)
-	if !isValid {
-		log.Printf("Adjusted CR is still invalid: %s", validationErrors)
-		return toAdmissionResponse(fmt.Errorf("adjusted CR is still invalid: %s", validationErrors))
+	// In suggest mode, show the correction instead of applying it
+	if mode == correctionModeSuggest {
+		return suggestionResponse(cr, adjustedCR, warnings)
 	}
 
-	// Create a patch
-	originalJSON, err := json.Marshal(cr.Object)
-	if err != nil {
-		return toAdmissionResponse(err)
+	// Record on the object that it was corrected, and by what
+	if len(operations) > 0 {
+		if err := addProvenance(adjustedCR, cr, client, operations); err != nil {
+			return failureResponse(err, warnings)
+		}
 	}
-	adjustedJSON, err := json.Marshal(adjustedCR.Object)
-	if err != nil {
-		return toAdmissionResponse(err)
+
+	// In approve mode, propose the correction instead of applying it. The original is saved when the
+	// proposal is applied, so proposals that never are leave nothing behind
+	if mode == correctionModeApprove {
+		patchBytes, err := patchFor(cr, adjustedCR)
+		if err != nil {
+			return failureResponse(err, warnings)
+		}
+		return proposalResponse(req, cr, adjustedCR, patchBytes, result.correction, validationErrors, client, warnings)
+	}
+
+	if len(operations) > 0 {
+		if err := saveOriginal(context.TODO(), req, cr, adjustedCR); err != nil {
+			log.Printf("Failed to save original: %v", err)
+			warnings = append(warnings, fmt.Sprintf("the original spec was not saved and can't be restored with the revert command: %v", err))
+		}
 	}
-	patchBytes, err := createJSONPatch(originalJSON, adjustedJSON)
+	patchBytes, err := patchFor(cr, adjustedCR)
 	if err != nil {
-		return toAdmissionResponse(err)
+		return failureResponse(err, warnings)
 	}
 
 	// Return the patch in the admission response
 	return &admissionv1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
+		Allowed:  true,
+		Patch:    patchBytes,
+		Warnings: limitWarnings(warnings),
 		PatchType: func() *admissionv1.PatchType {
 			pt := admissionv1.PatchTypeJSONPatch
 			return &pt
@@ -281,8 +397,43 @@ func mutate(ar *admissionv1.AdmissionReview, client openaiClientInterface) *admi
 }
 
 func AdjustCRWithLLM(cr *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition, client openaiClientInterface) (*unstructured.Unstructured, error) {
+	correction, err := adjustCRWithLLM(cr, crd, client, nil)
+	if correction != nil {
+		provider, model := describeClient(client)
+		addUsage(provider, model, correction.usage)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return correction.adjusted, nil
+}
+
+// llmCorrection is the outcome of asking the model for a correction. Reasoning and usage are set as soon
+// as the model has answered, even if the answer is then rejected.
+type llmCorrection struct {
+	adjusted  *unstructured.Unstructured
+	reasoning string
+	usage     tokenUsage
+}
+
+func adjustCRWithLLM(cr *unstructured.Unstructured, crd *apiextensionsv1.CustomResourceDefinition, client openaiClientInterface, update *updateScope) (*llmCorrection, error) {
+	// Keep instruction-like content in the CR away from the model
+	suspicious := findSuspiciousValues(cr)
+	promptCR := cr
+	if len(suspicious) > 0 {
+		paths := make([]string, 0, len(suspicious))
+		for _, s := range suspicious {
+			log.Printf("Instruction-like content in %s: %q", s.path, s.value)
+			paths = append(paths, s.path.String())
+		}
+		if promptInjectionAction() == injectionActionRefuse {
+			return nil, classify(failurePolicyViolation, fmt.Errorf("refusing LLM correction: instruction-like content in %s", strings.Join(paths, ", ")))
+		}
+		promptCR = redactSuspiciousValues(cr, suspicious)
+	}
+
 	// Convert CR to YAML
-	crYAML, err := yaml.Marshal(cr.Object)
+	crYAML, err := yaml.Marshal(promptCR.Object)
 	if err != nil {
 		log.Printf("Error marshalling CR to YAML: %v", err)
 		return nil, err
@@ -297,105 +448,130 @@ func AdjustCRWithLLM(cr *unstructured.Unstructured, crd *apiextensionsv1.CustomR
 	}
 	log.Printf("CRD YAML:\n%s\n", string(crdYAML))
 
-	// Construct the prompt to send to OpenAI/LLM
-	prompt := fmt.Sprintf(`You are an expert in Kubernetes custom resources.
-
-**Definitions:**
-
-- **Custom Resource Definition (CRD):** A schema that defines the structure and validation rules for a custom resource in Kubernetes.
-- **Custom Resource (CR):** An instance of a custom resource that must conform to the schema defined by a CRD.
-
-**Task:**
-
-Given the following Custom Resource Definition (CRD):
-
----
-%s
----
-
-And the following Custom Resource (CR) that may not conform to the CRD:
-
----
-%s
----
+	// Pick the curated examples closest to the current validation errors
+	target, err := targetFor(cr)
+	if err != nil {
+		return nil, err
+	}
+	var validationErrors []string
+	if isValid, message := validateObject(cr, crd); !isValid {
+		validationErrors = append(validationErrors, message)
+	}
+	examples := target.exampleLibrary().selectExamples(validationErrors, string(crYAML), cr.GetAPIVersion(), maxFewShotExamples())
+	for _, example := range examples {
+		log.Printf("Using few-shot example %q", example.Name)
+	}
 
-Please adjust the CR so that it conforms to the CRD schema.
+	// Ground the correction in names that actually exist in the cluster
+	clusterCtx := gatherClusterContext(context.TODO(), cr)
 
-- Return only the corrected CR in YAML format.
-- Exclude 'annotations', 'managedFields', 'status', and any other unnecessary fields.
-- Do not include any explanations, notes, or additional text.`, string(crdYAML), string(crYAML))
+	// Construct the prompt to send to OpenAI/LLM, shrunk to fit the model's context window
+	prompt, err := fitPrompt(client, cr, crd, promptInput{
+		crdYAML:        string(crdYAML),
+		crYAML:         string(crYAML),
+		examples:       examples,
+		fenceID:        newFenceID(),
+		clusterContext: clusterCtx,
+		update:         update,
+		instructions:   target.instructions(),
+	}, validationErrors)
+	if err != nil {
+		log.Printf("Error building prompt: %v", err)
+		return nil, err
+	}
 
 	log.Printf("Generated OpenAI/LLM prompt:\n%s\n", prompt)
 
-	// Call the OpenAI or LLM client
-	adjustedCRYAML, err := client.CreateChatCompletion(context.TODO(), prompt)
+	// Call the OpenAI or LLM client, separating any reasoning from the answer
+	completion, err := complete(context.TODO(), client, prompt)
 	if err != nil {
 		log.Printf("Error from OpenAI/LLM API: %v", err)
-		return nil, err
+		return nil, classify(failureLLMUnavailable, err)
+	}
+	provider, model := describeClient(client)
+	correction := &llmCorrection{
+		reasoning: completion.reasoning,
+		usage:     measureUsage(provider, model, prompt, completion),
+	}
+	if completion.reasoning != "" {
+		log.Printf("Removed %d characters of model reasoning from the response", len(completion.reasoning))
 	}
+	adjustedCRYAML := completion.content
 	log.Printf("Raw Adjusted CR YAML from OpenAI/LLM:\n%s\n", adjustedCRYAML)
 
-	// Extract YAML content from the LLM response
-	adjustedCRYAML = extractYAMLContent(adjustedCRYAML)
-	log.Printf("Adjusted CR YAML after extracting YAML content:\n%s\n", adjustedCRYAML)
-
-	// Verify if response contains valid YAML by checking for essential keywords
-	if !strings.Contains(adjustedCRYAML, "apiVersion:") && !strings.Contains(adjustedCRYAML, "kind:") {
-		log.Printf("Response does not appear to contain valid YAML. Response:\n%s\n", adjustedCRYAML)
-		return nil, fmt.Errorf("model returned non-YAML content instead of corrected CR")
+	// Mark control characters, zero-width characters and BOMs for removal, keeping all other UTF-8
+	adjustedCRYAML, removed := markUnsafeRunes(adjustedCRYAML)
+	for _, r := range removed {
+		log.Printf("Removing character from model response at %s", r)
 	}
 
-	// Remove any non-printable characters to sanitize the YAML
-	adjustedCRYAML = strings.Map(func(r rune) rune {
-		if r == '\n' || r == '\r' || (r >= ' ' && r <= '~') {
-			return r
-		}
-		return -1
-	}, adjustedCRYAML)
+	// Find the corrected CR in the response
+	adjustedCR, sanitizedPaths, err := parseLLMResponse(adjustedCRYAML, cr)
+	if err != nil {
+		log.Printf("Failed to parse adjusted CR from response: %v", err)
+		return correction, classify(failureCorrectionInvalid, err)
+	}
+	// Take only the corrected fields from the model; identity and server-managed fields always come from
+	// the original
+	adjustedCR = mergeCorrection(cr, adjustedCR, target.correctedFields())
+	log.Printf("Adjusted CR: %v", adjustedCR.Object)
 
-	log.Printf("Adjusted CR YAML after cleaning:\n%s\n", adjustedCRYAML)
+	// Reject the correction if sanitizing changed a value that would be patched
+	for _, path := range sanitizedPaths {
+		log.Printf("Sanitization changed %s", path)
+	}
+	if err := checkSanitizedPaths(cr, adjustedCR, sanitizedPaths); err != nil {
+		log.Printf("Rejecting adjusted CR: %v", err)
+		return correction, classify(failureCorrectionInvalid, err)
+	}
 
-	// Attempt to convert YAML to JSON
-	log.Printf("Attempting to convert adjusted CR YAML to JSON")
-	adjustedCRJSON, err := yaml.YAMLToJSON([]byte(adjustedCRYAML))
-	if err != nil {
-		log.Printf("Failed to convert adjusted CR YAML to JSON: %v", err)
-		log.Printf("Raw adjusted CR YAML causing error:\n%s\n", adjustedCRYAML) // Debugging raw YAML on error
-		return nil, fmt.Errorf("failed to convert adjusted CR YAML to JSON: %v", err)
+	// Undo redactions and reject values lifted from instruction-like content
+	restoreRedactedValues(adjustedCR, suspicious)
+	if err := findCopiedValues(cr, adjustedCR, suspicious); err != nil {
+		log.Printf("Rejecting adjusted CR: %v", err)
+		return correction, classify(failurePolicyViolation, err)
 	}
-	log.Printf("Adjusted CR JSON:\n%s\n", string(adjustedCRJSON))
 
-	// Unmarshal JSON into unstructured.Unstructured
-	adjustedCR := &unstructured.Unstructured{}
-	err = adjustedCR.UnmarshalJSON(adjustedCRJSON)
-	if err != nil {
-		log.Printf("Failed to unmarshal adjusted CR JSON: %v", err)
-		return nil, fmt.Errorf("failed to unmarshal adjusted CR JSON: %v", err)
+	// Reject names the model invented
+	groundServiceAccounts(context.TODO(), adjustedCR, clusterCtx)
+	if err := checkGrounding(cr, adjustedCR, clusterCtx); err != nil {
+		log.Printf("Rejecting adjusted CR: %v", err)
+		return correction, classify(failureCorrectionInvalid, err)
 	}
 
-	return adjustedCR, nil
+	correction.adjusted = adjustedCR
+	return correction, nil
 }
 
-// Helper function to extract YAML content from the LLM response
-func extractYAMLContent(response string) string {
-	var yamlLines []string
-	lines := strings.Split(response, "\n")
-	inYAMLBlock := false
-	for _, line := range lines {
-		trimmedLine := strings.TrimSpace(line)
-		// Start collecting when we find the 'apiVersion' or 'kind' field
-		if strings.HasPrefix(trimmedLine, "apiVersion:") || strings.HasPrefix(trimmedLine, "kind:") {
-			inYAMLBlock = true
-		}
-		// Stop collecting if we reach a note or end of the YAML block
-		if inYAMLBlock {
-			if strings.HasPrefix(trimmedLine, "Note:") || strings.HasPrefix(trimmedLine, "```") {
-				break
-			}
-			yamlLines = append(yamlLines, line)
-		}
+// validationFailure describes a message returned by ValidateCR: the kind of problem and the field it refers to.
+type validationFailure struct {
+	errorType string
+	path      string
+}
+
+// validationFailures maps the messages returned by ValidateCR to their error type and failing path.
+var validationFailures = map[string]validationFailure{
+	"spec field is missing":                {errorType: "missing-spec", path: "spec"},
+	"install field is missing":             {errorType: "missing-install", path: "spec.install"},
+	"namespace is missing in install":      {errorType: "missing-namespace", path: "spec.install.namespace"},
+	"serviceAccount is missing in install": {errorType: "missing-service-account", path: "spec.install.serviceAccount"},
+	"serviceAccount name is missing":       {errorType: "missing-service-account-name", path: "spec.install.serviceAccount.name"},
+	"source field is missing":              {errorType: "missing-source", path: "spec.source"},
+	"sourceType is missing in source":      {errorType: "missing-source-type", path: "spec.source.sourceType"},
+	"catalog is missing in source":         {errorType: "missing-catalog", path: "spec.source.catalog"},
+	"packageName is missing in catalog":    {errorType: "missing-package-name", path: "spec.source.catalog.packageName"},
+	// In v1, the namespace and the service account are at the top of spec
+	"namespace is missing in spec":           {errorType: "missing-namespace", path: "spec.namespace"},
+	"serviceAccount is missing in spec":      {errorType: "missing-service-account", path: "spec.serviceAccount"},
+	"serviceAccount name is missing in spec": {errorType: "missing-service-account-name", path: "spec.serviceAccount.name"},
+}
+
+// classifyValidationError returns the error type for a ValidateCR message, or "unknown" if it is not recognized.
+func classifyValidationError(message string) string {
+	if failure, ok := validationFailures[message]; ok {
+		return failure.errorType
 	}
-	return strings.Join(yamlLines, "\n")
+	return "unknown"
 }
 
 func ValidateCR(cr *unstructured.Unstructured) (bool, string) {
@@ -408,26 +584,32 @@ func ValidateCR(cr *unstructured.Unstructured) (bool, string) {
 	// Add logging to check what's inside spec
 	fmt.Printf("Validating CR Spec: %+v\n", spec)
 
-	install, found, err := unstructured.NestedMap(spec, "install")
-	if err != nil || !found {
-		return false, "install field is missing"
-	}
+	if cr.GroupVersionKind().Version == "v1" {
+		if isValid, message := validateV1Install(spec); !isValid {
+			return false, message
+		}
+	} else {
+		install, found, err := unstructured.NestedMap(spec, "install")
+		if err != nil || !found {
+			return false, "install field is missing"
+		}
 
-	// Validate install.namespace
-	_, found, err = unstructured.NestedString(install, "namespace")
-	if err != nil || !found {
-		return false, "namespace is missing in install"
-	}
+		// Validate install.namespace
+		_, found, err = unstructured.NestedString(install, "namespace")
+		if err != nil || !found {
+			return false, "namespace is missing in install"
+		}
 
-	// Validate install.serviceAccount
-	serviceAccount, found, err := unstructured.NestedMap(install, "serviceAccount")
-	if err != nil || !found {
-		return false, "serviceAccount is missing in install"
-	}
+		// Validate install.serviceAccount
+		serviceAccount, found, err := unstructured.NestedMap(install, "serviceAccount")
+		if err != nil || !found {
+			return false, "serviceAccount is missing in install"
+		}
 
-	_, found, err = unstructured.NestedString(serviceAccount, "name")
-	if err != nil || !found {
-		return false, "serviceAccount name is missing"
+		_, found, err = unstructured.NestedString(serviceAccount, "name")
+		if err != nil || !found {
+			return false, "serviceAccount name is missing"
+		}
 	}
 
 	// Validate source
@@ -456,6 +638,59 @@ func ValidateCR(cr *unstructured.Unstructured) (bool, string) {
 	return true, ""
 }
 
+// validateV1Install checks the install settings of a v1 ClusterExtension, which are at the top of its spec
+// instead of under spec.install.
+func validateV1Install(spec map[string]interface{}) (bool, string) {
+	_, found, err := unstructured.NestedString(spec, "namespace")
+	if err != nil || !found {
+		return false, "namespace is missing in spec"
+	}
+
+	serviceAccount, found, err := unstructured.NestedMap(spec, "serviceAccount")
+	if err != nil || !found {
+		return false, "serviceAccount is missing in spec"
+	}
+
+	_, found, err = unstructured.NestedString(serviceAccount, "name")
+	if err != nil || !found {
+		return false, "serviceAccount name is missing in spec"
+	}
+	return true, ""
+}
+
+// legacyLayoutWarning explains why a v1 ClusterExtension written in the v1alpha1 layout lost its install
+// namespace and service account: the API server pruned them from spec.install before the webhook saw it.
+const legacyLayoutWarning = "spec.namespace and spec.serviceAccount are both missing: olm.operatorframework.io/v1 moved them out of " +
+	"spec.install, so if the manifest sets them there, the API server dropped them; move them to the top of spec"
+
+// legacyLayoutWarnings returns legacyLayoutWarning for a v1 ClusterExtension that has neither an install
+// namespace nor a service account, which is how one written in the v1alpha1 layout arrives.
+func legacyLayoutWarnings(cr *unstructured.Unstructured) []string {
+	gvk := cr.GroupVersionKind()
+	if gvk.GroupKind() != clusterExtensionKind || gvk.Version != "v1" {
+		return nil
+	}
+	_, hasNamespace, _ := unstructured.NestedFieldNoCopy(cr.Object, "spec", "namespace")
+	_, hasServiceAccount, _ := unstructured.NestedFieldNoCopy(cr.Object, "spec", "serviceAccount")
+	if hasNamespace || hasServiceAccount {
+		return nil
+	}
+	return []string{legacyLayoutWarning}
+}
+
+// patchFor returns the JSON patch that turns original into adjusted.
+func patchFor(original, adjusted *unstructured.Unstructured) ([]byte, error) {
+	originalJSON, err := json.Marshal(original.Object)
+	if err != nil {
+		return nil, err
+	}
+	adjustedJSON, err := json.Marshal(adjusted.Object)
+	if err != nil {
+		return nil, err
+	}
+	return createJSONPatch(originalJSON, adjustedJSON)
+}
+
 func createJSONPatch(originalJSON, modifiedJSON []byte) ([]byte, error) {
 	// Generate the JSON Patch
 	patch, err := jsondiff.CompareJSON(originalJSON, modifiedJSON)
@@ -481,52 +716,11 @@ func toAdmissionResponse(err error) *admissionv1.AdmissionResponse {
 	}
 }
 
+// getCRD returns the CRD of an object's kind or, for built-in kinds, one made from their OpenAPI v3 schema.
 var getCRD = func(cr *unstructured.Unstructured) (*apiextensionsv1.CustomResourceDefinition, error) {
-	// Build the client configuration
-	config, err := rest.InClusterConfig()
+	crds, err := sharedCRDCache()
 	if err != nil {
 		return nil, err
 	}
-
-	// Create the API extensions client
-	apiExtensionsClient, err := apiextensionsclientset.NewForConfig(config)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create the discovery client
-	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create discovery client: %v", err)
-	}
-
-	// Get the GroupVersionKind (GVK) of the resource
-	gvk := cr.GroupVersionKind()
-
-	// Get the preferred API resources
-	groupResources, err := restmapper.GetAPIGroupResources(discoveryClient)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get API group resources: %v", err)
-	}
-
-	// Build the REST mapper
-	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
-
-	// Map the GVK to a REST mapping
-	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
-	if err != nil {
-		return nil, fmt.Errorf("failed to map GVK: %v", err)
-	}
-
-	// The name of the CRD is the plural form of the resource plus the group name
-	plural := mapping.Resource.Resource
-	crdName := fmt.Sprintf("%s.%s", plural, gvk.Group)
-
-	// Get the CRD
-	crd, err := apiExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Get(context.Background(), crdName, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve CRD: %v", err)
-	}
-
-	return crd, nil
+	return crds.get(context.Background(), cr)
 }
@@ -3,6 +3,7 @@ package webhook
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
 	"testing"
 
@@ -405,3 +406,124 @@ func replaceValue(obj *map[string]interface{}, path string, value interface{}) {
 		}
 	}
 }
+
+const clusterExtensionV1CRDYAML = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: clusterextensions.olm.operatorframework.io
+spec:
+  group: olm.operatorframework.io
+  scope: Cluster
+  names:
+    kind: ClusterExtension
+    plural: clusterextensions
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            properties:
+              namespace:
+                type: string
+              serviceAccount:
+                type: object
+                properties:
+                  name:
+                    type: string
+              install:
+                type: object
+                properties:
+                  preflight:
+                    type: object
+                    properties:
+                      crdUpgradeSafety:
+                        type: object
+                        properties:
+                          enforcement:
+                            type: string
+                            enum: ["None", "Strict"]
+              source:
+                type: object
+                properties:
+                  sourceType:
+                    type: string
+                  catalog:
+                    type: object
+                    properties:
+                      packageName:
+                        type: string
+`
+
+const validV1CRYAML = `
+apiVersion: olm.operatorframework.io/v1
+kind: ClusterExtension
+metadata:
+  name: argocd
+spec:
+  namespace: argocd
+  serviceAccount:
+    name: argocd-installer
+  source:
+    sourceType: Catalog
+    catalog:
+      packageName: argocd-operator
+`
+
+func clusterExtensionV1CRD(*unstructured.Unstructured) (*apiextensionsv1.CustomResourceDefinition, error) {
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := yaml.Unmarshal([]byte(clusterExtensionV1CRDYAML), crd); err != nil {
+		return nil, err
+	}
+	return crd, nil
+}
+
+func TestValidateCR_V1(t *testing.T) {
+	if isValid, message := ValidateCR(parseCR(t, validV1CRYAML)); !isValid {
+		t.Errorf("Expected the v1 CR to be valid, got %s", message)
+	}
+	// The v1alpha1 layout is invalid in v1
+	if isValid, message := ValidateCR(parseCR(t, strings.Replace(validCRYAML, "/v1alpha1", "/v1", 1))); isValid || message != "namespace is missing in spec" {
+		t.Errorf("Expected the v1alpha1 layout to be invalid in v1, got %v: %s", isValid, message)
+	}
+	if failure := validationFailures["serviceAccount name is missing in spec"]; failure.path != "spec.serviceAccount.name" {
+		t.Errorf("Unexpected path %q for the v1 service account name", failure.path)
+	}
+}
+
+func TestMutate_V1LegacyLayoutWarning(t *testing.T) {
+	withGetCRD(t, clusterExtensionV1CRD)
+	withEmptyCorrectionCache(t)
+
+	// What the API server leaves of a v1 ClusterExtension written in the v1alpha1 layout
+	prunedYAML := `
+apiVersion: olm.operatorframework.io/v1
+kind: ClusterExtension
+metadata:
+  name: argocd
+spec:
+  source:
+    sourceType: Catalog
+    catalog:
+      packageName: argocd-operator
+`
+	response := mutate(admissionReviewFor(t, prunedYAML), &mockOpenAIClient{response: validV1CRYAML})
+	if !response.Allowed || response.Patch == nil {
+		t.Fatalf("Expected the CR to be corrected, got %+v", response)
+	}
+	if len(response.Warnings) == 0 || response.Warnings[0] != legacyLayoutWarning {
+		t.Errorf("Expected the v1 layout warning first, got %q", response.Warnings)
+	}
+
+	// An object that only misses one of them isn't in the old layout
+	missingNamespaceYAML := strings.Replace(validV1CRYAML, "  namespace: argocd\n", "", 1)
+	response = mutate(admissionReviewFor(t, missingNamespaceYAML), &mockOpenAIClient{response: validV1CRYAML})
+	if slices.Contains(response.Warnings, legacyLayoutWarning) {
+		t.Errorf("Did not expect the v1 layout warning, got %q", response.Warnings)
+	}
+}